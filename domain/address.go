@@ -0,0 +1,71 @@
+package domain
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+
+	"github.com/aleksannder/gochain/util"
+)
+
+// Addresses are Base58Check encoded: version byte, 20 byte hash and checksum
+const addressHashLen = 20
+const addressLen = 1 + addressHashLen + addressChecksumLen
+
+// Address is a decoded address, Hash is the hash of a public key or of a multisig
+// redeem script depending on Version
+type Address struct {
+	Version byte
+	Hash    []byte
+}
+
+// ParseAddress decodes and checks an address, rejecting characters outside the Base58
+// alphabet, the wrong length, unknown versions and checksum mismatches
+func ParseAddress(address string) (Address, error) {
+	payload, err := util.Base58Decode([]byte(address))
+	if err != nil {
+		return Address{}, fmt.Errorf("address %s: %s", address, err)
+	}
+	if len(payload) != addressLen {
+		return Address{}, fmt.Errorf("address %s decodes to %d bytes, expected %d", address, len(payload), addressLen)
+	}
+
+	data := payload[:len(payload)-addressChecksumLen]
+	if !bytes.Equal(checksum(data), payload[len(payload)-addressChecksumLen:]) {
+		return Address{}, fmt.Errorf("address %s has a wrong checksum", address)
+	}
+
+	version := data[0]
+	if version != chainParams.ScriptHashVersion && !isAddressVersion(version) {
+		return Address{}, fmt.Errorf("address %s has unknown version %#02x", address, version)
+	}
+
+	return Address{version, append([]byte{}, data[1:]...)}, nil
+}
+
+func (a Address) String() string {
+	return string(encodeAddress(a.Version, a.Hash))
+}
+
+func (a Address) IsMultiSig() bool {
+	return a.Version == chainParams.ScriptHashVersion
+}
+
+// LockingScript returns the standard script paying to the address, P2SH for multisig addresses
+func (a Address) LockingScript() []byte {
+	if a.IsMultiSig() {
+		return NewP2SHScript(a.Hash)
+	}
+
+	return NewP2PKHScript(a.Hash)
+}
+
+// mustParseAddress is ParseAddress for addresses that were validated before
+func mustParseAddress(address string) Address {
+	parsed, err := ParseAddress(address)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return parsed
+}
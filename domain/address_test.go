@@ -0,0 +1,61 @@
+package domain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestParseAddress(t *testing.T) {
+	hash, _ := hex.DecodeString("010966776006953d5567439e5e39f86a0d273bee")
+	valid := "16UwLL9Risc3QfPqBUvKofHmBQ7wMtjvM"
+
+	tests := []struct {
+		name    string
+		address string
+		version byte
+		err     string
+	}{
+		{"pubkey hash", valid, 0x00, ""},
+		{"leading zero version", string(encodeAddress(0x00, make([]byte, addressHashLen))), 0x00, ""},
+		{"script hash", string(encodeAddress(0x05, hash)), 0x05, ""},
+		{"secp256k1", string(encodeAddress(0x26, hash)), 0x26, ""},
+		{"bad checksum", "16UwLL9Risc3QfPqBUvKofHmBQ7wMtjvN", 0, "wrong checksum"},
+		{"wrong version", string(encodeAddress(0x6f, hash)), 0, "unknown version"},
+		{"truncated", valid[:len(valid)-1], 0, "decodes to"},
+		{"too long", string(encodeAddress(0x00, make([]byte, addressHashLen+1))), 0, "decodes to"},
+		{"empty", "", 0, "decodes to"},
+		{"invalid character", "16UwLL9Risc3QfPqBUvKofHmBQ7wMtjv0", 0, "invalid base58 character"},
+	}
+
+	defer SelectNetwork(chainParams.Name)
+	if err := SelectNetwork(MainNetParams.Name); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		address, err := ParseAddress(test.address)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: ParseAddress(%q) = %v, %v, expected an error with %q", test.name, test.address, address, err, test.err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: ParseAddress(%q) failed: %s", test.name, test.address, err)
+			continue
+		}
+		if address.Version != test.version || len(address.Hash) != addressHashLen {
+			t.Errorf("%s: ParseAddress(%q) = %v, expected version %#02x", test.name, test.address, address, test.version)
+		}
+		if address.String() != test.address {
+			t.Errorf("%s: %q doesn't round trip, got %q", test.name, test.address, address)
+		}
+	}
+
+	parsed, _ := ParseAddress(valid)
+	if !bytes.Equal(parsed.Hash, hash) {
+		t.Errorf("ParseAddress(%q) hash = %x, expected %x", valid, parsed.Hash, hash)
+	}
+}
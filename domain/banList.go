@@ -0,0 +1,171 @@
+package domain
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const banListFile = "banlist_%s.json"
+
+// Peers reaching banThreshold misbehavior points are banned for defaultBanTime
+const banThreshold = 100
+const defaultBanTime = 24 * time.Hour
+
+// BanEntry is a banned IP or subnet, single IPs are written as /32 or /128 subnets
+type BanEntry struct {
+	Subnet      string `json:"subnet"`
+	BannedUntil int64  `json:"banned_until"` // Unix time
+	Reason      string `json:"reason"`
+}
+
+// BanList is the set of banned subnets, saved to the data directory on every change
+type BanList struct {
+	file string
+
+	mu      sync.Mutex
+	entries map[string]BanEntry
+}
+
+func LoadBanList(nodeID string) (*BanList, error) {
+	bl := BanList{file: config.dataFile(fmt.Sprintf(banListFile, nodeID)), entries: make(map[string]BanEntry)}
+
+	content, err := os.ReadFile(bl.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return &bl, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []BanEntry
+	if err := json.Unmarshal(content, &entries); err != nil {
+		return nil, fmt.Errorf("%s: %s", bl.file, err)
+	}
+	for _, entry := range entries {
+		bl.entries[entry.Subnet] = entry
+	}
+
+	return &bl, nil
+}
+
+// parseSubnet accepts an IP or a subnet in CIDR notation
+func parseSubnet(subnet string) (*net.IPNet, error) {
+	if ip := net.ParseIP(subnet); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, ipNet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return nil, fmt.Errorf("%s is neither an IP nor a subnet", subnet)
+	}
+
+	return ipNet, nil
+}
+
+// Ban bans subnet until the given time, replacing an earlier ban of the same subnet
+func (bl *BanList) Ban(subnet string, until time.Time, reason string) (string, error) {
+	ipNet, err := parseSubnet(subnet)
+	if err != nil {
+		return "", err
+	}
+
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	bl.entries[ipNet.String()] = BanEntry{ipNet.String(), until.Unix(), reason}
+
+	return ipNet.String(), bl.save()
+}
+
+func (bl *BanList) Unban(subnet string) error {
+	ipNet, err := parseSubnet(subnet)
+	if err != nil {
+		return err
+	}
+
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	if _, ok := bl.entries[ipNet.String()]; !ok {
+		return fmt.Errorf("%s isn't banned", ipNet)
+	}
+	delete(bl.entries, ipNet.String())
+
+	return bl.save()
+}
+
+func (bl *BanList) Clear() error {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	bl.entries = make(map[string]BanEntry)
+
+	return bl.save()
+}
+
+// List returns the bans in force, sorted by subnet
+func (bl *BanList) List() []BanEntry {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	var entries []BanEntry
+	now := time.Now().Unix()
+	for _, entry := range bl.entries {
+		if entry.BannedUntil > now {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Subnet < entries[j].Subnet
+	})
+
+	return entries
+}
+
+func (bl *BanList) IsBanned(ip net.IP) bool {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	now := time.Now().Unix()
+	for subnet, entry := range bl.entries {
+		if entry.BannedUntil <= now {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(subnet)
+		if err == nil && ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// save writes the bans in force, expired ones are dropped
+func (bl *BanList) save() error {
+	entries := []BanEntry{}
+	now := time.Now().Unix()
+	for subnet, entry := range bl.entries {
+		if entry.BannedUntil <= now {
+			delete(bl.entries, subnet)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	content, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(bl.file, append(content, '\n'), 0644)
+}
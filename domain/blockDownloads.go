@@ -0,0 +1,76 @@
+package domain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"sync"
+)
+
+// blockDownloads holds the blocks asked for with getdata, only those are accepted
+// from peers, and the blocks of an inv that are fetched one after another
+var blockDownloads = struct {
+	sync.Mutex
+	requested map[string]bool
+	inTransit [][]byte
+}{requested: make(map[string]bool)}
+
+func markBlockRequested(hash []byte) {
+	blockDownloads.Lock()
+	blockDownloads.requested[hex.EncodeToString(hash)] = true
+	blockDownloads.Unlock()
+}
+
+// takeBlockRequest reports whether the block was requested and forgets the request
+func takeBlockRequest(hash []byte) bool {
+	blockDownloads.Lock()
+	defer blockDownloads.Unlock()
+
+	requested := blockDownloads.requested[hex.EncodeToString(hash)]
+	delete(blockDownloads.requested, hex.EncodeToString(hash))
+
+	return requested
+}
+
+// isBlockPending reports whether the block was requested or is about to be
+func isBlockPending(hash []byte) bool {
+	blockDownloads.Lock()
+	defer blockDownloads.Unlock()
+
+	if blockDownloads.requested[hex.EncodeToString(hash)] {
+		return true
+	}
+	for _, b := range blockDownloads.inTransit {
+		if bytes.Equal(b, hash) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func setBlocksInTransit(hashes [][]byte) {
+	blockDownloads.Lock()
+	blockDownloads.inTransit = hashes
+	blockDownloads.Unlock()
+}
+
+// nextBlockInTransit takes the next block to fetch, nil when there is none
+func nextBlockInTransit() []byte {
+	blockDownloads.Lock()
+	defer blockDownloads.Unlock()
+
+	if len(blockDownloads.inTransit) == 0 {
+		return nil
+	}
+	next := blockDownloads.inTransit[0]
+
+	var rest [][]byte
+	for _, b := range blockDownloads.inTransit {
+		if !bytes.Equal(b, next) {
+			rest = append(rest, b)
+		}
+	}
+	blockDownloads.inTransit = rest
+
+	return next
+}
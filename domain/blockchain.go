@@ -2,7 +2,6 @@ package domain
 
 import (
 	"bytes"
-	"crypto/ecdsa"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -13,7 +12,6 @@ import (
 
 const dbFile = "blockchain_%s.db"
 const blocksBucket = "blocks"
-const genesisCoinbaseData = "Here lies the genesis block data"
 
 type Blockchain struct {
 	tip []byte
@@ -25,83 +23,61 @@ type BlockchainIterator struct {
 	db          *bolt.DB
 }
 
+// NewBlockchain opens the blockchain of the node, starting it from the genesis
+// block of the network when there is none yet
 func NewBlockchain(nodeID string) *Blockchain {
-	dbFile := fmt.Sprintf(dbFile, nodeID)
-	if !dbExists(dbFile) {
-		fmt.Printf("A blockchain doesn't exist. Create a new one\n")
-		os.Exit(1)
-	}
-
-	var tip []byte
-	db, err := bolt.Open(dbFile, 0660, nil)
-	if err != nil {
-		log.Panic(err)
-	}
-	err = db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-		tip = b.Get([]byte("l"))
-
-		return nil
-	})
-
-	if err != nil {
-		log.Panic(err)
-	}
-
-	bc := Blockchain{tip, db}
-
-	return &bc
-}
-
-func NewGenesisBlock(coinbase *Transaction) *Block {
-	return NewBlock([]*Transaction{coinbase}, []byte{}, 0)
-}
-
-func CreateBlockchain(address, nodeID string) *Blockchain {
-	dbFile := fmt.Sprintf(dbFile, nodeID)
-	if dbExists(dbFile) {
-		fmt.Println("Blockchain already exists.")
-		os.Exit(1)
-	}
+	dbFile := config.dataFile(fmt.Sprintf(dbFile, nodeID))
+	created := !dbExists(dbFile)
+	genesis := genesisBlock()
 
 	var tip []byte
 	db, err := bolt.Open(dbFile, 0600, nil)
 	if err != nil {
 		log.Panic(err)
 	}
-
 	err = db.Update(func(tx *bolt.Tx) error {
-		cbtx := NewCoinbaseTX(address, genesisCoinbaseData)
-		genesis := NewGenesisBlock(cbtx)
-
-		b, err := tx.CreateBucket([]byte(blocksBucket))
-		if err != nil {
-			log.Panic(err)
-		}
-
-		err = b.Put(genesis.Hash, genesis.Serialize())
-		if err != nil {
-			log.Panic(err)
+		b := tx.Bucket([]byte(blocksBucket))
+		if b == nil {
+			b, err = tx.CreateBucket([]byte(blocksBucket))
+			if err != nil {
+				return err
+			}
+			err = b.Put(genesis.Hash, genesis.Serialize())
+			if err != nil {
+				return err
+			}
+			err = b.Put([]byte("l"), genesis.Hash)
+			if err != nil {
+				return err
+			}
 		}
 
-		err = b.Put([]byte("l"), genesis.Hash)
-		if err != nil {
-			log.Panic(err)
+		if b.Get(genesis.Hash) == nil {
+			return fmt.Errorf("%s doesn't start with the genesis block of the %s network, remove it to start over", dbFile, chainParams.Name)
 		}
-		tip = genesis.Hash
+		// Values from the database are only valid during the transaction
+		tip = append([]byte{}, b.Get([]byte("l"))...)
 
 		return nil
 	})
-
 	if err != nil {
 		log.Panic(err)
 	}
 
 	bc := Blockchain{tip, db}
+	if created {
+		UTXOSet{&bc}.Reindex()
+		fmt.Printf("Started the %s blockchain from genesis block %x\n", chainParams.Name, genesis.Hash)
+	}
 
 	return &bc
 }
 
+// GenesisHash is the hash of the first block, nodes only talk to peers that share it
+func (bc *Blockchain) GenesisHash() []byte {
+	return genesisBlock().Hash
+}
+
 func (bc *Blockchain) FindUnspentTransactions(pubKeyHash []byte) []Transaction {
 	var unspentTXs []Transaction
 	spentTXOs := make(map[string][]int)
@@ -153,6 +129,7 @@ func (bc *Blockchain) FindUTXO() map[string]TXOutputs {
 
 	for {
 		block := bci.Next()
+		medianTime := bc.GetMedianTimePast(block.PrevBlockHash)
 
 		for _, tx := range block.Transactions {
 			txID := hex.EncodeToString(tx.ID)
@@ -167,8 +144,11 @@ func (bc *Blockchain) FindUTXO() map[string]TXOutputs {
 					}
 				}
 
-				outs := UTXO[txID]
-				outs.Outputs = append(outs.Outputs, out)
+				outs, ok := UTXO[txID]
+				if !ok {
+					outs = TXOutputs{make(map[int]TXOutput), block.Height, medianTime}
+				}
+				outs.Outputs[outIdx] = out
 				UTXO[txID] = outs
 			}
 
@@ -188,33 +168,23 @@ func (bc *Blockchain) FindUTXO() map[string]TXOutputs {
 }
 
 func (bc *Blockchain) MineBlock(transactions []*Transaction) *Block {
-	var lastHash []byte
-	var lastHeight int
+	lastBlock := bc.GetLastBlock()
+	lastHash := lastBlock.Hash
+	lastHeight := lastBlock.Height
+	UTXOSet := UTXOSet{bc}
 
 	for _, tx := range transactions {
 		if bc.VerifyTransaction(tx) != true {
 			log.Panic("ERROR: Invalid transaction")
 		}
-	}
-
-	err := bc.Db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-		lastHash = b.Get([]byte("l"))
-
-		blockData := b.Get(lastHash)
-		block := DeserializeBlock(blockData)
-
-		lastHeight = block.Height
-		return nil
-	})
-
-	if err != nil {
-		log.Panic(err)
+		if err := UTXOSet.CheckTransactionLocks(tx, lastHeight+1, lastHash); err != nil {
+			log.Panic(err)
+		}
 	}
 
 	newBlock := NewBlock(transactions, lastHash, lastHeight+1)
 
-	err = bc.Db.Update(func(tx *bolt.Tx) error {
+	err := bc.Db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(blocksBucket))
 		err := b.Put(newBlock.Hash, newBlock.Serialize())
 		if err != nil {
@@ -238,6 +208,19 @@ func (bc *Blockchain) MineBlock(transactions []*Transaction) *Block {
 	return newBlock
 }
 
+// Generate mines blocks holding nothing but a coinbase paying address
+func (bc *Blockchain) Generate(address string, blocks int) [][]byte {
+	UTXOSet := UTXOSet{bc}
+	var hashes [][]byte
+	for i := 0; i < blocks; i++ {
+		newBlock := bc.MineBlock([]*Transaction{NewCoinbaseTX(address, "")})
+		UTXOSet.Update(newBlock)
+		hashes = append(hashes, newBlock.Hash)
+	}
+
+	return hashes
+}
+
 func (bc *Blockchain) Iterator() *BlockchainIterator {
 	return &BlockchainIterator{bc.tip, bc.Db}
 }
@@ -281,7 +264,104 @@ func (bc *Blockchain) VerifyTransaction(tx *Transaction) bool {
 	return tx.Verify(prevTXs)
 }
 
-func (bc *Blockchain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey) {
+// VerifyBlockTransactions validates the transactions of block against the UTXO set:
+// a single coinbase first, paying at most the subsidy and the fees, and every other
+// transaction spending unspent outputs once and no more than they hold. The scripts
+// are verified with all Schnorr signatures of the block in a single batch.
+func (bc *Blockchain) VerifyBlockTransactions(block *Block) error {
+	if len(block.Transactions) == 0 || !block.Transactions[0].IsCoinbase() {
+		return errors.New("block doesn't start with a coinbase transaction")
+	}
+
+	var batch SchnorrBatch
+	set := UTXOSet{bc}
+	blockTXs := make(map[string]Transaction)
+	blockOuts := make(map[string]TXOutput) // Outputs of the transactions before the current one
+	spent := make(map[string]bool)
+	fees := 0
+
+	for i, tx := range block.Transactions {
+		if i > 0 {
+			if tx.IsCoinbase() {
+				return fmt.Errorf("transaction %x is a second coinbase", tx.ID)
+			}
+			fee, err := bc.verifyBlockTransaction(tx, set, blockTXs, blockOuts, spent, &batch)
+			if err != nil {
+				return err
+			}
+			fees += fee
+		}
+
+		blockTXs[hex.EncodeToString(tx.ID)] = *tx
+		for index, out := range tx.Vout {
+			blockOuts[fmt.Sprintf("%x:%d", tx.ID, index)] = out
+		}
+	}
+
+	coinbase := block.Transactions[0]
+	reward := 0
+	for _, out := range coinbase.Vout {
+		if out.Value < 0 || out.Value > chainParams.Subsidy+fees-reward {
+			return fmt.Errorf("coinbase %x pays more than the subsidy of %d and the fees of %d", coinbase.ID, chainParams.Subsidy, fees)
+		}
+		reward += out.Value
+	}
+
+	if !batch.Verify() {
+		return fmt.Errorf("batch verification of %d Schnorr signatures failed", batch.Len())
+	}
+
+	return nil
+}
+
+// verifyBlockTransaction checks a transaction of a block after the coinbase, spending
+// outputs of the UTXO set or of the earlier transactions in blockOuts, and returns its fee
+func (bc *Blockchain) verifyBlockTransaction(tx *Transaction, set UTXOSet, blockTXs map[string]Transaction, blockOuts map[string]TXOutput, spent map[string]bool, batch *SchnorrBatch) (int, error) {
+	prevTXs := make(map[string]Transaction)
+	var prevOuts []UTXO
+
+	for _, vin := range tx.Vin {
+		outpoint := fmt.Sprintf("%x:%d", vin.Txid, vin.Vout)
+		if spent[outpoint] {
+			return 0, fmt.Errorf("transaction %x spends %s, which the block spends already", tx.ID, outpoint)
+		}
+		spent[outpoint] = true
+
+		out, ok := blockOuts[outpoint]
+		if !ok {
+			outs, found := set.FindOutputs(vin.Txid)
+			out, ok = outs.Outputs[vin.Vout]
+			ok = ok && found
+		}
+		if !ok {
+			return 0, fmt.Errorf("transaction %x spends %s, which isn't an unspent output", tx.ID, outpoint)
+		}
+		prevOuts = append(prevOuts, UTXO{Outpoint{vin.Txid, vin.Vout}, out})
+
+		prevID := hex.EncodeToString(vin.Txid)
+		prevTX, ok := blockTXs[prevID]
+		if !ok {
+			var err error
+			prevTX, err = bc.FindTransaction(vin.Txid)
+			if err != nil {
+				return 0, fmt.Errorf("transaction %x spends unknown transaction %s", tx.ID, prevID)
+			}
+		}
+		prevTXs[prevID] = prevTX
+	}
+
+	fee, err := transactionFee(tx, prevOuts)
+	if err != nil {
+		return 0, err
+	}
+	if !tx.verify(prevTXs, batch) {
+		return 0, fmt.Errorf("transaction %x is invalid", tx.ID)
+	}
+
+	return fee, nil
+}
+
+func (bc *Blockchain) SignTransaction(tx *Transaction, wallet *Wallet) {
 	prevTXs := make(map[string]Transaction)
 
 	for _, vin := range tx.Vin {
@@ -293,7 +373,7 @@ func (bc *Blockchain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey)
 		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
 	}
 
-	tx.Sign(privKey, prevTXs)
+	tx.Sign(wallet, prevTXs)
 }
 
 func (bc *Blockchain) AddBlock(block *Block) {
@@ -332,6 +412,12 @@ func (bc *Blockchain) AddBlock(block *Block) {
 }
 
 func (bc *Blockchain) GetBestHeight() int {
+	lastBlock := bc.GetLastBlock()
+
+	return lastBlock.Height
+}
+
+func (bc *Blockchain) GetLastBlock() Block {
 	var lastBlock Block
 
 	err := bc.Db.View(func(tx *bolt.Tx) error {
@@ -347,7 +433,7 @@ func (bc *Blockchain) GetBestHeight() int {
 		log.Panic(err)
 	}
 
-	return lastBlock.Height
+	return lastBlock
 }
 
 func (bc *Blockchain) GetBlock(blockHash []byte) (Block, error) {
@@ -0,0 +1,85 @@
+package domain
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// coinbaseTx pays value to address, for blocks that claim a different reward
+func coinbaseTx(address string, value int) *Transaction {
+	tx := NewCoinbaseTX(address, "")
+	tx.Vout[0].Value = value
+	tx.ID = tx.Hash()
+
+	return tx
+}
+
+// spendTx spends output vout of prev, owned by wallet, to address with one output per value
+func spendTx(wallet *Wallet, address string, prev *Transaction, vout int, values ...int) *Transaction {
+	tx := Transaction{nil, []TXInput{{prev.ID, vout, nil, maxTxInSequence}}, nil, 0}
+	for _, value := range values {
+		tx.Vout = append(tx.Vout, TXOutput{value, LockingScript(address)})
+	}
+	tx.ID = tx.Hash()
+	tx.Sign(wallet, map[string]Transaction{hex.EncodeToString(prev.ID): *prev})
+
+	return &tx
+}
+
+func TestVerifyBlockTransactions(t *testing.T) {
+	bc := NewBlockchain("3001")
+	defer bc.Db.Close()
+
+	wallet := NewWallet(p256Scheme{})
+	address := string(wallet.GetAddress())
+	var coins []*Transaction
+	for _, hash := range bc.Generate(address, 3) {
+		block, err := bc.GetBlock(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		coins = append(coins, block.Transactions[0])
+	}
+
+	// The last coin is spent in the chain already
+	spent := spendTx(wallet, address, coins[2], 0, chainParams.Subsidy)
+	UTXOSet{bc}.Update(bc.MineBlock([]*Transaction{NewCoinbaseTX(address, ""), spent}))
+
+	subsidy := chainParams.Subsidy
+	pay := spendTx(wallet, address, coins[0], 0, subsidy-3)
+	chained := spendTx(wallet, address, pay, 0, subsidy-4)
+
+	tests := []struct {
+		name string
+		txs  []*Transaction
+		err  string
+	}{
+		{"subsidy and fees", []*Transaction{coinbaseTx(address, subsidy+3), pay}, ""},
+		{"spend within the block", []*Transaction{coinbaseTx(address, subsidy+4), pay, chained}, ""},
+		{"reward below the limit", []*Transaction{coinbaseTx(address, 1), pay}, ""},
+		{"no transactions", nil, "doesn't start with a coinbase"},
+		{"no coinbase", []*Transaction{pay}, "doesn't start with a coinbase"},
+		{"second coinbase", []*Transaction{coinbaseTx(address, subsidy), coinbaseTx(address, subsidy)}, "second coinbase"},
+		{"coinbase above subsidy and fees", []*Transaction{coinbaseTx(address, subsidy+4), pay}, "pays more than the subsidy"},
+		{"negative coinbase output", []*Transaction{coinbaseTx(address, -1)}, "pays more than the subsidy"},
+		{"negative output", []*Transaction{coinbaseTx(address, subsidy), spendTx(wallet, address, coins[1], 0, -5, subsidy+5)}, "negative value"},
+		{"outputs above inputs", []*Transaction{coinbaseTx(address, subsidy), spendTx(wallet, address, coins[1], 0, subsidy+1)}, "more than its inputs"},
+		{"outpoint spent twice", []*Transaction{coinbaseTx(address, subsidy), pay, spendTx(wallet, address, coins[0], 0, subsidy-1)}, "which the block spends already"},
+		{"spent in the chain", []*Transaction{coinbaseTx(address, subsidy), spendTx(wallet, address, coins[2], 0, subsidy)}, "isn't an unspent output"},
+		{"spend of a later transaction", []*Transaction{coinbaseTx(address, subsidy), chained, pay}, "isn't an unspent output"},
+	}
+
+	for _, test := range tests {
+		err := bc.VerifyBlockTransactions(&Block{Transactions: test.txs})
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%s: %s", test.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got %v, expected an error with %q", test.name, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package domain
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// ChainParams holds everything that tells networks apart. Nodes of different
+// networks refuse each other's messages because of Magic, and addresses and
+// exported keys of one network don't parse on another.
+type ChainParams struct {
+	Name  string
+	Magic [4]byte // Prefixes every message between nodes
+
+	DefaultPort int    // Port of the seed node, and of this node when NODE_ID is unset
+	DataDir     string // Relative to the working directory, empty for the working directory itself
+
+	GenesisCoinbaseData string
+	GenesisTimestamp    int64
+	GenesisNonce        int
+	GenesisHash         string
+	TargetBits          int
+	Subsidy             int
+	MineOnDemand        bool // Miners mine a block as soon as a transaction arrives
+
+	PubKeyHashVersions map[byte]byte // Address version of every signature scheme
+	ScriptHashVersion  byte          // Address version of multisig addresses
+	PrivateKeyVersion  byte          // Version of exported private keys
+}
+
+var MainNetParams = ChainParams{
+	Name:                "main",
+	Magic:               [4]byte{0xf9, 0xbe, 0xb4, 0xd9},
+	DefaultPort:         3000,
+	GenesisCoinbaseData: "Here lies the genesis block data",
+	GenesisTimestamp:    1735689600,
+	GenesisNonce:        317923,
+	GenesisHash:         "0000285e535d1dc94e27b8336c0145f57bec1c6a6e195e673c88d352cd611e8f",
+	TargetBits:          16,
+	Subsidy:             10,
+	PubKeyHashVersions: map[byte]byte{
+		schemeP256:      0x00,
+		schemeSecp256k1: 0x26,
+		schemeSchnorr:   0x3f,
+	},
+	ScriptHashVersion: 0x05,
+	PrivateKeyVersion: 0x80,
+}
+
+var TestNetParams = ChainParams{
+	Name:                "test",
+	Magic:               [4]byte{0x0b, 0x11, 0x09, 0x07},
+	DefaultPort:         4000,
+	DataDir:             "testnet",
+	GenesisCoinbaseData: "Here lies the testnet genesis block data",
+	GenesisTimestamp:    1735776000,
+	GenesisNonce:        3756,
+	GenesisHash:         "000bb8a289a0442c7bf5c4edfff2d8521bdbeb11cd6caa8ddf78427392d76d20",
+	TargetBits:          12,
+	Subsidy:             10,
+	PubKeyHashVersions: map[byte]byte{
+		schemeP256:      0x6f,
+		schemeSecp256k1: 0x41,
+		schemeSchnorr:   0x7f,
+	},
+	ScriptHashVersion: 0xc4,
+	PrivateKeyVersion: 0xef,
+}
+
+var RegTestParams = ChainParams{
+	Name:                "regtest",
+	Magic:               [4]byte{0xfa, 0xbf, 0xb5, 0xda},
+	DefaultPort:         5000,
+	DataDir:             "regtest",
+	GenesisCoinbaseData: "Here lies the regtest genesis block data",
+	GenesisTimestamp:    1735862400,
+	GenesisNonce:        0,
+	GenesisHash:         "07b2e67a9407ec06bab523e550bebd0605d90d4cf1d35855defe74fa7c70317e",
+	TargetBits:          1,
+	Subsidy:             10,
+	MineOnDemand:        true,
+	PubKeyHashVersions: map[byte]byte{
+		schemeP256:      0x70,
+		schemeSecp256k1: 0x43,
+		schemeSchnorr:   0x7c,
+	},
+	ScriptHashVersion: 0xc5,
+	PrivateKeyVersion: 0xf0,
+}
+
+var networks = map[string]*ChainParams{
+	MainNetParams.Name: &MainNetParams,
+	TestNetParams.Name: &TestNetParams,
+	RegTestParams.Name: &RegTestParams,
+}
+
+// chainParams is the network this process runs on
+var chainParams = &MainNetParams
+
+// SelectNetwork switches the process to the named network, it has to run before
+// any wallet or blockchain is opened
+func SelectNetwork(name string) error {
+	params, ok := networks[name]
+	if !ok {
+		return fmt.Errorf("unknown network %s, expected main, test or regtest", name)
+	}
+
+	chainParams = params
+	setKnownNodes([]string{fmt.Sprintf("localhost:%d", params.DefaultPort)})
+
+	return nil
+}
+
+func (p *ChainParams) defaultNodeID() string {
+	return strconv.Itoa(p.DefaultPort)
+}
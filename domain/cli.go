@@ -1,13 +1,20 @@
 package domain
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
-	"github.com/aleksannder/gochain/util"
 	"github.com/boltdb/bolt"
+	"golang.org/x/term"
 	"log"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type CLI struct{}
@@ -15,14 +22,55 @@ type CLI struct{}
 // Usage CLI
 
 func (cli *CLI) printUsage() {
-	fmt.Println("Usage:")
-	fmt.Println("\t getbalance -address ADDRESS -> Get balance of given address")
-	fmt.Println("\t createblockchain -address ADDRESS -> Create a blockchain and send genesis block reward to ADDRESS")
+	fmt.Println("Usage: gochain [-network main|test|regtest] [-datadir DIR] [-conf FILE] [SETTINGS] COMMAND")
+	fmt.Println("\t every network keeps its blockchain and wallet apart, NODE_ID defaults to the port of the network's seed node")
+	fmt.Println("\t settings: -listen, -externalip, -seeds, -miner, -minetxs, -mineinterval, -stratum, -sharebits, -rpclisten, -rpc, -encrypt and -loglevel, also read from GOCHAIN_ variables")
+	fmt.Println("\t\t like GOCHAIN_DATADIR and from gochain.conf in the data directory, flags take precedence over both")
+	fmt.Println("\t getbalance -address ADDRESS -> Get balance of given address, or of every wallet address when omitted")
 	fmt.Println("\t printchain -> Print all the blocks of the blockchain")
 	fmt.Println("\t send -from FROM -to TO -amount AMOUNT  -mine -> Send AMOUNT of coins from FROM address to TO recipient. Mine flag mines on same node when set")
-	fmt.Println("\t createwallet -> Generates new key-pair and saves to wallet file")
+	fmt.Println("\t\t -locktime makes the transaction invalid before the given block height (or unix time when >= 500000000)")
+	fmt.Println("\t\t sending from a multisig address writes a partially signed transaction to the -psbt FILE instead")
+	fmt.Println("\t\t -coinselect picks inputs with largest-first, smallest-first, bnb (exact match, default) or random")
+	fmt.Println("\t\t -inputs txid:vout,... spends exactly the given outputs")
+	fmt.Println("\t\t watch-only addresses can only send with -external, which writes the unsigned transaction to the -psbt FILE")
+	fmt.Println("\t\t when a node is running with the same NODE_ID the payment is signed by its unlocked wallet")
+	fmt.Println("\t\t -dryrun prints the transaction instead of broadcasting it")
+	fmt.Println("\t sendmany -from FROM -to ADDR:AMOUNT,... | -file FILE -> Pay several recipients in one transaction, takes the flags of send")
+	fmt.Println("\t\t FILE is CSV with address,amount rows or JSON, a list of {\"address\", \"amount\"} objects or an object of address: amount")
+	fmt.Println("\t consolidate -address ADDRESS -mine -> Merge every unspent output of ADDRESS into one")
+	fmt.Println("\t createwallet -scheme SCHEME -> Generates new key-pair (secp256k1, schnorr or p256) and saves to wallet file")
+	fmt.Println("\t\t the wallet file is encrypted, commands that need private keys prompt for the passphrase unless -passphrase is given")
+	fmt.Println("\t\t -mnemonic turns the wallet into an HD wallet, later createwallet calls derive the next address from its seed")
+	fmt.Println("\t restorewallet -mnemonic WORDS -gap N -> Restore an HD wallet from its mnemonic and rescan the chain for used addresses")
+	fmt.Println("\t dumpprivkey -address ADDRESS -> Print the private key of an address in a portable text format")
+	fmt.Println("\t importprivkey KEY -rescan -> Import a private key, -rescan reports the funds it already holds")
+	fmt.Println("\t dumpwallet FILE -> Write every key of the wallet to a text file")
+	fmt.Println("\t importwallet FILE -> Import the keys of a wallet dump and rescan for their funds")
+	fmt.Println("\t changepassphrase -> Re-encrypt the wallet file with a new passphrase")
+	fmt.Println("\t walletpassphrase -timeout SECONDS -> Unlock the wallet of the running node for the given time")
+	fmt.Println("\t walletlock -> Lock the wallet of the running node")
+	fmt.Println("\t getpubkey -address ADDRESS -> Print the public key of a wallet address")
+	fmt.Println("\t createmultisig -m M -keys KEY1,KEY2,... -> Create an M-of-N multisig address from public keys or wallet addresses")
+	fmt.Println("\t signpsbt -file FILE -sighash TYPE -> Add signatures from this wallet to a partially signed transaction")
+	fmt.Println("\t finalizepsbt -file FILE -mine -> Finalize a fully signed transaction and broadcast it")
+	fmt.Println("\t createrawtransaction -inputs TXID:VOUT,... -to ADDR:AMOUNT,... -locktime N -prevouts FILE -> Print an unsigned transaction as hex")
+	fmt.Println("\t\t -prevouts writes the spent outputs to FILE for signing on a machine without the blockchain")
+	fmt.Println("\t signrawtransaction HEX -prevouts FILE -sighash TYPE -> Sign a raw transaction with this wallet and the given spent outputs only")
+	fmt.Println("\t decoderawtransaction HEX -> Print a raw transaction")
+	fmt.Println("\t sendrawtransaction HEX -mine -> Broadcast a signed raw transaction")
 	fmt.Println("\t listaddresses -> Lists all addresses from wallet file")
-	fmt.Println("\t startnode -miner ADDRESS -> Start a node with ID specified in NODE_ID env variable. Miner enables mining on that node")
+	fmt.Println("\t importaddress ADDRESS|PUBKEY -rescan -> Watch an address without its private key")
+	fmt.Println("\t generate -address ADDRESS -blocks N -> Mine N blocks paying ADDRESS right away")
+	fmt.Println("\t getblocktemplate -address ADDRESS -> Print the block the running node would mine next as JSON, paying ADDRESS or its mining address")
+	fmt.Println("\t submitblock HEX -nonce N -> Add a serialized block mined on the tip to the running node and announce it")
+	fmt.Println("\t\t -nonce sets the nonce found for the block of getblocktemplate and hashes the block with it")
+	fmt.Println("\t getpoolshares -reset -> List the shares of every Stratum worker, -reset starts counting from zero after a payout")
+	fmt.Println("\t getpeerinfo -> List the peers of the running node, with whether the last connection to each was encrypted")
+	fmt.Println("\t listbanned -> List the IPs and subnets banned by the node, for misbehaving or with setban")
+	fmt.Println("\t setban IP|SUBNET -bantime SECONDS -remove -> Ban an IP or subnet like 192.0.2.0/24, -remove lifts the ban")
+	fmt.Println("\t clearbanned -> Lift every ban")
+	fmt.Println("\t startnode -miner ADDRESS -> Start a node with ID specified in NODE_ID env variable, or on the default port of the network. Miner enables mining on that node")
 }
 
 // Validate CLI args
@@ -37,30 +85,122 @@ func (cli *CLI) validateArgs() {
 // Run CLI
 
 func (cli *CLI) Run() {
+	args, err := LoadConfig(os.Args[1:])
+	if err != nil {
+		log.Panic(err)
+	}
+	os.Args = append(os.Args[:1], args...)
 	cli.validateArgs()
 
 	nodeID := os.Getenv("NODE_ID")
 	if nodeID == "" {
-		fmt.Println("NODE_ID environment variable not set")
-		os.Exit(1)
+		nodeID = chainParams.defaultNodeID()
 	}
 
 	getBalanceCmd := flag.NewFlagSet("getbalance", flag.ExitOnError)
-	createBlockchainCmd := flag.NewFlagSet("createblockchain", flag.ExitOnError)
 	createWalletCmd := flag.NewFlagSet("createwallet", flag.ExitOnError)
 	listAddressesCmd := flag.NewFlagSet("listaddresses", flag.ExitOnError)
 	printChainCmd := flag.NewFlagSet("printchain", flag.ExitOnError)
 	sendCmd := flag.NewFlagSet("send", flag.ExitOnError)
+	sendManyCmd := flag.NewFlagSet("sendmany", flag.ExitOnError)
 	reindexUtxoCmd := flag.NewFlagSet("reindexutxo", flag.ExitOnError)
+	consolidateCmd := flag.NewFlagSet("consolidate", flag.ExitOnError)
 	startNodeCmd := flag.NewFlagSet("startnode", flag.ExitOnError)
+	getPubKeyCmd := flag.NewFlagSet("getpubkey", flag.ExitOnError)
+	createMultiSigCmd := flag.NewFlagSet("createmultisig", flag.ExitOnError)
+	signPSBTCmd := flag.NewFlagSet("signpsbt", flag.ExitOnError)
+	finalizePSBTCmd := flag.NewFlagSet("finalizepsbt", flag.ExitOnError)
+	createRawTxCmd := flag.NewFlagSet("createrawtransaction", flag.ExitOnError)
+	signRawTxCmd := flag.NewFlagSet("signrawtransaction", flag.ExitOnError)
+	decodeRawTxCmd := flag.NewFlagSet("decoderawtransaction", flag.ExitOnError)
+	sendRawTxCmd := flag.NewFlagSet("sendrawtransaction", flag.ExitOnError)
+	restoreWalletCmd := flag.NewFlagSet("restorewallet", flag.ExitOnError)
+	dumpPrivKeyCmd := flag.NewFlagSet("dumpprivkey", flag.ExitOnError)
+	importPrivKeyCmd := flag.NewFlagSet("importprivkey", flag.ExitOnError)
+	importAddressCmd := flag.NewFlagSet("importaddress", flag.ExitOnError)
+	dumpWalletCmd := flag.NewFlagSet("dumpwallet", flag.ExitOnError)
+	importWalletCmd := flag.NewFlagSet("importwallet", flag.ExitOnError)
+	changePassphraseCmd := flag.NewFlagSet("changepassphrase", flag.ExitOnError)
+	walletPassphraseCmd := flag.NewFlagSet("walletpassphrase", flag.ExitOnError)
+	walletLockCmd := flag.NewFlagSet("walletlock", flag.ExitOnError)
+	generateCmd := flag.NewFlagSet("generate", flag.ExitOnError)
+	getBlockTemplateCmd := flag.NewFlagSet("getblocktemplate", flag.ExitOnError)
+	submitBlockCmd := flag.NewFlagSet("submitblock", flag.ExitOnError)
+	getPoolSharesCmd := flag.NewFlagSet("getpoolshares", flag.ExitOnError)
+	getPeerInfoCmd := flag.NewFlagSet("getpeerinfo", flag.ExitOnError)
+	listBannedCmd := flag.NewFlagSet("listbanned", flag.ExitOnError)
+	setBanCmd := flag.NewFlagSet("setban", flag.ExitOnError)
+	clearBannedCmd := flag.NewFlagSet("clearbanned", flag.ExitOnError)
 
 	getBalanceAddress := getBalanceCmd.String("address", "", "Address of wallet")
-	createBlockchainAddress := createBlockchainCmd.String("address", "", "Address of wallet")
+	createWalletScheme := createWalletCmd.String("scheme", defaultSignatureScheme, "Signature scheme: secp256k1, schnorr or p256")
+	createWalletPassphrase := createWalletCmd.String("passphrase", "", "Wallet passphrase, prompted for when empty")
+	createWalletMnemonic := createWalletCmd.Bool("mnemonic", false, "Create an HD wallet from a new mnemonic")
+	restoreWalletMnemonic := restoreWalletCmd.String("mnemonic", "", "Mnemonic of the HD wallet")
+	restoreWalletScheme := restoreWalletCmd.String("scheme", defaultSignatureScheme, "Signature scheme of the HD wallet: secp256k1 or schnorr")
+	restoreWalletGap := restoreWalletCmd.Int("gap", defaultGapLimit, "Number of consecutive unused addresses that ends the rescan")
+	restoreWalletPassphrase := restoreWalletCmd.String("passphrase", "", "Wallet passphrase, prompted for when empty")
 	sendFrom := sendCmd.String("from", "", "Source wallet address")
 	sendTo := sendCmd.String("to", "", "Destination wallet address")
 	sendAmount := sendCmd.Int("amount", 0, "Amount to send")
 	sendMine := sendCmd.Bool("mine", false, "Mine on node")
+	sendLockTime := sendCmd.Int64("locktime", 0, "Block height or unix time before which the transaction is invalid")
+	sendPSBT := sendCmd.String("psbt", "multisig.psbt", "File for the partially signed transaction when sending from a multisig address")
+	sendPassphrase := sendCmd.String("passphrase", "", "Wallet passphrase, prompted for when empty")
+	sendExternal := sendCmd.Bool("external", false, "Leave signing a watch-only payment to the holder of the key")
+	sendCoinSelect := sendCmd.String("coinselect", defaultCoinSelector, "Coin selection: largest-first, smallest-first, bnb or random")
+	sendInputs := sendCmd.String("inputs", "", "Comma separated txid:vout outputs to spend")
+	sendDryRun := sendCmd.Bool("dryrun", false, "Print the transaction instead of broadcasting it")
+	sendManyFrom := sendManyCmd.String("from", "", "Source wallet address")
+	sendManyTo := sendManyCmd.String("to", "", "Comma separated address:amount recipients")
+	sendManyFile := sendManyCmd.String("file", "", "CSV or JSON file with the recipients")
+	sendManyMine := sendManyCmd.Bool("mine", false, "Mine on node")
+	sendManyLockTime := sendManyCmd.Int64("locktime", 0, "Block height or unix time before which the transaction is invalid")
+	sendManyPSBT := sendManyCmd.String("psbt", "multisig.psbt", "File for the partially signed transaction when sending from a multisig address")
+	sendManyPassphrase := sendManyCmd.String("passphrase", "", "Wallet passphrase, prompted for when empty")
+	sendManyExternal := sendManyCmd.Bool("external", false, "Leave signing a watch-only payment to the holder of the key")
+	sendManyCoinSelect := sendManyCmd.String("coinselect", defaultCoinSelector, "Coin selection: largest-first, smallest-first, bnb or random")
+	sendManyInputs := sendManyCmd.String("inputs", "", "Comma separated txid:vout outputs to spend")
+	sendManyDryRun := sendManyCmd.Bool("dryrun", false, "Print the transaction instead of broadcasting it")
+	consolidateAddress := consolidateCmd.String("address", "", "Address whose outputs are merged")
+	consolidateMine := consolidateCmd.Bool("mine", false, "Mine on node")
+	consolidatePassphrase := consolidateCmd.String("passphrase", "", "Wallet passphrase, prompted for when empty")
+	generateAddress := generateCmd.String("address", "", "Address the block rewards go to")
+	generateBlocks := generateCmd.Int("blocks", 1, "Number of blocks to mine")
+	getBlockTemplateAddress := getBlockTemplateCmd.String("address", "", "Address the block reward goes to")
+	submitBlockNonce := submitBlockCmd.Int("nonce", -1, "Nonce found for the block of getblocktemplate")
+	getPoolSharesReset := getPoolSharesCmd.Bool("reset", false, "Reset the share counts after listing them")
 	startNodeMiner := startNodeCmd.String("miner", "", "Mine on node")
+	getPubKeyAddress := getPubKeyCmd.String("address", "", "Address of wallet")
+	createMultiSigM := createMultiSigCmd.Int("m", 0, "Number of required signatures")
+	createMultiSigKeys := createMultiSigCmd.String("keys", "", "Comma separated public keys or wallet addresses")
+	signPSBTFile := signPSBTCmd.String("file", "", "Partially signed transaction file")
+	signPSBTSigHash := signPSBTCmd.String("sighash", "ALL", "Signature hash type: ALL, NONE or SINGLE, optionally with |ANYONECANPAY")
+	signPSBTPassphrase := signPSBTCmd.String("passphrase", "", "Wallet passphrase, prompted for when empty")
+	finalizePSBTFile := finalizePSBTCmd.String("file", "", "Partially signed transaction file")
+	finalizePSBTMine := finalizePSBTCmd.Bool("mine", false, "Mine on node")
+	createRawTxInputs := createRawTxCmd.String("inputs", "", "Comma separated txid:vout outputs to spend")
+	createRawTxTo := createRawTxCmd.String("to", "", "Comma separated address:amount recipients")
+	createRawTxLockTime := createRawTxCmd.Int64("locktime", 0, "Block height or unix time before which the transaction is invalid")
+	createRawTxPrevOuts := createRawTxCmd.String("prevouts", "", "File to write the spent outputs to")
+	signRawTxPrevOuts := signRawTxCmd.String("prevouts", "", "File with the spent outputs, written by createrawtransaction")
+	signRawTxSigHash := signRawTxCmd.String("sighash", "ALL", "Signature hash type: ALL, NONE or SINGLE, optionally with |ANYONECANPAY")
+	signRawTxPassphrase := signRawTxCmd.String("passphrase", "", "Wallet passphrase, prompted for when empty")
+	sendRawTxMine := sendRawTxCmd.Bool("mine", false, "Mine on node")
+	dumpPrivKeyAddress := dumpPrivKeyCmd.String("address", "", "Address of wallet")
+	dumpPrivKeyPassphrase := dumpPrivKeyCmd.String("passphrase", "", "Wallet passphrase, prompted for when empty")
+	importPrivKeyRescan := importPrivKeyCmd.Bool("rescan", false, "Look up the funds the key already holds")
+	importPrivKeyPassphrase := importPrivKeyCmd.String("passphrase", "", "Wallet passphrase, prompted for when empty")
+	importAddressRescan := importAddressCmd.Bool("rescan", false, "Look up the funds the address already holds")
+	importAddressPassphrase := importAddressCmd.String("passphrase", "", "Passphrase for a new wallet file, prompted for when empty")
+	dumpWalletPassphrase := dumpWalletCmd.String("passphrase", "", "Wallet passphrase, prompted for when empty")
+	importWalletPassphrase := importWalletCmd.String("passphrase", "", "Wallet passphrase, prompted for when empty")
+	changePassphraseOld := changePassphraseCmd.String("passphrase", "", "Current wallet passphrase, prompted for when empty")
+	changePassphraseNew := changePassphraseCmd.String("newpassphrase", "", "New wallet passphrase, prompted for when empty")
+	walletPassphrasePassphrase := walletPassphraseCmd.String("passphrase", "", "Wallet passphrase, prompted for when empty")
+	walletPassphraseTimeout := walletPassphraseCmd.Int("timeout", 60, "Seconds until the wallet locks again")
+	setBanRemove := setBanCmd.Bool("remove", false, "Lift the ban instead")
+	setBanTime := setBanCmd.Int64("bantime", int64(defaultBanTime/time.Second), "Seconds the ban lasts")
 
 	switch os.Args[1] {
 	case "printchain":
@@ -73,11 +213,6 @@ func (cli *CLI) Run() {
 		if err != nil {
 			log.Panic(err)
 		}
-	case "createblockchain":
-		err := createBlockchainCmd.Parse(os.Args[2:])
-		if err != nil {
-			log.Panic(err)
-		}
 	case "listaddresses":
 		err := listAddressesCmd.Parse(os.Args[2:])
 		if err != nil {
@@ -93,6 +228,16 @@ func (cli *CLI) Run() {
 		if err != nil {
 			log.Panic(err)
 		}
+	case "sendmany":
+		err := sendManyCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "consolidate":
+		err := consolidateCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "reindexutxo":
 		err := reindexUtxoCmd.Parse(os.Args[2:])
 		if err != nil {
@@ -103,44 +248,160 @@ func (cli *CLI) Run() {
 		if err != nil {
 			log.Panic(err)
 		}
+	case "getpubkey":
+		err := getPubKeyCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "createmultisig":
+		err := createMultiSigCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "signpsbt":
+		err := signPSBTCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "createrawtransaction":
+		err := createRawTxCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "signrawtransaction":
+		parseWithArgument(signRawTxCmd, os.Args[2:])
+	case "decoderawtransaction":
+		parseWithArgument(decodeRawTxCmd, os.Args[2:])
+	case "sendrawtransaction":
+		parseWithArgument(sendRawTxCmd, os.Args[2:])
+	case "finalizepsbt":
+		err := finalizePSBTCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "restorewallet":
+		err := restoreWalletCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "dumpprivkey":
+		err := dumpPrivKeyCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "importprivkey":
+		parseWithArgument(importPrivKeyCmd, os.Args[2:])
+	case "importaddress":
+		parseWithArgument(importAddressCmd, os.Args[2:])
+	case "dumpwallet":
+		parseWithArgument(dumpWalletCmd, os.Args[2:])
+	case "importwallet":
+		parseWithArgument(importWalletCmd, os.Args[2:])
+	case "changepassphrase":
+		err := changePassphraseCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "walletpassphrase":
+		err := walletPassphraseCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "walletlock":
+		err := walletLockCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "generate":
+		err := generateCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "getblocktemplate":
+		err := getBlockTemplateCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "submitblock":
+		parseWithArgument(submitBlockCmd, os.Args[2:])
+	case "getpoolshares":
+		err := getPoolSharesCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "getpeerinfo":
+		err := getPeerInfoCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "listbanned":
+		err := listBannedCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "setban":
+		parseWithArgument(setBanCmd, os.Args[2:])
+	case "clearbanned":
+		err := clearBannedCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	default:
 		cli.printUsage()
 		os.Exit(1)
 	}
 
 	if getBalanceCmd.Parsed() {
-		if *getBalanceAddress == "" {
-			getBalanceCmd.Usage()
-			os.Exit(1)
-		}
 		cli.getBalance(*getBalanceAddress, nodeID)
 	}
 	if printChainCmd.Parsed() {
 		cli.printChain(nodeID)
 	}
-	if createBlockchainCmd.Parsed() {
-		if *createBlockchainAddress == "" {
-			createBlockchainCmd.Usage()
-			os.Exit(1)
-		}
-		cli.createBlockchain(*createBlockchainAddress, nodeID)
-	}
 	if sendCmd.Parsed() {
 		if *sendFrom == "" || *sendTo == "" || *sendAmount == 0 {
 			sendCmd.Usage()
 			os.Exit(1)
 		}
-		cli.send(*sendFrom, *sendTo, *sendAmount, nodeID, *sendMine)
+		coins := parseCoinSelection(*sendCoinSelect, *sendInputs)
+		payments := []Payment{{*sendTo, *sendAmount}}
+		cli.send(*sendFrom, payments, *sendLockTime, nodeID, *sendMine, *sendDryRun, *sendPSBT, *sendPassphrase, *sendExternal, coins)
+	}
+	if sendManyCmd.Parsed() {
+		if *sendManyFrom == "" || (*sendManyTo == "") == (*sendManyFile == "") {
+			sendManyCmd.Usage()
+			os.Exit(1)
+		}
+		var payments []Payment
+		var err error
+		if *sendManyFile != "" {
+			payments, err = LoadPaymentsFromFile(*sendManyFile)
+		} else {
+			payments, err = ParsePayments(*sendManyTo)
+		}
+		if err != nil {
+			log.Panic(err)
+		}
+		coins := parseCoinSelection(*sendManyCoinSelect, *sendManyInputs)
+		cli.send(*sendManyFrom, payments, *sendManyLockTime, nodeID, *sendManyMine, *sendManyDryRun, *sendManyPSBT, *sendManyPassphrase, *sendManyExternal, coins)
+	}
+	if consolidateCmd.Parsed() {
+		if *consolidateAddress == "" {
+			consolidateCmd.Usage()
+			os.Exit(1)
+		}
+		cli.consolidate(*consolidateAddress, nodeID, *consolidateMine, *consolidatePassphrase)
 	}
 	if createWalletCmd.Parsed() {
-		cli.createWallet(nodeID)
+		cli.createWallet(*createWalletScheme, nodeID, *createWalletPassphrase, *createWalletMnemonic)
 	}
-	if startNodeCmd.Parsed() {
-		nodeID := os.Getenv("NODE_ID")
-		if nodeID == "" {
-			startNodeCmd.Usage()
+	if restoreWalletCmd.Parsed() {
+		if *restoreWalletMnemonic == "" {
+			restoreWalletCmd.Usage()
 			os.Exit(1)
 		}
+		cli.restoreWallet(*restoreWalletMnemonic, *restoreWalletScheme, *restoreWalletGap, nodeID, *restoreWalletPassphrase)
+	}
+	if startNodeCmd.Parsed() {
 		cli.startNode(nodeID, *startNodeMiner)
 	}
 	if listAddressesCmd.Parsed() {
@@ -149,13 +410,156 @@ func (cli *CLI) Run() {
 	if reindexUtxoCmd.Parsed() {
 		cli.reindexUtxo(nodeID)
 	}
+	if getPubKeyCmd.Parsed() {
+		if *getPubKeyAddress == "" {
+			getPubKeyCmd.Usage()
+			os.Exit(1)
+		}
+		cli.getPubKey(*getPubKeyAddress, nodeID)
+	}
+	if createMultiSigCmd.Parsed() {
+		if *createMultiSigM == 0 || *createMultiSigKeys == "" {
+			createMultiSigCmd.Usage()
+			os.Exit(1)
+		}
+		cli.createMultiSig(*createMultiSigM, strings.Split(*createMultiSigKeys, ","), nodeID)
+	}
+	if signPSBTCmd.Parsed() {
+		if *signPSBTFile == "" {
+			signPSBTCmd.Usage()
+			os.Exit(1)
+		}
+		cli.signPSBT(*signPSBTFile, *signPSBTSigHash, nodeID, *signPSBTPassphrase)
+	}
+	if finalizePSBTCmd.Parsed() {
+		if *finalizePSBTFile == "" {
+			finalizePSBTCmd.Usage()
+			os.Exit(1)
+		}
+		cli.finalizePSBT(*finalizePSBTFile, nodeID, *finalizePSBTMine)
+	}
+	if createRawTxCmd.Parsed() {
+		if *createRawTxInputs == "" || *createRawTxTo == "" {
+			createRawTxCmd.Usage()
+			os.Exit(1)
+		}
+		cli.createRawTransaction(*createRawTxInputs, *createRawTxTo, *createRawTxLockTime, *createRawTxPrevOuts, nodeID)
+	}
+	if signRawTxCmd.Parsed() {
+		if signRawTxCmd.NArg() != 1 || *signRawTxPrevOuts == "" {
+			signRawTxCmd.Usage()
+			os.Exit(1)
+		}
+		cli.signRawTransaction(signRawTxCmd.Arg(0), *signRawTxPrevOuts, *signRawTxSigHash, nodeID, *signRawTxPassphrase)
+	}
+	if decodeRawTxCmd.Parsed() {
+		if decodeRawTxCmd.NArg() != 1 {
+			decodeRawTxCmd.Usage()
+			os.Exit(1)
+		}
+		cli.decodeRawTransaction(decodeRawTxCmd.Arg(0))
+	}
+	if sendRawTxCmd.Parsed() {
+		if sendRawTxCmd.NArg() != 1 {
+			sendRawTxCmd.Usage()
+			os.Exit(1)
+		}
+		cli.sendRawTransaction(sendRawTxCmd.Arg(0), nodeID, *sendRawTxMine)
+	}
+	if dumpPrivKeyCmd.Parsed() {
+		if *dumpPrivKeyAddress == "" {
+			dumpPrivKeyCmd.Usage()
+			os.Exit(1)
+		}
+		cli.dumpPrivKey(*dumpPrivKeyAddress, nodeID, *dumpPrivKeyPassphrase)
+	}
+	if importPrivKeyCmd.Parsed() {
+		if importPrivKeyCmd.NArg() != 1 {
+			importPrivKeyCmd.Usage()
+			os.Exit(1)
+		}
+		cli.importPrivKey(importPrivKeyCmd.Arg(0), *importPrivKeyRescan, nodeID, *importPrivKeyPassphrase)
+	}
+	if importAddressCmd.Parsed() {
+		if importAddressCmd.NArg() != 1 {
+			importAddressCmd.Usage()
+			os.Exit(1)
+		}
+		cli.importAddress(importAddressCmd.Arg(0), *importAddressRescan, nodeID, *importAddressPassphrase)
+	}
+	if dumpWalletCmd.Parsed() {
+		if dumpWalletCmd.NArg() != 1 {
+			dumpWalletCmd.Usage()
+			os.Exit(1)
+		}
+		cli.dumpWallet(dumpWalletCmd.Arg(0), nodeID, *dumpWalletPassphrase)
+	}
+	if importWalletCmd.Parsed() {
+		if importWalletCmd.NArg() != 1 {
+			importWalletCmd.Usage()
+			os.Exit(1)
+		}
+		cli.importWallet(importWalletCmd.Arg(0), nodeID, *importWalletPassphrase)
+	}
+	if changePassphraseCmd.Parsed() {
+		cli.changePassphrase(nodeID, *changePassphraseOld, *changePassphraseNew)
+	}
+	if walletPassphraseCmd.Parsed() {
+		cli.walletPassphrase(nodeID, *walletPassphrasePassphrase, *walletPassphraseTimeout)
+	}
+	if walletLockCmd.Parsed() {
+		cli.walletLock(nodeID)
+	}
+	if generateCmd.Parsed() {
+		if *generateAddress == "" || *generateBlocks <= 0 {
+			generateCmd.Usage()
+			os.Exit(1)
+		}
+		cli.generate(*generateAddress, *generateBlocks, nodeID)
+	}
+	if getBlockTemplateCmd.Parsed() {
+		cli.getBlockTemplate(*getBlockTemplateAddress, nodeID)
+	}
+	if submitBlockCmd.Parsed() {
+		if submitBlockCmd.NArg() != 1 {
+			submitBlockCmd.Usage()
+			os.Exit(1)
+		}
+		cli.submitBlock(submitBlockCmd.Arg(0), *submitBlockNonce, nodeID)
+	}
+	if getPoolSharesCmd.Parsed() {
+		cli.getPoolShares(*getPoolSharesReset, nodeID)
+	}
+	if getPeerInfoCmd.Parsed() {
+		cli.getPeerInfo(nodeID)
+	}
+	if listBannedCmd.Parsed() {
+		cli.listBanned(nodeID)
+	}
+	if setBanCmd.Parsed() {
+		if setBanCmd.NArg() != 1 || *setBanTime <= 0 {
+			setBanCmd.Usage()
+			os.Exit(1)
+		}
+		cli.setBan(setBanCmd.Arg(0), *setBanRemove, *setBanTime, nodeID)
+	}
+	if clearBannedCmd.Parsed() {
+		cli.clearBanned(nodeID)
+	}
 }
 
-func (cli *CLI) createBlockchain(address string, nodeID string) {
-	if !ValidateAddress(address) {
-		log.Panic("Address is not valid")
+func (cli *CLI) getBalance(address string, nodeID string) {
+	if address == "" {
+		cli.getWalletBalance(nodeID)
+		return
+	}
+	parsed, err := ParseAddress(address)
+	if err != nil {
+		log.Panicf("ERROR: %s", err)
 	}
-	bc := CreateBlockchain(address, nodeID)
+
+	bc := NewBlockchain(nodeID)
+	UTXOSet := UTXOSet{bc}
 	defer func(Db *bolt.DB) {
 		err := Db.Close()
 		if err != nil {
@@ -163,14 +567,26 @@ func (cli *CLI) createBlockchain(address string, nodeID string) {
 		}
 	}(bc.Db)
 
-	UTXOSet := UTXOSet{bc}
-	UTXOSet.Reindex()
-	fmt.Println("Done")
+	balance := 0
+	UTXOs := UTXOSet.FindUTXO(parsed.LockingScript())
+
+	for _, out := range UTXOs {
+		balance += out.Value
+	}
+
+	label := ""
+	if wallets, err := NewWallets(nodeID); err == nil && wallets.IsWatchOnly(address) {
+		label = " (watch-only)"
+	}
+
+	fmt.Printf("Balance of '%s': %d%s\n", address, balance, label)
 }
 
-func (cli *CLI) getBalance(address string, nodeID string) {
-	if !ValidateAddress(address) {
-		log.Panic("ERROR: Address invalid")
+// getWalletBalance lists the balance of every wallet address, keeping watch-only funds apart
+func (cli *CLI) getWalletBalance(nodeID string) {
+	wallets, err := NewWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
 	}
 
 	bc := NewBlockchain(nodeID)
@@ -182,16 +598,23 @@ func (cli *CLI) getBalance(address string, nodeID string) {
 		}
 	}(bc.Db)
 
-	balance := 0
-	pubKeyHash := util.Base58Decode([]byte(address))
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
-	UTXOs := UTXOSet.FindUTXO(pubKeyHash)
+	spendable, watchOnly := 0, 0
+	for _, address := range wallets.GetAddresses() {
+		balance := 0
+		for _, out := range UTXOSet.FindUTXO(LockingScript(address)) {
+			balance += out.Value
+		}
 
-	for _, out := range UTXOs {
-		balance += out.Value
+		if wallets.IsWatchOnly(address) {
+			watchOnly += balance
+			fmt.Printf("Balance of '%s': %d (watch-only)\n", address, balance)
+		} else {
+			spendable += balance
+			fmt.Printf("Balance of '%s': %d\n", address, balance)
+		}
 	}
 
-	fmt.Printf("Balance of '%s': %d\n", address, balance)
+	fmt.Printf("Total: %d, watch-only: %d\n", spendable, watchOnly)
 }
 
 func (cli *CLI) printChain(nodeID string) {
@@ -223,12 +646,36 @@ func (cli *CLI) printChain(nodeID string) {
 	}
 }
 
-func (cli *CLI) send(from, to string, amount int, nodeID string, mineNow bool) {
-	if !ValidateAddress(to) {
-		log.Panic("ERROR: Recipient Address invalid")
+func (cli *CLI) send(from string, payments []Payment, lockTime int64, nodeID string, mineNow, dryRun bool, psbtFile, passphrase string, external bool, coins CoinSelection) {
+	if err := ValidatePayments(payments); err != nil {
+		log.Panicf("ERROR: %s", err)
+	}
+	if _, err := ParseAddress(from); err != nil {
+		log.Panicf("ERROR: Sender %s", err)
+	}
+	if lockTime < 0 {
+		log.Panic("ERROR: Lock time can't be negative")
 	}
-	if !ValidateAddress(from) {
-		log.Panic("ERROR: Sender Address invalid")
+
+	if client, err := DialNode(nodeID); err == nil {
+		defer client.Close()
+		if mineNow {
+			log.Panic("ERROR: Can't mine while the node is running")
+		}
+
+		var reply string
+		args := SendArgs{from, payments, lockTime, coins.Strategy.Name(), coins.Inputs, dryRun}
+		err = client.Call("Node.Send", args, &reply)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		if dryRun {
+			fmt.Println(reply)
+			return
+		}
+		fmt.Printf("Success, transaction %s\n", reply)
+		return
 	}
 
 	bc := NewBlockchain(nodeID)
@@ -244,9 +691,46 @@ func (cli *CLI) send(from, to string, amount int, nodeID string, mineNow bool) {
 	if err != nil {
 		log.Panic(err)
 	}
-	wallet := wallets.GetWallet(from)
 
-	tx := NewUTXOTransaction(&wallet, to, amount, &UTXOSet)
+	if wallets.IsWatchOnly(from) {
+		if !external {
+			log.Panicf("ERROR: %s is watch-only, use -external to get a transaction for the key holder to sign", from)
+		}
+
+		psbt := NewExternalTransaction(from, payments, lockTime, coins, &UTXOSet)
+		if dryRun {
+			fmt.Println(psbt.Tx.String())
+			return
+		}
+		psbt.SaveToFile(psbtFile)
+
+		fmt.Printf("Unsigned transaction written to %s, sign it with signpsbt where the key is kept\n", psbtFile)
+		return
+	}
+	unlockWallets(wallets, passphrase)
+
+	if redeemScript, ok := wallets.MultiSig[from]; ok {
+		psbt := NewMultiSigTransaction(from, redeemScript, payments, lockTime, coins, &UTXOSet)
+		signed := psbt.Sign(wallets, SigHashAll)
+		if dryRun {
+			fmt.Println(psbt.Tx.String())
+			return
+		}
+		psbt.SaveToFile(psbtFile)
+
+		fmt.Printf("Added %d signature(s), partially signed transaction written to %s\n", signed, psbtFile)
+		return
+	}
+
+	tx := NewUTXOTransaction(wallets, from, payments, lockTime, coins, &UTXOSet)
+	if dryRun {
+		// The wallet isn't saved, so an HD change address is handed out again next time
+		fmt.Println(tx.String())
+		return
+	}
+	if wallets.HasSeed() {
+		wallets.SaveToFile(nodeID)
+	}
 	if mineNow {
 		cbTx := NewCoinbaseTX(from, "")
 		txs := []*Transaction{cbTx, tx}
@@ -254,50 +738,928 @@ func (cli *CLI) send(from, to string, amount int, nodeID string, mineNow bool) {
 		newBlock := bc.MineBlock(txs)
 		UTXOSet.Update(newBlock)
 	} else {
-		SendTx(knownNodes[0], tx)
+		SendTx(knownNodeList()[0], tx)
 	}
 
 	fmt.Printf("\n Success")
 }
 
-func (cli *CLI) listAddresses(nodeID string) {
+// consolidate merges every unspent output of address into a single output paid back to it
+func (cli *CLI) consolidate(address, nodeID string, mineNow bool, passphrase string) {
+	if _, err := ParseAddress(address); err != nil {
+		log.Panicf("ERROR: %s", err)
+	}
+
+	bc := NewBlockchain(nodeID)
+	UTXOSet := UTXOSet{bc}
+	defer func(Db *bolt.DB) {
+		err := Db.Close()
+		if err != nil {
+			log.Panic(err)
+		}
+	}(bc.Db)
+
 	wallets, err := NewWallets(nodeID)
 	if err != nil {
 		log.Panic(err)
 	}
-	addresses := wallets.GetAddresses()
+	if _, ok := wallets.Wallets[address]; !ok {
+		log.Panic("ERROR: Only addresses whose key is in the wallet can be consolidated")
+	}
+	unlockWallets(wallets, passphrase)
 
-	for _, address := range addresses {
-		fmt.Println(address)
+	utxos := UTXOSet.FindUTXOs(LockingScript(address))
+	if len(utxos) < 2 {
+		fmt.Printf("Nothing to consolidate, %s has %d unspent output(s)\n", address, len(utxos))
+		return
+	}
+
+	var inputs []Outpoint
+	for _, utxo := range utxos {
+		inputs = append(inputs, utxo.Outpoint)
+	}
+	total := sumUTXOs(utxos)
+
+	tx := NewUTXOTransaction(wallets, address, []Payment{{address, total}}, 0, CoinSelection{Inputs: inputs}, &UTXOSet)
+	if mineNow {
+		cbTx := NewCoinbaseTX(address, "")
+
+		newBlock := bc.MineBlock([]*Transaction{cbTx, tx})
+		UTXOSet.Update(newBlock)
+	} else {
+		SendTx(knownNodeList()[0], tx)
+	}
+
+	fmt.Printf("Success, merged %d outputs worth %d in transaction %x\n", len(utxos), total, tx.ID)
+}
+
+func (cli *CLI) getPubKey(address, nodeID string) {
+	wallets, err := NewWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	wallet, ok := wallets.Wallets[address]
+	if !ok {
+		log.Panic("ERROR: Address is not in the wallet")
 	}
+
+	fmt.Printf("%x\n", wallet.PublicKey)
 }
 
-func (cli *CLI) createWallet(nodeID string) {
+func (cli *CLI) createMultiSig(m int, keys []string, nodeID string) {
 	wallets, _ := NewWallets(nodeID)
-	address := wallets.CreateWallet()
+
+	var pubKeys [][]byte
+	for _, key := range keys {
+		key = strings.TrimSpace(key)
+
+		if wallet, ok := wallets.Wallets[key]; ok {
+			pubKeys = append(pubKeys, wallet.PublicKey)
+			continue
+		}
+
+		pubKey, err := hex.DecodeString(key)
+		if err != nil {
+			log.Panicf("ERROR: %s is neither a wallet address nor a hex public key", key)
+		}
+		pubKeys = append(pubKeys, pubKey)
+	}
+
+	address, err := wallets.CreateMultiSig(m, pubKeys)
+	if err != nil {
+		log.Panic(err)
+	}
+	encryptWallets(wallets, "")
 	wallets.SaveToFile(nodeID)
 
-	fmt.Printf("Success, your new address is: %s\n", address)
+	fmt.Printf("Success, your new %d-of-%d multisig address is: %s\n", m, len(pubKeys), address)
+	fmt.Printf("Redeem script: %x\n", wallets.MultiSig[address])
 }
 
-func (cli *CLI) reindexUtxo(nodeID string) {
-	bc := NewBlockchain(nodeID)
+func (cli *CLI) signPSBT(file, sigHash, nodeID, passphrase string) {
+	hashType, err := ParseSigHashType(sigHash)
+	if err != nil {
+		log.Panic(err)
+	}
 
-	UTXOSet := UTXOSet{bc}
-	UTXOSet.Reindex()
+	psbt, err := LoadPSBTFromFile(file)
+	if err != nil {
+		log.Panic(err)
+	}
 
-	count := UTXOSet.CountTransactions()
-	fmt.Printf("Reindexed, there are %d transactions in the UTXO set.\n", count)
+	wallets, err := NewWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	unlockWallets(wallets, passphrase)
+
+	signed := psbt.Sign(wallets, hashType)
+	psbt.SaveToFile(file)
+
+	fmt.Printf("Added %d signature(s)\n", signed)
+	if psbt.IsComplete() {
+		fmt.Println("Transaction has enough signatures and can be finalized")
+	}
 }
 
-func (cli *CLI) startNode(nodeID, minerAddress string) {
-	fmt.Printf("Starting node %s\n", nodeID)
-	if len(minerAddress) > 0 {
-		if ValidateAddress(minerAddress) {
-			fmt.Printf("Miner address is %s\n", minerAddress)
-		} else {
-			log.Panic("Wrong address")
-		}
+func (cli *CLI) finalizePSBT(file, nodeID string, mineNow bool) {
+	psbt, err := LoadPSBTFromFile(file)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	tx, err := psbt.Finalize()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if mineNow {
+		bc := NewBlockchain(nodeID)
+		UTXOSet := UTXOSet{bc}
+		defer func(Db *bolt.DB) {
+			err := Db.Close()
+			if err != nil {
+				log.Panic(err)
+			}
+		}(bc.Db)
+
+		rewardAddress := psbt.InputAddress(0)
+		cbTx := NewCoinbaseTX(rewardAddress, "")
+
+		newBlock := bc.MineBlock([]*Transaction{cbTx, tx})
+		UTXOSet.Update(newBlock)
+	} else {
+		SendTx(knownNodeList()[0], tx)
+	}
+
+	fmt.Printf("\n Success, transaction %x\n", tx.ID)
+}
+
+func (cli *CLI) createRawTransaction(inputList, paymentList string, lockTime int64, prevOutsFile, nodeID string) {
+	inputs, err := ParseOutpoints(inputList)
+	if err != nil {
+		log.Panic(err)
+	}
+	payments, err := ParsePayments(paymentList)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	tx, err := NewRawTransaction(inputs, payments, lockTime)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if prevOutsFile != "" {
+		bc := NewBlockchain(nodeID)
+		defer func(Db *bolt.DB) {
+			err := Db.Close()
+			if err != nil {
+				log.Panic(err)
+			}
+		}(bc.Db)
+
+		prevOuts, err := UTXOSet{bc}.FindPrevOutputs(tx)
+		if err != nil {
+			log.Panic(err)
+		}
+		if paid, spent := sumOutputs(tx.Vout), sumUTXOs(prevOuts); paid != spent {
+			fmt.Printf("Warning: outputs pay %d, inputs hold %d\n", paid, spent)
+		}
+		err = SavePrevOutputs(prevOutsFile, prevOuts)
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+
+	fmt.Println(EncodeRawTransaction(tx))
+}
+
+func (cli *CLI) signRawTransaction(raw, prevOutsFile, sigHash, nodeID, passphrase string) {
+	hashType, err := ParseSigHashType(sigHash)
+	if err != nil {
+		log.Panic(err)
+	}
+	tx, err := DecodeRawTransaction(raw)
+	if err != nil {
+		log.Panic(err)
+	}
+	prevOuts, err := LoadPrevOutputs(prevOutsFile)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	wallets, err := NewWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	unlockWallets(wallets, passphrase)
+
+	complete, err := wallets.SignRawTransaction(tx, prevOuts, hashType)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Println(EncodeRawTransaction(tx))
+	if !complete {
+		fmt.Println("Some inputs aren't signed yet, sign the transaction where their keys are kept")
+	}
+}
+
+func (cli *CLI) decodeRawTransaction(raw string) {
+	tx, err := DecodeRawTransaction(raw)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Println(tx)
+}
+
+func (cli *CLI) sendRawTransaction(raw, nodeID string, mineNow bool) {
+	tx, err := DecodeRawTransaction(raw)
+	if err != nil {
+		log.Panic(err)
+	}
+	if !tx.IsSigned() {
+		log.Panic("ERROR: Transaction isn't fully signed")
+	}
+
+	if mineNow {
+		bc := NewBlockchain(nodeID)
+		UTXOSet := UTXOSet{bc}
+		defer func(Db *bolt.DB) {
+			err := Db.Close()
+			if err != nil {
+				log.Panic(err)
+			}
+		}(bc.Db)
+
+		rewardAddress := tx.signerAddress(0)
+		if rewardAddress == "" {
+			log.Panic("ERROR: The first input isn't signed by a single key to pay the reward to")
+		}
+		cbTx := NewCoinbaseTX(rewardAddress, "")
+
+		newBlock := bc.MineBlock([]*Transaction{cbTx, tx})
+		UTXOSet.Update(newBlock)
+	} else {
+		SendTx(knownNodeList()[0], tx)
+	}
+
+	fmt.Printf("\n Success, transaction %x\n", tx.ID)
+}
+
+func (cli *CLI) listAddresses(nodeID string) {
+	wallets, err := NewWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	addresses := wallets.GetAddresses()
+
+	for _, address := range addresses {
+		if wallets.IsWatchOnly(address) {
+			fmt.Printf("%s (watch-only)\n", address)
+		} else {
+			fmt.Println(address)
+		}
+	}
+}
+
+func (cli *CLI) importAddress(addressOrPubKey string, rescan bool, nodeID, passphrase string) {
+	wallets, _ := NewWallets(nodeID)
+	encryptWallets(wallets, passphrase)
+
+	address, err := wallets.ImportAddress(addressOrPubKey)
+	if err != nil {
+		log.Panic(err)
+	}
+	wallets.SaveToFile(nodeID)
+
+	fmt.Printf("Watching %s\n", address)
+	if rescan {
+		bc := NewBlockchain(nodeID)
+		defer func(Db *bolt.DB) {
+			err := Db.Close()
+			if err != nil {
+				log.Panic(err)
+			}
+		}(bc.Db)
+
+		printFunds(UTXOSet{bc}, []string{address})
+	}
+}
+
+func (cli *CLI) createWallet(schemeName, nodeID, passphrase string, hd bool) {
+	scheme, err := GetSignatureSchemeByName(schemeName)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	wallets, _ := NewWallets(nodeID)
+	if wallets.IsEncrypted() {
+		unlockWallets(wallets, passphrase)
+	} else {
+		encryptWallets(wallets, passphrase)
+	}
+
+	var address string
+	if hd {
+		mnemonic, err := NewMnemonic()
+		if err != nil {
+			log.Panic(err)
+		}
+		err = wallets.SetMnemonic(mnemonic, scheme)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		fmt.Printf("Write down your mnemonic, it restores every address of this wallet:\n%s\n", mnemonic)
+	}
+
+	if wallets.HasSeed() {
+		address, err = wallets.NewReceiveAddress()
+		if err != nil {
+			log.Panic(err)
+		}
+	} else {
+		address = wallets.CreateWallet(scheme)
+	}
+	wallets.SaveToFile(nodeID)
+
+	fmt.Printf("Success, your new address is: %s\n", address)
+}
+
+func (cli *CLI) restoreWallet(mnemonic, schemeName string, gapLimit int, nodeID, passphrase string) {
+	scheme, err := GetSignatureSchemeByName(schemeName)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	wallets, _ := NewWallets(nodeID)
+	if wallets.IsEncrypted() {
+		unlockWallets(wallets, passphrase)
+	} else {
+		encryptWallets(wallets, passphrase)
+	}
+
+	err = wallets.SetMnemonic(mnemonic, scheme)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	bc := NewBlockchain(nodeID)
+	defer func(Db *bolt.DB) {
+		err := Db.Close()
+		if err != nil {
+			log.Panic(err)
+		}
+	}(bc.Db)
+
+	found, err := wallets.Rescan(bc, gapLimit)
+	if err != nil {
+		log.Panic(err)
+	}
+	if wallets.HD.NextIndex[hdReceiveBranch] == 0 {
+		_, err = wallets.NewReceiveAddress()
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+	wallets.SaveToFile(nodeID)
+
+	fmt.Printf("Success, restored the HD wallet with %d used address(es)\n", found)
+}
+
+func (cli *CLI) reindexUtxo(nodeID string) {
+	bc := NewBlockchain(nodeID)
+
+	UTXOSet := UTXOSet{bc}
+	UTXOSet.Reindex()
+
+	count := UTXOSet.CountTransactions()
+	fmt.Printf("Reindexed, there are %d transactions in the UTXO set.\n", count)
+}
+
+func (cli *CLI) generate(address string, blocks int, nodeID string) {
+	if _, err := ParseAddress(address); err != nil {
+		log.Panicf("ERROR: %s", err)
+	}
+
+	if client, err := DialNode(nodeID); err == nil {
+		defer client.Close()
+
+		var hashes []string
+		err = client.Call("Node.Generate", GenerateArgs{address, blocks}, &hashes)
+		if err != nil {
+			log.Panic(err)
+		}
+		for _, hash := range hashes {
+			fmt.Println(hash)
+		}
+		return
+	}
+
+	bc := NewBlockchain(nodeID)
+	defer func(Db *bolt.DB) {
+		err := Db.Close()
+		if err != nil {
+			log.Panic(err)
+		}
+	}(bc.Db)
+
+	for _, hash := range bc.Generate(address, blocks) {
+		fmt.Printf("%x\n", hash)
+	}
+}
+
+// blockTemplateJSON is a block template for external mining software: the header fields,
+// the serialized transactions and the serialized block with nonce 0, all hex
+type blockTemplateJSON struct {
+	Height        int      `json:"height"`
+	PrevBlockHash string   `json:"previous_block_hash"`
+	Timestamp     int64    `json:"timestamp"`
+	TargetBits    int      `json:"target_bits"`
+	MerkleRoot    string   `json:"merkle_root"`
+	Fees          int      `json:"fees"`
+	Transactions  []string `json:"transactions"` // The coinbase first
+	Block         string   `json:"block"`
+}
+
+func (cli *CLI) getBlockTemplate(address, nodeID string) {
+	client, err := DialNode(nodeID)
+	if err != nil {
+		log.Panicf("ERROR: Can't reach node %s: %s", nodeID, err)
+	}
+	defer client.Close()
+
+	var template BlockTemplate
+	err = client.Call("Node.GetBlockTemplate", GetBlockTemplateArgs{address}, &template)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	out := blockTemplateJSON{
+		template.Height,
+		hex.EncodeToString(template.PrevBlockHash),
+		template.Timestamp,
+		template.TargetBits,
+		hex.EncodeToString(template.MerkleRoot),
+		template.Fees,
+		nil,
+		hex.EncodeToString(template.Block(0).Serialize()),
+	}
+	for _, tx := range template.Transactions {
+		out.Transactions = append(out.Transactions, hex.EncodeToString(tx.Serialize()))
+	}
+
+	content, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Println(string(content))
+}
+
+// submitBlock sends a serialized block to the running node, a nonce of 0 or more is
+// set on the block first and its hash recomputed, for the block of getblocktemplate
+func (cli *CLI) submitBlock(raw string, nonce int, nodeID string) {
+	data, err := hex.DecodeString(raw)
+	if err != nil {
+		log.Panicf("ERROR: Block isn't hex: %s", err)
+	}
+	if nonce >= 0 {
+		block := DeserializeBlock(data)
+		block.Nonce = nonce
+		hash := sha256.Sum256(NewProofOfWork(block).prepareData(nonce))
+		block.Hash = hash[:]
+		data = block.Serialize()
+	}
+
+	client, err := DialNode(nodeID)
+	if err != nil {
+		log.Panicf("ERROR: Can't reach node %s: %s", nodeID, err)
+	}
+	defer client.Close()
+
+	var hash string
+	err = client.Call("Node.SubmitBlock", SubmitBlockArgs{data}, &hash)
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Printf("Added block %s\n", hash)
+}
+
+func (cli *CLI) getPoolShares(reset bool, nodeID string) {
+	workers := []WorkerShares{}
+
+	if client, err := DialNode(nodeID); err == nil {
+		defer client.Close()
+
+		err = client.Call("Node.GetPoolShares", GetPoolSharesArgs{reset}, &workers)
+		if err != nil {
+			log.Panic(err)
+		}
+	} else {
+		ps, err := LoadPoolShares(nodeID)
+		if err != nil {
+			log.Panic(err)
+		}
+		workers, err = ps.List(reset)
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+
+	content, err := json.MarshalIndent(workers, "", "  ")
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Println(string(content))
+}
+
+func (cli *CLI) getPeerInfo(nodeID string) {
+	client, err := DialNode(nodeID)
+	if err != nil {
+		log.Panicf("ERROR: Can't reach node %s: %s", nodeID, err)
+	}
+	defer client.Close()
+
+	var infos []PeerInfo
+	err = client.Call("Node.GetPeerInfo", struct{}{}, &infos)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	content, err := json.MarshalIndent(infos, "", "  ")
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Println(string(content))
+}
+
+// The ban commands go to the running node, or edit its ban list file when it's stopped
+
+func (cli *CLI) listBanned(nodeID string) {
+	var entries []BanEntry
+
+	if client, err := DialNode(nodeID); err == nil {
+		defer client.Close()
+
+		err = client.Call("Node.ListBanned", struct{}{}, &entries)
+		if err != nil {
+			log.Panic(err)
+		}
+	} else {
+		bl, err := LoadBanList(nodeID)
+		if err != nil {
+			log.Panic(err)
+		}
+		entries = bl.List()
+	}
+
+	for _, entry := range entries {
+		until := time.Unix(entry.BannedUntil, 0).Format(time.RFC3339)
+		fmt.Printf("%s banned until %s: %s\n", entry.Subnet, until, entry.Reason)
+	}
+	fmt.Printf("%d banned\n", len(entries))
+}
+
+func (cli *CLI) setBan(subnet string, remove bool, banTime int64, nodeID string) {
+	if client, err := DialNode(nodeID); err == nil {
+		defer client.Close()
+
+		err = client.Call("Node.SetBan", SetBanArgs{subnet, remove, banTime}, &struct{}{})
+		if err != nil {
+			log.Panicf("ERROR: %s", err)
+		}
+	} else {
+		bl, err := LoadBanList(nodeID)
+		if err != nil {
+			log.Panic(err)
+		}
+		if remove {
+			err = bl.Unban(subnet)
+		} else {
+			_, err = bl.Ban(subnet, time.Now().Add(time.Duration(banTime)*time.Second), "manually banned")
+		}
+		if err != nil {
+			log.Panicf("ERROR: %s", err)
+		}
+	}
+
+	if remove {
+		fmt.Printf("Unbanned %s\n", subnet)
+	} else {
+		fmt.Printf("Banned %s for %d seconds\n", subnet, banTime)
+	}
+}
+
+func (cli *CLI) clearBanned(nodeID string) {
+	if client, err := DialNode(nodeID); err == nil {
+		defer client.Close()
+
+		err = client.Call("Node.ClearBanned", struct{}{}, &struct{}{})
+		if err != nil {
+			log.Panic(err)
+		}
+	} else {
+		bl, err := LoadBanList(nodeID)
+		if err != nil {
+			log.Panic(err)
+		}
+		if err := bl.Clear(); err != nil {
+			log.Panic(err)
+		}
+	}
+
+	fmt.Println("Ban list cleared")
+}
+
+func (cli *CLI) startNode(nodeID, minerAddress string) {
+	fmt.Printf("Starting node %s\n", nodeID)
+	if minerAddress == "" {
+		minerAddress = config.Miner
+	}
+	if len(minerAddress) > 0 {
+		if _, err := ParseAddress(minerAddress); err != nil {
+			log.Panicf("ERROR: Miner %s", err)
+		}
+		fmt.Printf("Miner address is %s\n", minerAddress)
+	}
+	StartServer(nodeID, minerAddress)
+}
+
+func (cli *CLI) dumpPrivKey(address, nodeID, passphrase string) {
+	wallets, err := NewWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	wallet, ok := wallets.Wallets[address]
+	if !ok {
+		log.Panic("ERROR: Address is not in the wallet")
+	}
+	unlockWallets(wallets, passphrase)
+
+	key, err := EncodePrivateKey(wallet)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Println(key)
+}
+
+func (cli *CLI) importPrivKey(key string, rescan bool, nodeID, passphrase string) {
+	wallet, err := DecodePrivateKey(key)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	wallets, _ := NewWallets(nodeID)
+	if wallets.IsEncrypted() {
+		unlockWallets(wallets, passphrase)
+	} else {
+		encryptWallets(wallets, passphrase)
+	}
+
+	address, added := wallets.ImportKey(wallet)
+	if !added {
+		fmt.Printf("Address %s is already in the wallet\n", address)
+		return
+	}
+	wallets.SaveToFile(nodeID)
+
+	fmt.Printf("Imported %s\n", address)
+	if rescan {
+		bc := NewBlockchain(nodeID)
+		defer func(Db *bolt.DB) {
+			err := Db.Close()
+			if err != nil {
+				log.Panic(err)
+			}
+		}(bc.Db)
+
+		printFunds(UTXOSet{bc}, []string{address})
+	}
+}
+
+func (cli *CLI) dumpWallet(file, nodeID, passphrase string) {
+	wallets, err := NewWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	unlockWallets(wallets, passphrase)
+
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer f.Close()
+
+	err = wallets.Dump(f)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("Wallet dumped to %s, keep the file private\n", file)
+}
+
+func (cli *CLI) importWallet(file, nodeID, passphrase string) {
+	f, err := os.Open(file)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer f.Close()
+
+	wallets, _ := NewWallets(nodeID)
+	if wallets.IsEncrypted() {
+		unlockWallets(wallets, passphrase)
+	} else {
+		encryptWallets(wallets, passphrase)
+	}
+
+	imported, err := wallets.ImportDump(f)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	bc := NewBlockchain(nodeID)
+	defer func(Db *bolt.DB) {
+		err := Db.Close()
+		if err != nil {
+			log.Panic(err)
+		}
+	}(bc.Db)
+
+	if wallets.HasSeed() {
+		found, err := wallets.Rescan(bc, defaultGapLimit)
+		if err != nil {
+			log.Panic(err)
+		}
+		fmt.Printf("Rescanned the HD wallet, %d used address(es)\n", found)
+	}
+	wallets.SaveToFile(nodeID)
+
+	fmt.Printf("Imported %d key(s)\n", len(imported))
+	printFunds(UTXOSet{bc}, imported)
+}
+
+// printFunds reports the unspent outputs the UTXO set holds for each address
+func printFunds(set UTXOSet, addresses []string) {
+	for _, address := range addresses {
+		UTXOs := set.FindUTXO(LockingScript(address))
+		if len(UTXOs) == 0 {
+			continue
+		}
+
+		balance := 0
+		for _, out := range UTXOs {
+			balance += out.Value
+		}
+		fmt.Printf("Found %d unspent output(s) worth %d on %s\n", len(UTXOs), balance, address)
+	}
+}
+
+func (cli *CLI) changePassphrase(nodeID, oldPassphrase, newPassphrase string) {
+	wallets, err := NewWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	if wallets.IsEncrypted() {
+		unlockWallets(wallets, oldPassphrase)
+	}
+
+	err = wallets.SetPassphrase(readNewPassphrase(newPassphrase))
+	if err != nil {
+		log.Panic(err)
+	}
+	wallets.SaveToFile(nodeID)
+
+	fmt.Println("Wallet passphrase changed")
+}
+
+func (cli *CLI) walletPassphrase(nodeID, passphrase string, timeout int) {
+	client, err := DialNode(nodeID)
+	if err != nil {
+		log.Panicf("ERROR: Can't reach node %s: %s", nodeID, err)
+	}
+	defer client.Close()
+
+	args := WalletPassphraseArgs{readPassphrase("Wallet passphrase: ", passphrase), timeout}
+	err = client.Call("Node.WalletPassphrase", args, &struct{}{})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("Wallet unlocked for %d seconds\n", timeout)
+}
+
+func (cli *CLI) walletLock(nodeID string) {
+	client, err := DialNode(nodeID)
+	if err != nil {
+		log.Panicf("ERROR: Can't reach node %s: %s", nodeID, err)
+	}
+	defer client.Close()
+
+	err = client.Call("Node.WalletLock", struct{}{}, &struct{}{})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Println("Wallet locked")
+}
+
+// Passphrases are read without echo from a terminal, or as a line from piped input
+
+func readPassphrase(prompt, value string) []byte {
+	if value != "" {
+		return []byte(value)
+	}
+
+	fmt.Fprint(os.Stderr, prompt)
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			log.Panic(err)
+		}
+		return passphrase
+	}
+
+	line, err := stdinReader.ReadString('\n')
+	if err != nil && line == "" {
+		log.Panic("ERROR: No passphrase given")
+	}
+
+	return []byte(strings.TrimRight(line, "\r\n"))
+}
+
+var stdinReader = bufio.NewReader(os.Stdin)
+
+func readNewPassphrase(value string) []byte {
+	passphrase := readPassphrase("New wallet passphrase: ", value)
+	if value == "" && term.IsTerminal(int(os.Stdin.Fd())) {
+		if !bytes.Equal(passphrase, readPassphrase("Repeat the passphrase: ", "")) {
+			log.Panic("ERROR: Passphrases don't match")
+		}
+	}
+
+	return passphrase
+}
+
+func unlockWallets(wallets *Wallets, passphrase string) {
+	if !wallets.IsLocked() {
+		return
+	}
+
+	err := wallets.Unlock(readPassphrase("Wallet passphrase: ", passphrase))
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// encryptWallets sets a passphrase on new wallets and on files from before encryption
+func encryptWallets(wallets *Wallets, passphrase string) {
+	if wallets.IsEncrypted() {
+		return
+	}
+
+	err := wallets.SetPassphrase(readNewPassphrase(passphrase))
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// parseCoinSelection builds the coin selection from the -coinselect and -inputs flags
+func parseCoinSelection(strategy, inputs string) CoinSelection {
+	selector, err := GetCoinSelector(strategy)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	coins := CoinSelection{Strategy: selector}
+	if inputs != "" {
+		coins.Inputs, err = ParseOutpoints(inputs)
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+
+	return coins
+}
+
+// parseWithArgument parses flags around a single positional argument, so both
+// "importprivkey KEY -rescan" and "importprivkey -rescan KEY" work
+func parseWithArgument(cmd *flag.FlagSet, args []string) {
+	err := cmd.Parse(args)
+	if err != nil {
+		log.Panic(err)
+	}
+	if cmd.NArg() > 1 {
+		rest := append([]string{}, cmd.Args()[1:]...)
+		err = cmd.Parse(append(rest, cmd.Arg(0)))
+		if err != nil {
+			log.Panic(err)
+		}
 	}
-	StartServer(nodeID, minerAddress)
 }
@@ -0,0 +1,280 @@
+package domain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+const defaultCoinSelector = "bnb"
+
+// Branch and bound gives up after this many tries and falls back to largest-first
+const bnbMaxTries = 100000
+
+var errNotEnoughFunds = errors.New("not enough funds")
+
+// Outpoint references an output of a transaction
+type Outpoint struct {
+	Txid []byte
+	Vout int
+}
+
+// UTXO is an unspent output together with its outpoint
+type UTXO struct {
+	Outpoint
+	Output TXOutput
+}
+
+// CoinSelector picks unspent outputs worth at least amount
+type CoinSelector interface {
+	Name() string
+	Select(utxos []UTXO, amount int) ([]UTXO, error)
+}
+
+// CoinSelection is how a transaction chooses its inputs, explicit Inputs are spent as
+// given and the Strategy picks from every spendable output otherwise
+type CoinSelection struct {
+	Strategy CoinSelector
+	Inputs   []Outpoint
+}
+
+var coinSelectors = map[string]CoinSelector{
+	"largest-first":  largestFirst{},
+	"smallest-first": smallestFirst{},
+	"bnb":            branchAndBound{},
+	"random":         randomSelector{},
+}
+
+func GetCoinSelector(name string) (CoinSelector, error) {
+	selector, ok := coinSelectors[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown coin selection %s", name)
+	}
+
+	return selector, nil
+}
+
+// ParseOutpoints parses a comma separated list of txid:vout pairs
+func ParseOutpoints(list string) ([]Outpoint, error) {
+	var outpoints []Outpoint
+
+	for _, item := range strings.Split(list, ",") {
+		parts := strings.Split(strings.TrimSpace(item), ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("input %s is not in the form txid:vout", item)
+		}
+
+		txID, err := hex.DecodeString(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("input %s has an invalid transaction ID", item)
+		}
+		vout, err := strconv.Atoi(parts[1])
+		if err != nil || vout < 0 {
+			return nil, fmt.Errorf("input %s has an invalid output index", item)
+		}
+
+		outpoints = append(outpoints, Outpoint{txID, vout})
+	}
+
+	return outpoints, nil
+}
+
+// FindUTXOs returns every unspent output locked with lockingScript
+func (u UTXOSet) FindUTXOs(lockingScript []byte) []UTXO {
+	var utxos []UTXO
+
+	err := u.Blockchain.Db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(utxoBucket))
+		c := b.Cursor()
+
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			outs := DeserializeOutputs(v)
+
+			for outIdx, out := range outs.Outputs {
+				if out.IsLockedWithScript(lockingScript) {
+					txID := append([]byte{}, k...)
+					utxos = append(utxos, UTXO{Outpoint{txID, outIdx}, out})
+				}
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return utxos
+}
+
+// selectCoins returns the outputs of from to spend and their total value
+func (c CoinSelection) selectCoins(set *UTXOSet, from string, amount int) ([]UTXO, int, error) {
+	lockingScript := LockingScript(from)
+
+	var selected []UTXO
+	if len(c.Inputs) > 0 {
+		for _, outpoint := range c.Inputs {
+			outs, ok := set.FindOutputs(outpoint.Txid)
+			out, unspent := outs.Outputs[outpoint.Vout]
+			if !ok || !unspent {
+				return nil, 0, fmt.Errorf("input %x:%d isn't an unspent output", outpoint.Txid, outpoint.Vout)
+			}
+			if !bytes.Equal(out.ScriptPubKey, lockingScript) {
+				return nil, 0, fmt.Errorf("input %x:%d doesn't belong to %s", outpoint.Txid, outpoint.Vout, from)
+			}
+			for _, utxo := range selected {
+				if bytes.Equal(utxo.Txid, outpoint.Txid) && utxo.Vout == outpoint.Vout {
+					return nil, 0, fmt.Errorf("input %x:%d is listed twice", outpoint.Txid, outpoint.Vout)
+				}
+			}
+
+			selected = append(selected, UTXO{outpoint, out})
+		}
+	} else {
+		strategy := c.Strategy
+		if strategy == nil {
+			strategy = coinSelectors[defaultCoinSelector]
+		}
+
+		var err error
+		selected, err = strategy.Select(set.FindUTXOs(lockingScript), amount)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	total := sumUTXOs(selected)
+	if total < amount {
+		return nil, 0, errNotEnoughFunds
+	}
+
+	return selected, total, nil
+}
+
+func sumUTXOs(utxos []UTXO) int {
+	total := 0
+	for _, utxo := range utxos {
+		total += utxo.Output.Value
+	}
+
+	return total
+}
+
+// accumulate takes outputs in order until amount is reached
+func accumulate(utxos []UTXO, amount int) ([]UTXO, error) {
+	var selected []UTXO
+	total := 0
+
+	for _, utxo := range utxos {
+		if total >= amount {
+			break
+		}
+		selected = append(selected, utxo)
+		total += utxo.Output.Value
+	}
+
+	if total < amount {
+		return nil, errNotEnoughFunds
+	}
+
+	return selected, nil
+}
+
+func sortedUTXOs(utxos []UTXO, descending bool) []UTXO {
+	sorted := append([]UTXO{}, utxos...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if descending {
+			return sorted[i].Output.Value > sorted[j].Output.Value
+		}
+		return sorted[i].Output.Value < sorted[j].Output.Value
+	})
+
+	return sorted
+}
+
+// largestFirst spends as few outputs as possible
+type largestFirst struct{}
+
+func (largestFirst) Name() string { return "largest-first" }
+
+func (largestFirst) Select(utxos []UTXO, amount int) ([]UTXO, error) {
+	return accumulate(sortedUTXOs(utxos, true), amount)
+}
+
+// smallestFirst cleans up small outputs, at the cost of bigger transactions
+type smallestFirst struct{}
+
+func (smallestFirst) Name() string { return "smallest-first" }
+
+func (smallestFirst) Select(utxos []UTXO, amount int) ([]UTXO, error) {
+	return accumulate(sortedUTXOs(utxos, false), amount)
+}
+
+// randomSelector doesn't reveal anything about the wallet through the order of its outputs
+type randomSelector struct{}
+
+func (randomSelector) Name() string { return "random" }
+
+func (randomSelector) Select(utxos []UTXO, amount int) ([]UTXO, error) {
+	shuffled := append([]UTXO{}, utxos...)
+	rand.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+
+	return accumulate(shuffled, amount)
+}
+
+// branchAndBound searches depth first for a set of outputs worth exactly amount,
+// so no change output is needed, and falls back to largest-first
+type branchAndBound struct{}
+
+func (branchAndBound) Name() string { return "bnb" }
+
+func (branchAndBound) Select(utxos []UTXO, amount int) ([]UTXO, error) {
+	sorted := sortedUTXOs(utxos, true)
+
+	// remaining[i] is the value of the outputs from i on, to prune branches that can't reach amount
+	remaining := make([]int, len(sorted)+1)
+	for i := len(sorted) - 1; i >= 0; i-- {
+		remaining[i] = remaining[i+1] + sorted[i].Output.Value
+	}
+
+	tries := 0
+	var chosen []int
+	var search func(i, total int) bool
+	search = func(i, total int) bool {
+		tries++
+		if total == amount {
+			return true
+		}
+		if total > amount || i == len(sorted) || total+remaining[i] < amount || tries > bnbMaxTries {
+			return false
+		}
+
+		chosen = append(chosen, i)
+		if search(i+1, total+sorted[i].Output.Value) {
+			return true
+		}
+		chosen = chosen[:len(chosen)-1]
+
+		return search(i+1, total)
+	}
+
+	if amount > 0 && search(0, 0) {
+		var selected []UTXO
+		for _, i := range chosen {
+			selected = append(selected, sorted[i])
+		}
+		return selected, nil
+	}
+
+	return largestFirst{}.Select(utxos, amount)
+}
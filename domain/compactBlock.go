@@ -0,0 +1,305 @@
+package domain
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"log"
+	"math/big"
+	"net"
+	"sync"
+)
+
+// Compact blocks announce a new block as its header and a short ID of every
+// transaction, receivers fill in the transactions from their mempool and ask only
+// for the missing ones with getblocktxn. When the rebuilt block doesn't match the
+// header's merkle root the full block is requested instead.
+const shortIDLen = 6
+
+// maxPendingCompact limits the blocks waiting for missing transactions
+const maxPendingCompact = 16
+
+type blockHeader struct {
+	Timestamp     int64
+	PrevBlockHash []byte
+	MerkleRoot    []byte
+	Hash          []byte
+	Nonce         int
+	Height        int
+}
+
+type prefilledTx struct {
+	Index       int
+	Transaction []byte
+}
+
+type cmpctblock struct {
+	AddrFrom  string
+	Header    blockHeader
+	Nonce     uint64 // Salts the short IDs of this announcement
+	ShortIDs  [][]byte
+	Prefilled []prefilledTx // Transactions the receiver can't have, the coinbase
+}
+
+type getblocktxn struct {
+	AddrFrom  string
+	BlockHash []byte
+	Indexes   []int
+}
+
+type blocktxn struct {
+	AddrFrom     string
+	BlockHash    []byte
+	Transactions [][]byte
+}
+
+// partialBlock is a compact block waiting for the transactions in missing
+type partialBlock struct {
+	header       blockHeader
+	transactions []*Transaction
+	missing      []int
+}
+
+var pendingCompact = struct {
+	sync.Mutex
+	blocks map[string]*partialBlock
+}{blocks: make(map[string]*partialBlock)}
+
+func shortIDKey(blockHash []byte, nonce uint64) []byte {
+	data := binary.LittleEndian.AppendUint64(append([]byte{}, blockHash...), nonce)
+	key := sha256.Sum256(data)
+
+	return key[:]
+}
+
+func shortTxID(key, txID []byte) []byte {
+	hash := sha256.Sum256(append(append([]byte{}, key...), txID...))
+
+	return hash[:shortIDLen]
+}
+
+func newCmpctBlock(b *Block) cmpctblock {
+	var nonce [8]byte
+	_, err := rand.Read(nonce[:])
+	if err != nil {
+		log.Panic(err)
+	}
+
+	header := blockHeader{b.Timestamp, b.PrevBlockHash, b.HashTransactions(), b.Hash, b.Nonce, b.Height}
+	compact := cmpctblock{nodeAddress, header, binary.LittleEndian.Uint64(nonce[:]), nil, nil}
+	key := shortIDKey(b.Hash, compact.Nonce)
+
+	for i, tx := range b.Transactions {
+		if tx.IsCoinbase() {
+			compact.Prefilled = append(compact.Prefilled, prefilledTx{i, tx.Serialize()})
+			continue
+		}
+		compact.ShortIDs = append(compact.ShortIDs, shortTxID(key, tx.ID))
+	}
+
+	return compact
+}
+
+// validHeader checks the proof of work of a header before its transactions are known
+func validHeader(header blockHeader) bool {
+	var hashInt big.Int
+
+	hash := sha256.Sum256(headerData(header.PrevBlockHash, header.MerkleRoot, header.Timestamp, header.Nonce))
+	hashInt.SetBytes(hash[:])
+
+	return hashInt.Cmp(powTarget()) == -1 && bytes.Equal(hash[:], header.Hash)
+}
+
+func sendCmpctBlock(addr string, b *Block) {
+	payload := gobEncode(newCmpctBlock(b))
+	req := append(commandToBytes("cmpctblock"), payload...)
+
+	sendData(addr, req)
+}
+
+func sendGetBlockTxn(addr string, blockHash []byte, indexes []int) {
+	payload := gobEncode(getblocktxn{nodeAddress, blockHash, indexes})
+	req := append(commandToBytes("getblocktxn"), payload...)
+
+	sendData(addr, req)
+}
+
+func sendBlockTxn(addr string, blockHash []byte, transactions [][]byte) {
+	payload := gobEncode(blocktxn{nodeAddress, blockHash, transactions})
+	req := append(commandToBytes("blocktxn"), payload...)
+
+	sendData(addr, req)
+}
+
+func handleCmpctBlock(req []byte, from net.Addr, bc *Blockchain) {
+	var buf bytes.Buffer
+	var payload cmpctblock
+
+	buf.Write(req[commandLength:])
+	dec := gob.NewDecoder(&buf)
+	err := dec.Decode(&payload)
+	if err != nil {
+		misbehaving(from, scoreUndecodable, "undecodable cmpctblock message")
+		return
+	}
+
+	payload.AddrFrom = peerAddress(from, payload.AddrFrom)
+	header := payload.Header
+
+	if _, err := bc.GetBlock(header.Hash); err == nil {
+		return
+	}
+	if !validHeader(header) {
+		misbehaving(from, scoreBadPoW, "compact block %x has an invalid proof of work", header.Hash)
+		return
+	}
+
+	count := len(payload.ShortIDs) + len(payload.Prefilled)
+	transactions := make([]*Transaction, count)
+	for _, prefilled := range payload.Prefilled {
+		if prefilled.Index < 0 || prefilled.Index >= count || transactions[prefilled.Index] != nil {
+			misbehaving(from, scoreUndecodable, "compact block %x prefills index %d", header.Hash, prefilled.Index)
+			return
+		}
+		var tx Transaction
+		if err := recoverPanic(func() { tx = DeserializeTransaction(prefilled.Transaction) }); err != nil {
+			misbehaving(from, scoreUndecodable, "compact block %x has an undecodable transaction", header.Hash)
+			return
+		}
+		transactions[prefilled.Index] = &tx
+	}
+
+	// Short IDs shared by several mempool transactions are left out and requested
+	key := shortIDKey(header.Hash, payload.Nonce)
+	candidates := make(map[string]*Transaction)
+	for _, tx := range mempoolTxs() {
+		tx := tx
+		shortID := string(shortTxID(key, tx.ID))
+		if _, ok := candidates[shortID]; ok {
+			candidates[shortID] = nil
+		} else {
+			candidates[shortID] = &tx
+		}
+	}
+
+	var missing []int
+	shortIDs := payload.ShortIDs
+	for i := range transactions {
+		if transactions[i] != nil {
+			continue
+		}
+		transactions[i] = candidates[string(shortIDs[0])]
+		shortIDs = shortIDs[1:]
+		if transactions[i] == nil {
+			missing = append(missing, i)
+		}
+	}
+
+	partial := &partialBlock{header, transactions, missing}
+	if len(missing) == 0 {
+		completeCompactBlock(partial, from, payload.AddrFrom, bc)
+		return
+	}
+
+	pendingCompact.Lock()
+	if len(pendingCompact.blocks) >= maxPendingCompact {
+		for hash := range pendingCompact.blocks {
+			delete(pendingCompact.blocks, hash)
+			break
+		}
+	}
+	pendingCompact.blocks[hex.EncodeToString(header.Hash)] = partial
+	pendingCompact.Unlock()
+
+	debugf("Compact block %x misses %d of %d transactions\n", header.Hash, len(missing), count)
+	sendGetBlockTxn(payload.AddrFrom, header.Hash, missing)
+}
+
+func handleGetBlockTxn(req []byte, from net.Addr, bc *Blockchain) {
+	var buf bytes.Buffer
+	var payload getblocktxn
+
+	buf.Write(req[commandLength:])
+	dec := gob.NewDecoder(&buf)
+	err := dec.Decode(&payload)
+	if err != nil {
+		misbehaving(from, scoreUndecodable, "undecodable getblocktxn message")
+		return
+	}
+
+	payload.AddrFrom = peerAddress(from, payload.AddrFrom)
+
+	block, err := bc.GetBlock(payload.BlockHash)
+	if err != nil {
+		return
+	}
+
+	var transactions [][]byte
+	for _, index := range payload.Indexes {
+		if index < 0 || index >= len(block.Transactions) {
+			misbehaving(from, scoreUndecodable, "getblocktxn for index %d of block %x", index, block.Hash)
+			return
+		}
+		transactions = append(transactions, block.Transactions[index].Serialize())
+	}
+
+	sendBlockTxn(payload.AddrFrom, block.Hash, transactions)
+}
+
+func handleBlockTxn(req []byte, from net.Addr, bc *Blockchain) {
+	var buf bytes.Buffer
+	var payload blocktxn
+
+	buf.Write(req[commandLength:])
+	dec := gob.NewDecoder(&buf)
+	err := dec.Decode(&payload)
+	if err != nil {
+		misbehaving(from, scoreUndecodable, "undecodable blocktxn message")
+		return
+	}
+
+	payload.AddrFrom = peerAddress(from, payload.AddrFrom)
+
+	pendingCompact.Lock()
+	partial, ok := pendingCompact.blocks[hex.EncodeToString(payload.BlockHash)]
+	delete(pendingCompact.blocks, hex.EncodeToString(payload.BlockHash))
+	pendingCompact.Unlock()
+	if !ok {
+		misbehaving(from, scoreUnsolicited, "unsolicited blocktxn for block %x", payload.BlockHash)
+		return
+	}
+
+	if len(payload.Transactions) != len(partial.missing) {
+		log.Printf("Got %d of the %d missing transactions of block %x, requesting the full block\n", len(payload.Transactions), len(partial.missing), payload.BlockHash)
+		sendGetData(payload.AddrFrom, "block", payload.BlockHash)
+		return
+	}
+	for i, index := range partial.missing {
+		var tx Transaction
+		if err := recoverPanic(func() { tx = DeserializeTransaction(payload.Transactions[i]) }); err != nil {
+			misbehaving(from, scoreUndecodable, "blocktxn for block %x has an undecodable transaction", payload.BlockHash)
+			return
+		}
+		partial.transactions[index] = &tx
+	}
+
+	completeCompactBlock(partial, from, payload.AddrFrom, bc)
+}
+
+// completeCompactBlock adds a rebuilt block, or requests the full block when the
+// transactions don't match the header
+func completeCompactBlock(partial *partialBlock, from net.Addr, addrFrom string, bc *Blockchain) {
+	header := partial.header
+	block := &Block{header.Timestamp, partial.transactions, header.PrevBlockHash, header.Hash, header.Nonce, header.Height}
+
+	if !bytes.Equal(block.HashTransactions(), header.MerkleRoot) {
+		log.Printf("Rebuilding compact block %x failed, requesting the full block\n", header.Hash)
+		sendGetData(addrFrom, "block", header.Hash)
+		return
+	}
+
+	processBlock(block, from, addrFrom, bc)
+}
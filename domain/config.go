@@ -0,0 +1,374 @@
+package domain
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const configFile = "gochain.conf"
+
+// Every setting can be given as a flag before the command, as a GOCHAIN_ environment
+// variable or in the config file, in that order of precedence
+const envPrefix = "GOCHAIN_"
+
+const (
+	logDebug = iota
+	logInfo
+	logWarn
+)
+
+var logLevels = map[string]int{"debug": logDebug, "info": logInfo, "warn": logWarn}
+
+// Config is the node configuration, empty addresses are derived from NODE_ID
+type Config struct {
+	Network      string
+	DataDir      string   // Holds a data directory per network
+	Listen       string   // Address the node listens on
+	ExternalIP   string   // Address announced to peers
+	Seeds        []string // Peers contacted on startup
+	Miner        string   // Address block rewards are paid to when startnode gets no -miner
+	MineTxs      int      // Transactions the miner waits for, negative for the network default
+	MineInterval int      // Seconds after the last block the miner mines regardless, 0 for never
+	Stratum      string   // Address of the Stratum server for pool workers, none when empty
+	ShareBits    int      // Target bits of a Stratum share, negative for half the block's
+	RPCListen    string   // Address of the control interface
+	RPCPassword  string   // Authenticates clients of the control interface instead of the cookie file
+	RPC          bool
+	Encrypt      bool // Encrypt connections to peers that announce an identity key
+	LogLevel     int
+}
+
+var settings = []struct {
+	name  string
+	usage string
+}{
+	{"network", "Network: main, test or regtest"},
+	{"datadir", "Directory for blockchains, wallets and the config file"},
+	{"conf", "Config file, " + configFile + " in the data directory by default"},
+	{"listen", "Address to listen on for peers, localhost:NODE_ID by default"},
+	{"externalip", "IP or address announced to peers, the listen address by default"},
+	{"seeds", "Comma separated peers to connect to on startup"},
+	{"miner", "Address to mine to when startnode gets no -miner"},
+	{"minetxs", "Transactions to wait for before mining a block, 0 mines continuously"},
+	{"mineinterval", "Seconds after the last block to mine one with any transactions, 0 for never"},
+	{"stratum", "Address to serve Stratum mining pool workers on, the node mines through them"},
+	{"sharebits", "Target bits of a Stratum share, half the block's by default"},
+	{"rpclisten", "Address of the control interface, localhost:NODE_ID+10000 by default"},
+	{"rpcpassword", "Password of the control interface, a cookie file in the data directory by default"},
+	{"rpc", "Serve the control interface, true or false"},
+	{"encrypt", "Encrypt connections to peers that support it, true or false"},
+	{"loglevel", "Log level: debug, info or warn"},
+}
+
+var config = Config{Network: MainNetParams.Name, MineTxs: -1, ShareBits: -1, RPC: true, Encrypt: true, LogLevel: logInfo}
+
+// LoadConfig reads the global flags in front of the command, the environment and the
+// config file, selects the network and returns the command with its arguments
+func LoadConfig(args []string) ([]string, error) {
+	global := flag.NewFlagSet("gochain", flag.ExitOnError)
+	for _, setting := range settings {
+		global.String(setting.name, "", setting.usage)
+	}
+	err := global.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	flags := make(map[string]string)
+	global.Visit(func(f *flag.Flag) {
+		flags[f.Name] = f.Value.String()
+	})
+	env := make(map[string]string)
+	for _, setting := range settings {
+		if value, ok := os.LookupEnv(envPrefix + strings.ToUpper(setting.name)); ok {
+			env[setting.name] = value
+		}
+	}
+	lookup := func(name string) (string, bool) {
+		if value, ok := flags[name]; ok {
+			return value, true
+		}
+		value, ok := env[name]
+		return value, ok
+	}
+
+	dataDir, _ := lookup("datadir")
+	confPath, explicit := lookup("conf")
+	if !explicit {
+		confPath = filepath.Join(dataDir, configFile)
+	}
+	sections, err := readConfigFile(confPath)
+	if err != nil && (explicit || !errors.Is(err, os.ErrNotExist)) {
+		return nil, err
+	}
+
+	cfg := Config{Network: MainNetParams.Name, DataDir: dataDir, MineTxs: -1, ShareBits: -1, RPC: true, Encrypt: true, LogLevel: logInfo}
+	if network, ok := lookup("network"); ok {
+		cfg.Network = network
+	} else if values := sections[""]["network"]; len(values) > 0 {
+		cfg.Network = values[len(values)-1]
+	}
+
+	for _, section := range []string{"", cfg.Network} {
+		for key, values := range sections[section] {
+			if key == "network" {
+				continue
+			}
+			if key == "datadir" || key == "conf" {
+				return nil, fmt.Errorf("%s: %s can't be set in the config file", confPath, key)
+			}
+			if err := cfg.set(key, strings.Join(values, ",")); err != nil {
+				return nil, fmt.Errorf("%s: %s", confPath, err)
+			}
+		}
+	}
+	for _, source := range []map[string]string{env, flags} {
+		for key, value := range source {
+			if err := cfg.set(key, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	err = cfg.checkRPCListen()
+	if err != nil {
+		return nil, err
+	}
+
+	err = SelectNetwork(cfg.Network)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.Seeds) > 0 {
+		setKnownNodes(cfg.Seeds)
+	}
+	config = cfg
+
+	return global.Args(), nil
+}
+
+func (c *Config) set(key, value string) error {
+	value = strings.TrimSpace(value)
+
+	switch key {
+	case "network", "datadir", "conf":
+		// Read before everything else
+	case "listen":
+		listen, err := normalizeAddress(value)
+		if err != nil {
+			return fmt.Errorf("listen %s", err)
+		}
+		c.Listen = listen
+	case "externalip":
+		// The port may be left out, the listen port is used then
+		if _, _, err := net.SplitHostPort(value); err != nil {
+			value = strings.Trim(value, "[]")
+			if net.ParseIP(value) == nil {
+				return fmt.Errorf("externalip %s is neither an IP nor a host:port address", value)
+			}
+		} else if value, err = normalizeAddress(value); err != nil {
+			return fmt.Errorf("externalip %s", err)
+		}
+		c.ExternalIP = value
+	case "seeds":
+		c.Seeds = nil
+		for _, seed := range strings.Split(value, ",") {
+			if seed = strings.TrimSpace(seed); seed != "" {
+				seed, err := normalizeAddress(seed)
+				if err != nil {
+					return fmt.Errorf("seed %s", err)
+				}
+				c.Seeds = append(c.Seeds, seed)
+			}
+		}
+	case "miner":
+		c.Miner = value
+	case "minetxs":
+		count, err := strconv.Atoi(value)
+		if err != nil || count < 0 {
+			return fmt.Errorf("minetxs must be a number of transactions, got %s", value)
+		}
+		c.MineTxs = count
+	case "mineinterval":
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 {
+			return fmt.Errorf("mineinterval must be a number of seconds, got %s", value)
+		}
+		c.MineInterval = seconds
+	case "stratum":
+		if value == "" {
+			c.Stratum = ""
+			break
+		}
+		stratum, err := normalizeAddress(value)
+		if err != nil {
+			return fmt.Errorf("stratum %s", err)
+		}
+		c.Stratum = stratum
+	case "sharebits":
+		bits, err := strconv.Atoi(value)
+		if err != nil || bits < 0 {
+			return fmt.Errorf("sharebits must be a number of bits, got %s", value)
+		}
+		c.ShareBits = bits
+	case "rpclisten":
+		rpcListen, err := normalizeAddress(value)
+		if err != nil {
+			return fmt.Errorf("rpclisten %s", err)
+		}
+		c.RPCListen = rpcListen
+	case "rpcpassword":
+		c.RPCPassword = value
+	case "rpc":
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("rpc must be true or false, got %s", value)
+		}
+		c.RPC = enabled
+	case "encrypt":
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("encrypt must be true or false, got %s", value)
+		}
+		c.Encrypt = enabled
+	case "loglevel":
+		level, ok := logLevels[value]
+		if !ok {
+			return fmt.Errorf("unknown log level %s, expected debug, info or warn", value)
+		}
+		c.LogLevel = level
+	default:
+		return fmt.Errorf("unknown setting %s", key)
+	}
+
+	return nil
+}
+
+// checkRPCListen only lets the control interface listen beyond loopback with rpcpassword,
+// the cookie file reaches local clients only
+func (c *Config) checkRPCListen() error {
+	if c.RPCListen == "" || c.RPCPassword != "" {
+		return nil
+	}
+
+	host, _, _ := net.SplitHostPort(c.RPCListen)
+	if ip := net.ParseIP(host); host == "localhost" || ip != nil && ip.IsLoopback() {
+		return nil
+	}
+
+	return fmt.Errorf("rpclisten %s isn't a loopback address, set rpcpassword to serve the control interface on it", c.RPCListen)
+}
+
+// readConfigFile parses "key = value" lines, grouped by [network] sections. Settings
+// before the first section apply to every network, the section of the selected network
+// overrides them.
+func readConfigFile(path string) (map[string]map[string][]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func(file *os.File) {
+		err := file.Close()
+		if err != nil {
+			log.Panic(err)
+		}
+	}(file)
+
+	sections := map[string]map[string][]string{"": {}}
+	section := ""
+
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			if _, ok := networks[section]; !ok {
+				return nil, fmt.Errorf("%s:%d: unknown network section [%s]", path, lineNo, section)
+			}
+			if sections[section] == nil {
+				sections[section] = make(map[string][]string)
+			}
+			continue
+		}
+
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			return nil, fmt.Errorf("%s:%d: expected key = value", path, lineNo)
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+		sections[section][key] = append(sections[section][key], value)
+	}
+
+	return sections, scanner.Err()
+}
+
+func (c *Config) listenAddress(nodeID string) string {
+	if c.Listen != "" {
+		return c.Listen
+	}
+
+	return net.JoinHostPort("localhost", nodeID)
+}
+
+// externalAddress is the address announced to peers. Without -externalip it is the
+// listen address, or localhost when listening on every interface, until a peer
+// reports the address it sees this node at.
+func (c *Config) externalAddress(nodeID string) string {
+	listen := c.listenAddress(nodeID)
+	port := addressPort(listen)
+
+	if c.ExternalIP != "" {
+		if _, _, err := net.SplitHostPort(c.ExternalIP); err == nil {
+			return c.ExternalIP
+		}
+		return net.JoinHostPort(c.ExternalIP, port)
+	}
+
+	host, _, _ := net.SplitHostPort(listen)
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		return net.JoinHostPort("localhost", port)
+	}
+
+	return listen
+}
+
+// dataFile returns the path of a file in the data directory of the network,
+// creating the directory when needed
+func (c *Config) dataFile(name string) string {
+	dir := filepath.Join(c.DataDir, chainParams.DataDir)
+	if dir == "." {
+		return name
+	}
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return filepath.Join(dir, name)
+}
+
+func debugf(format string, v ...interface{}) {
+	if config.LogLevel <= logDebug {
+		log.Printf(format, v...)
+	}
+}
+
+func infof(format string, v ...interface{}) {
+	if config.LogLevel <= logInfo {
+		log.Printf(format, v...)
+	}
+}
@@ -0,0 +1,30 @@
+package domain
+
+import (
+	"testing"
+)
+
+func TestCheckRPCListen(t *testing.T) {
+	tests := []struct {
+		listen   string
+		password string
+		ok       bool
+	}{
+		{"", "", true},
+		{"localhost:13000", "", true},
+		{"127.0.0.1:13000", "", true},
+		{"[::1]:13000", "", true},
+		{"0.0.0.0:13000", "", false},
+		{":13000", "", false},
+		{"192.0.2.1:13000", "", false},
+		{"example.com:13000", "", false},
+		{"0.0.0.0:13000", "secret", true},
+	}
+
+	for _, test := range tests {
+		c := Config{RPCListen: test.listen, RPCPassword: test.password}
+		if err := c.checkRPCListen(); (err == nil) != test.ok {
+			t.Errorf("rpclisten %q with password %q: got %v, expected ok %t", test.listen, test.password, err, test.ok)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package domain
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+)
+
+// genesisBlock builds the hardcoded first block of the network. Every node constructs
+// the same block, its reward is locked with OP_RETURN and can't be spent.
+func genesisBlock() *Block {
+	coinbase := Transaction{
+		nil,
+		[]TXInput{{[]byte{}, -1, []byte(chainParams.GenesisCoinbaseData), maxTxInSequence}},
+		[]TXOutput{{chainParams.Subsidy, NewScriptBuilder().AddOp(opReturn).Script()}},
+		0,
+	}
+	coinbase.ID = coinbase.Hash()
+
+	block := &Block{chainParams.GenesisTimestamp, []*Transaction{&coinbase}, []byte{}, nil, chainParams.GenesisNonce, 0}
+	hash := sha256.Sum256(NewProofOfWork(block).prepareData(block.Nonce))
+	block.Hash = hash[:]
+
+	if hex.EncodeToString(block.Hash) != chainParams.GenesisHash {
+		log.Panicf("ERROR: Genesis block of the %s network hashes to %x instead of %s", chainParams.Name, block.Hash, chainParams.GenesisHash)
+	}
+
+	return block
+}
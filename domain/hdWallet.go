@@ -0,0 +1,267 @@
+package domain
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/tyler-smith/go-bip39"
+)
+
+// HD wallets derive keys like BIP-32 from a BIP-39 seed, following the default wallet
+// layout m/0'/branch/index with receiving addresses on branch 0 and change on branch 1
+const (
+	hdHardened       = 0x80000000
+	hdAccount        = hdHardened + 0
+	hdReceiveBranch  = 0
+	hdChangeBranch   = 1
+	hdMnemonicBits   = 128
+	defaultGapLimit  = 20
+	hdMasterHMACSeed = "Bitcoin seed"
+)
+
+var errNoHDSeed = errors.New("wallet has no HD seed, create one with createwallet -mnemonic")
+
+// HDChain holds the public state of an HD wallet, the seed itself is sealed with the private keys
+type HDChain struct {
+	Scheme    byte
+	NextIndex [2]uint32 // Next unused index of the receiving and change branches
+}
+
+type extendedKey struct {
+	key       []byte
+	chainCode []byte
+}
+
+func NewMnemonic() (string, error) {
+	entropy, err := bip39.NewEntropy(hdMnemonicBits)
+	if err != nil {
+		return "", err
+	}
+
+	return bip39.NewMnemonic(entropy)
+}
+
+func newMasterKey(seed []byte) (*extendedKey, error) {
+	mac := hmac.New(sha512.New, []byte(hdMasterHMACSeed))
+	mac.Write(seed)
+	sum := mac.Sum(nil)
+
+	if _, err := parseSecp256k1PrivateKey(sum[:32]); err != nil {
+		return nil, errors.New("seed derives an invalid master key")
+	}
+
+	return &extendedKey{sum[:32], sum[32:]}, nil
+}
+
+// child derives the private child key at index, indexes from hdHardened on are hardened
+func (k *extendedKey) child(index uint32) (*extendedKey, error) {
+	parent, err := parseSecp256k1PrivateKey(k.key)
+	if err != nil {
+		return nil, err
+	}
+
+	var data []byte
+	if index >= hdHardened {
+		data = append([]byte{0x00}, k.key...)
+	} else {
+		data = parent.PubKey().SerializeCompressed()
+	}
+	data = binary.BigEndian.AppendUint32(data, index)
+
+	mac := hmac.New(sha512.New, k.chainCode)
+	mac.Write(data)
+	sum := mac.Sum(nil)
+
+	var tweak btcec.ModNScalar
+	if overflow := tweak.SetByteSlice(sum[:32]); overflow {
+		return nil, fmt.Errorf("child key %d is invalid", index)
+	}
+	tweak.Add(&parent.Key)
+	if tweak.IsZero() {
+		return nil, fmt.Errorf("child key %d is invalid", index)
+	}
+
+	key := tweak.Bytes()
+
+	return &extendedKey{key[:], sum[32:]}, nil
+}
+
+func (k *extendedKey) derivePath(path []uint32) (*extendedKey, error) {
+	var err error
+	for _, index := range path {
+		k, err = k.child(index)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return k, nil
+}
+
+func formatHDPath(path []uint32) string {
+	parts := []string{"m"}
+	for _, index := range path {
+		if index >= hdHardened {
+			parts = append(parts, fmt.Sprintf("%d'", index-hdHardened))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d", index))
+		}
+	}
+
+	return strings.Join(parts, "/")
+}
+
+func (ws *Wallets) HasSeed() bool {
+	return ws.HD != nil
+}
+
+// SetMnemonic turns the wallet into an HD wallet whose keys are derived from mnemonic
+func (ws *Wallets) SetMnemonic(mnemonic string, scheme SignatureScheme) error {
+	if ws.HasSeed() {
+		return errors.New("wallet already has an HD seed")
+	}
+	if scheme.ID() != schemeSecp256k1 && scheme.ID() != schemeSchnorr {
+		return fmt.Errorf("HD wallets need a secp256k1 based scheme, not %s", scheme.Name())
+	}
+
+	mnemonic = strings.Join(strings.Fields(mnemonic), " ")
+	seed, err := bip39.NewSeedWithErrorChecking(mnemonic, "")
+	if err != nil {
+		return err
+	}
+	if _, err := newMasterKey(seed); err != nil {
+		return err
+	}
+
+	ws.HD = &HDChain{Scheme: scheme.ID()}
+	ws.seed, ws.mnemonic = seed, mnemonic
+
+	return nil
+}
+
+// deriveWallet adds the wallet at index of branch without moving the branch's next index
+func (ws *Wallets) deriveWallet(branch, index uint32) (string, error) {
+	if !ws.HasSeed() {
+		return "", errNoHDSeed
+	}
+	if ws.seed == nil {
+		return "", errWalletLocked
+	}
+
+	master, err := newMasterKey(ws.seed)
+	if err != nil {
+		return "", err
+	}
+	path := []uint32{hdAccount, branch, index}
+	key, err := master.derivePath(path)
+	if err != nil {
+		return "", err
+	}
+
+	scheme, err := GetSignatureScheme(ws.HD.Scheme)
+	if err != nil {
+		return "", err
+	}
+	public, err := scheme.PublicKey(key.key)
+	if err != nil {
+		return "", err
+	}
+
+	wallet := &Wallet{scheme.ID(), key.key, public, path}
+	address := fmt.Sprintf("%s", wallet.GetAddress())
+	ws.Wallets[address] = wallet
+
+	return address, nil
+}
+
+func (ws *Wallets) nextHDAddress(branch uint32) (string, error) {
+	if !ws.HasSeed() {
+		return "", errNoHDSeed
+	}
+
+	address, err := ws.deriveWallet(branch, ws.HD.NextIndex[branch])
+	if err != nil {
+		return "", err
+	}
+	ws.HD.NextIndex[branch]++
+
+	return address, nil
+}
+
+func (ws *Wallets) NewReceiveAddress() (string, error) {
+	return ws.nextHDAddress(hdReceiveBranch)
+}
+
+func (ws *Wallets) NewChangeAddress() (string, error) {
+	return ws.nextHDAddress(hdChangeBranch)
+}
+
+// Rescan derives addresses of both branches until gapLimit consecutive ones never
+// appeared in an output on the chain, returning how many used addresses were found
+func (ws *Wallets) Rescan(bc *Blockchain, gapLimit int) (int, error) {
+	if !ws.HasSeed() {
+		return 0, errNoHDSeed
+	}
+
+	used := make(map[string]bool)
+	bci := bc.Iterator()
+	for {
+		block := bci.Next()
+		for _, tx := range block.Transactions {
+			for _, out := range tx.Vout {
+				if pubKeyHash := ExtractPubKeyHash(out.ScriptPubKey); pubKeyHash != nil {
+					used[string(pubKeyHash)] = true
+				}
+			}
+		}
+
+		if len(block.PrevBlockHash) == 0 {
+			break
+		}
+	}
+
+	existing := make(map[string]bool)
+	for address := range ws.Wallets {
+		existing[address] = true
+	}
+
+	found := 0
+	for _, branch := range []uint32{hdReceiveBranch, hdChangeBranch} {
+		var derived []string
+		unused := 0
+		for index := uint32(0); unused < gapLimit; index++ {
+			address, err := ws.deriveWallet(branch, index)
+			if err != nil {
+				return found, err
+			}
+			derived = append(derived, address)
+			_, known := existing[address]
+
+			if used[string(ExtractPubKeyHash(LockingScript(address)))] {
+				found++
+				unused = 0
+			} else {
+				unused++
+				if !known {
+					continue
+				}
+			}
+
+			// Addresses already in the wallet are kept even when they were never paid
+			if index >= ws.HD.NextIndex[branch] {
+				ws.HD.NextIndex[branch] = index + 1
+			}
+		}
+
+		for i := int(ws.HD.NextIndex[branch]); i < len(derived); i++ {
+			delete(ws.Wallets, derived[i])
+		}
+	}
+
+	return found, nil
+}
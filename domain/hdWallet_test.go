@@ -0,0 +1,99 @@
+package domain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+
+	"github.com/aleksannder/gochain/util"
+)
+
+// parseXprv returns the child number, chain code and private key of a serialized BIP-32 private key
+func parseXprv(t *testing.T, xprv string) (uint32, []byte, []byte) {
+	t.Helper()
+	payload, err := util.Base58Decode([]byte(xprv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payload) != 82 || !bytes.Equal(checksum(payload[:78]), payload[78:]) || payload[45] != 0 {
+		t.Fatalf("%s isn't a valid extended private key", xprv)
+	}
+
+	return binary.BigEndian.Uint32(payload[9:13]), payload[13:45], payload[46:78]
+}
+
+// bip32Step is the child index taken from the previous key and the expected extended key
+type bip32Step struct {
+	index uint32
+	xprv  string
+}
+
+func TestExtendedKeyBIP32Vectors(t *testing.T) {
+	const h = hdHardened
+
+	tests := []struct {
+		seed  string
+		chain []bip32Step
+	}{
+		{"000102030405060708090a0b0c0d0e0f", []bip32Step{
+			{0, "xprv9s21ZrQH143K3QTDL4LXw2F7HEK3wJUD2nW2nRk4stbPy6cq3jPPqjiChkVvvNKmPGJxWUtg6LnF5kejMRNNU3TGtRBeJgk33yuGBxrMPHi"},
+			{h + 0, "xprv9uHRZZhk6KAJC1avXpDAp4MDc3sQKNxDiPvvkX8Br5ngLNv1TxvUxt4cV1rGL5hj6KCesnDYUhd7oWgT11eZG7XnxHrnYeSvkzY7d2bhkJ7"},
+			{1, "xprv9wTYmMFdV23N2TdNG573QoEsfRrWKQgWeibmLntzniatZvR9BmLnvSxqu53Kw1UmYPxLgboyZQaXwTCg8MSY3H2EU4pWcQDnRnrVA1xe8fs"},
+			{h + 2, "xprv9z4pot5VBttmtdRTWfWQmoH1taj2axGVzFqSb8C9xaxKymcFzXBDptWmT7FwuEzG3ryjH4ktypQSAewRiNMjANTtpgP4mLTj34bhnZX7UiM"},
+			{2, "xprvA2JDeKCSNNZky6uBCviVfJSKyQ1mDYahRjijr5idH2WwLsEd4Hsb2Tyh8RfQMuPh7f7RtyzTtdrbdqqsunu5Mm3wDvUAKRHSC34sJ7in334"},
+			{1000000000, "xprvA41z7zogVVwxVSgdKUHDy1SKmdb533PjDz7J6N6mV6uS3ze1ai8FHa8kmHScGpWmj4WggLyQjgPie1rFSruoUihUZREPSL39UNdE3BBDu76"},
+		}},
+		{"fffcf9f6f3f0edeae7e4e1dedbd8d5d2cfccc9c6c3c0bdbab7b4b1aeaba8a5a29f9c999693908d8a8784817e7b7875726f6c696663605d5a5754514e4b484542", []bip32Step{
+			{0, "xprv9s21ZrQH143K31xYSDQpPDxsXRTUcvj2iNHm5NUtrGiGG5e2DtALGdso3pGz6ssrdK4PFmM8NSpSBHNqPqm55Qn3LqFtT2emdEXVYsCzC2U"},
+			{0, "xprv9vHkqa6EV4sPZHYqZznhT2NPtPCjKuDKGY38FBWLvgaDx45zo9WQRUT3dKYnjwih2yJD9mkrocEZXo1ex8G81dwSM1fwqWpWkeS3v86pgKt"},
+			{h + 2147483647, "xprv9wSp6B7kry3Vj9m1zSnLvN3xH8RdsPP1Mh7fAaR7aRLcQMKTR2vidYEeEg2mUCTAwCd6vnxVrcjfy2kRgVsFawNzmjuHc2YmYRmagcEPdU9"},
+			{1, "xprv9zFnWC6h2cLgpmSA46vutJzBcfJ8yaJGg8cX1e5StJh45BBciYTRXSd25UEPVuesF9yog62tGAQtHjXajPPdbRCHuWS6T8XA2ECKADdw4Ef"},
+			{h + 2147483646, "xprvA1RpRA33e1JQ7ifknakTFpgNXPmW2YvmhqLQYMmrj4xJXXWYpDPS3xz7iAxn8L39njGVyuoseXzU6rcxFLJ8HFsTjSyQbLYnMpCqE2VbFWc"},
+			{2, "xprvA2nrNbFZABcdryreWet9Ea4LvTJcGsqrMzxHx98MMrotbir7yrKCEXw7nadnHM8Dq38EGfSh6dqA9QWTyefMLEcBYJUuekgW4BYPJcr9E7j"},
+		}},
+	}
+
+	for _, test := range tests {
+		seed, err := hex.DecodeString(test.seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := newMasterKey(seed)
+		if err != nil {
+			t.Fatalf("seed %s: %s", test.seed, err)
+		}
+
+		var path []uint32
+		for i, step := range test.chain {
+			if i > 0 {
+				path = append(path, step.index)
+				if key, err = key.child(step.index); err != nil {
+					t.Fatalf("seed %s, %s: %s", test.seed, formatHDPath(path), err)
+				}
+			}
+
+			index, chainCode, privKey := parseXprv(t, step.xprv)
+			if index != step.index {
+				t.Fatalf("seed %s, %s: vector has child number %d, expected %d", test.seed, formatHDPath(path), index, step.index)
+			}
+			if !bytes.Equal(key.key, privKey) {
+				t.Errorf("seed %s, %s: key %x, expected %x", test.seed, formatHDPath(path), key.key, privKey)
+			}
+			if !bytes.Equal(key.chainCode, chainCode) {
+				t.Errorf("seed %s, %s: chain code %x, expected %x", test.seed, formatHDPath(path), key.chainCode, chainCode)
+			}
+		}
+
+		derived, err := newMasterKey(seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if derived, err = derived.derivePath(path); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(derived.key, key.key) || !bytes.Equal(derived.chainCode, key.chainCode) {
+			t.Errorf("seed %s: derivePath(%s) differs from deriving one child at a time", test.seed, formatHDPath(path))
+		}
+	}
+}
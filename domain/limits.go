@@ -0,0 +1,130 @@
+package domain
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// maxPayloadSizes caps the payload of every command, a message is the magic bytes,
+// the command and the payload
+var maxPayloadSizes = map[string]int{
+	"addr":        64 << 10,
+	"block":       8 << 20,
+	"blocktxn":    8 << 20,
+	"cmpctblock":  2 << 20,
+	"getblocks":   1 << 10,
+	"getblocktxn": 256 << 10,
+	"getdata":     1 << 10,
+	"inv":         maxInvItems*40 + 1<<10,
+	"notfound":    1 << 10,
+	"tx":          1 << 20,
+	"ver":         1 << 10,
+}
+
+// Connections carry a single message and are dropped when it isn't read or written in time
+const readTimeout = 30 * time.Second
+const writeTimeout = 30 * time.Second
+const dialTimeout = 10 * time.Second
+
+// maxInbound limits the connections served at once, maxInboundPerIP those of one IP
+const maxInbound = 125
+const maxInboundPerIP = 8
+
+// Every IP may send messageRates[command] messages a second, in bursts of up to
+// ten seconds worth
+var messageRates = map[string]float64{
+	"tx":  20,
+	"inv": 20,
+}
+
+const rateBurst = 10
+
+// Buckets of IPs that went quiet are dropped once there are maxRateBuckets
+const maxRateBuckets = 10000
+
+var inbound = struct {
+	sync.Mutex
+	total int
+	perIP map[string]int
+}{perIP: make(map[string]int)}
+
+// acquireInbound counts a new connection, false means it's over one of the limits
+func acquireInbound(addr net.Addr) bool {
+	ip := remoteIP(addr).String()
+
+	inbound.Lock()
+	defer inbound.Unlock()
+
+	if inbound.total >= maxInbound || inbound.perIP[ip] >= maxInboundPerIP {
+		return false
+	}
+	inbound.total++
+	inbound.perIP[ip]++
+
+	return true
+}
+
+func releaseInbound(addr net.Addr) {
+	ip := remoteIP(addr).String()
+
+	inbound.Lock()
+	defer inbound.Unlock()
+
+	inbound.total--
+	inbound.perIP[ip]--
+	if inbound.perIP[ip] == 0 {
+		delete(inbound.perIP, ip)
+	}
+}
+
+// tokenBucket holds up to rateBurst seconds of messages and refills at the rate
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+var rateLimits = struct {
+	sync.Mutex
+	buckets map[string]*tokenBucket
+}{buckets: make(map[string]*tokenBucket)}
+
+// allowMessage reports whether the IP of addr is still within the rate of command
+func allowMessage(addr net.Addr, command string) bool {
+	rate, ok := messageRates[command]
+	if !ok {
+		return true
+	}
+	key := remoteIP(addr).String() + " " + command
+	now := time.Now()
+
+	rateLimits.Lock()
+	defer rateLimits.Unlock()
+
+	if len(rateLimits.buckets) >= maxRateBuckets {
+		for key, bucket := range rateLimits.buckets {
+			if now.Sub(bucket.updated) > rateBurst*time.Second {
+				delete(rateLimits.buckets, key)
+			}
+		}
+	}
+
+	bucket, ok := rateLimits.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{rate * rateBurst, now}
+		rateLimits.buckets[key] = bucket
+	}
+
+	bucket.tokens += now.Sub(bucket.updated).Seconds() * rate
+	if bucket.tokens > rate*rateBurst {
+		bucket.tokens = rate * rateBurst
+	}
+	bucket.updated = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+
+	return true
+}
@@ -0,0 +1,131 @@
+package domain
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+)
+
+// Lock times below this value are block heights, above it unix timestamps
+const lockTimeThreshold = 500000000
+
+// Relative lock times are encoded in the input sequence like BIP-68
+const (
+	maxTxInSequence             = 0xffffffff
+	sequenceLockTimeDisabled    = 1 << 31
+	sequenceLockTimeIsSeconds   = 1 << 22
+	sequenceLockTimeMask        = 0x0000ffff
+	sequenceLockTimeGranularity = 9 // Time based locks count in units of 512 seconds
+)
+
+const medianTimeBlocks = 11
+
+// IsFinal reports whether tx may be included in a block at the given height whose
+// predecessor has the given median time past
+func (tx *Transaction) IsFinal(height int, medianTime int64) bool {
+	if tx.LockTime == 0 {
+		return true
+	}
+
+	limit := int64(height)
+	if tx.LockTime >= lockTimeThreshold {
+		limit = medianTime
+	}
+	if tx.LockTime < limit {
+		return true
+	}
+
+	for _, vin := range tx.Vin {
+		if vin.Sequence != maxTxInSequence {
+			return false
+		}
+	}
+
+	return true
+}
+
+// GetMedianTimePast returns the median timestamp of the last blocks up to and including blockHash
+func (bc *Blockchain) GetMedianTimePast(blockHash []byte) int64 {
+	if len(blockHash) == 0 {
+		return 0
+	}
+
+	var timestamps []int64
+	bci := &BlockchainIterator{blockHash, bc.Db}
+
+	for len(timestamps) < medianTimeBlocks {
+		block := bci.Next()
+		timestamps = append(timestamps, block.Timestamp)
+
+		if len(block.PrevBlockHash) == 0 {
+			break
+		}
+	}
+
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+
+	return timestamps[len(timestamps)/2]
+}
+
+// CheckTransactionLocks enforces the absolute and relative lock times of tx for a block
+// at height built on top of prevBlockHash. Outputs created in the same block are
+// treated as confirmed at height.
+func (u UTXOSet) CheckTransactionLocks(tx *Transaction, height int, prevBlockHash []byte) error {
+	medianTime := u.Blockchain.GetMedianTimePast(prevBlockHash)
+
+	if !tx.IsFinal(height, medianTime) {
+		return fmt.Errorf("transaction %x is not final, lock time %d", tx.ID, tx.LockTime)
+	}
+	if tx.IsCoinbase() {
+		return nil
+	}
+
+	for inID, vin := range tx.Vin {
+		if vin.Sequence&sequenceLockTimeDisabled != 0 {
+			continue
+		}
+
+		coinHeight, coinTime := height, medianTime
+		if outs, ok := u.FindOutputs(vin.Txid); ok {
+			coinHeight, coinTime = outs.Height, outs.MedianTime
+		}
+
+		value := int64(vin.Sequence & sequenceLockTimeMask)
+		if vin.Sequence&sequenceLockTimeIsSeconds != 0 {
+			minTime := coinTime + value<<sequenceLockTimeGranularity - 1
+			if minTime >= medianTime {
+				return fmt.Errorf("input %d of transaction %x is time locked until %d", inID, tx.ID, minTime+1)
+			}
+		} else {
+			minHeight := int64(coinHeight) + value - 1
+			if minHeight >= int64(height) {
+				return fmt.Errorf("input %d of transaction %x is locked until height %d", inID, tx.ID, minHeight+1)
+			}
+		}
+	}
+
+	return nil
+}
+
+// CheckBlockLocks verifies that every transaction of block is final at the block's height
+func (u UTXOSet) CheckBlockLocks(block *Block) error {
+	for _, tx := range block.Transactions {
+		err := u.CheckTransactionLocks(tx, block.Height, block.PrevBlockHash)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkMempoolLocks rejects transactions that couldn't be mined in the next block
+func checkMempoolLocks(tx *Transaction, bc *Blockchain) error {
+	tip := bc.GetLastBlock()
+	set := UTXOSet{bc}
+	if err := set.CheckTransactionLocks(tx, tip.Height+1, tip.Hash); err != nil {
+		return fmt.Errorf("rejecting %s: %w", hex.EncodeToString(tx.ID), err)
+	}
+
+	return nil
+}
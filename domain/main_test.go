@@ -0,0 +1,49 @@
+package domain
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"testing"
+)
+
+// testChain is a regtest chain in a temporary data directory, shared by the tests
+var testChain *Blockchain
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "gochain")
+	if err != nil {
+		log.Panic(err)
+	}
+
+	config.DataDir = dir
+	config.LogLevel = logWarn
+	log.SetOutput(io.Discard)
+	if err := SelectNetwork(RegTestParams.Name); err != nil {
+		log.Panic(err)
+	}
+	nodeAddress = "localhost:3000"
+	banList, err = LoadBanList("3000")
+	if err != nil {
+		log.Panic(err)
+	}
+	identityKey, err = ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		log.Panic(err)
+	}
+	// Messages the handlers send go nowhere
+	dialNode = func(address string) (net.Conn, error) {
+		return nil, errors.New("no network in tests")
+	}
+	testChain = NewBlockchain("3000")
+
+	code := m.Run()
+
+	testChain.Db.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
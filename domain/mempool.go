@@ -0,0 +1,51 @@
+package domain
+
+import (
+	"encoding/hex"
+	"sync"
+)
+
+// mempool holds the valid transactions that aren't in a block yet, it's shared by
+// the connection handlers and the miner
+var mempool = struct {
+	sync.Mutex
+	txs map[string]Transaction
+}{txs: make(map[string]Transaction)}
+
+func mempoolTx(id []byte) (Transaction, bool) {
+	mempool.Lock()
+	defer mempool.Unlock()
+
+	tx, ok := mempool.txs[hex.EncodeToString(id)]
+	return tx, ok
+}
+
+func mempoolTxs() []Transaction {
+	mempool.Lock()
+	defer mempool.Unlock()
+
+	var txs []Transaction
+	for _, tx := range mempool.txs {
+		txs = append(txs, tx)
+	}
+
+	return txs
+}
+
+func addToMempool(tx Transaction) {
+	mempool.Lock()
+	mempool.txs[hex.EncodeToString(tx.ID)] = tx
+	mempool.Unlock()
+
+	notifyMiner()
+}
+
+func removeFromMempool(txs []*Transaction) {
+	mempool.Lock()
+	for _, tx := range txs {
+		delete(mempool.txs, hex.EncodeToString(tx.ID))
+	}
+	mempool.Unlock()
+
+	notifyMiner()
+}
@@ -0,0 +1,238 @@
+package domain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxBlockTxBytes caps the serialized transactions of a mined block
+const maxBlockTxBytes = 1 << 20
+
+// The miner looks for a changed tip or mempool every minerCheckNonces nonces and
+// starts over on a new template when there is one
+const minerCheckNonces = 1 << 14
+
+// chainLock serializes adding blocks, from peers, the miner and submitblock
+var chainLock sync.Mutex
+
+// minerChanged wakes the miner when the tip or the mempool changes
+var minerChanged = make(chan struct{}, 1)
+
+// BlockTemplate is the block a miner works on, only the nonce is left to find
+type BlockTemplate struct {
+	Height        int
+	PrevBlockHash []byte
+	Timestamp     int64
+	TargetBits    int
+	MerkleRoot    []byte
+	Transactions  []*Transaction // The coinbase first
+	Fees          int            // Paid to the coinbase on top of the subsidy
+}
+
+type templateTx struct {
+	tx   *Transaction
+	fee  int
+	size int
+}
+
+func notifyMiner() {
+	select {
+	case minerChanged <- struct{}{}:
+	default:
+	}
+}
+
+// transactionFee returns what tx leaves to the miner, its inputs less its outputs.
+// Outputs of negative value or worth more than the inputs would create coins.
+func transactionFee(tx *Transaction, prevOuts []UTXO) (int, error) {
+	in := 0
+	for _, prevOut := range prevOuts {
+		in += prevOut.Output.Value
+	}
+
+	out := 0
+	for _, vout := range tx.Vout {
+		if vout.Value < 0 {
+			return 0, fmt.Errorf("transaction %x has an output of negative value", tx.ID)
+		}
+		if vout.Value > in-out {
+			return 0, fmt.Errorf("transaction %x pays out more than its inputs hold", tx.ID)
+		}
+		out += vout.Value
+	}
+
+	return in - out, nil
+}
+
+// NewBlockTemplate builds a block on the tip paying address, with the mempool
+// transactions of the highest fee per byte that fit in maxBlockTxBytes
+func NewBlockTemplate(bc *Blockchain, address string) *BlockTemplate {
+	tip := bc.GetLastBlock()
+	set := UTXOSet{bc}
+
+	var candidates []templateTx
+	for _, tx := range mempoolTxs() {
+		tx := tx
+		prevOuts, err := set.FindPrevOutputs(&tx)
+		if err != nil {
+			continue
+		}
+		valid := false
+		if err := recoverPanic(func() { valid = bc.VerifyTransaction(&tx) }); err != nil || !valid {
+			continue
+		}
+		if set.CheckTransactionLocks(&tx, tip.Height+1, tip.Hash) != nil {
+			continue
+		}
+
+		fee, err := transactionFee(&tx, prevOuts)
+		if err != nil {
+			continue
+		}
+		candidates = append(candidates, templateTx{&tx, fee, len(tx.Serialize())})
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].fee*candidates[j].size > candidates[j].fee*candidates[i].size
+	})
+
+	template := &BlockTemplate{tip.Height + 1, tip.Hash, time.Now().Unix(), chainParams.TargetBits, nil, nil, 0}
+	var txs []*Transaction
+	size := 0
+	spent := make(map[string]bool)
+	for _, candidate := range candidates {
+		if size+candidate.size > maxBlockTxBytes {
+			continue
+		}
+		conflict := false
+		for _, vin := range candidate.tx.Vin {
+			conflict = conflict || spent[fmt.Sprintf("%x:%d", vin.Txid, vin.Vout)]
+		}
+		if conflict {
+			continue
+		}
+		for _, vin := range candidate.tx.Vin {
+			spent[fmt.Sprintf("%x:%d", vin.Txid, vin.Vout)] = true
+		}
+
+		txs = append(txs, candidate.tx)
+		size += candidate.size
+		template.Fees += candidate.fee
+	}
+
+	coinbase := NewCoinbaseTX(address, "")
+	coinbase.Vout[0].Value += template.Fees
+	coinbase.ID = coinbase.Hash()
+
+	template.Transactions = append([]*Transaction{coinbase}, txs...)
+	template.MerkleRoot = template.Block(0).HashTransactions()
+
+	return template
+}
+
+// Block returns the block of the template with nonce, hashed
+func (t *BlockTemplate) Block(nonce int) *Block {
+	hash := sha256.Sum256(headerData(t.PrevBlockHash, t.MerkleRoot, t.Timestamp, nonce))
+
+	return &Block{t.Timestamp, t.Transactions, t.PrevBlockHash, hash[:], nonce, t.Height}
+}
+
+// submitBlock adds a block mined on the tip to the chain and announces it to every peer
+func submitBlock(block *Block, bc *Blockchain) error {
+	err := func() error {
+		chainLock.Lock()
+		defer chainLock.Unlock()
+
+		if !NewProofOfWork(block).Validate() {
+			return errors.New("block has an invalid proof of work")
+		}
+		tip := bc.GetLastBlock()
+		if !bytes.Equal(block.PrevBlockHash, tip.Hash) || block.Height != tip.Height+1 {
+			return fmt.Errorf("block %x doesn't extend the tip %x", block.Hash, tip.Hash)
+		}
+		UTXOSet := UTXOSet{bc}
+		if err := UTXOSet.CheckBlockLocks(block); err != nil {
+			return err
+		}
+		if err := bc.VerifyBlockTransactions(block); err != nil {
+			return err
+		}
+
+		addBlock(block, bc)
+		return nil
+	}()
+	if err != nil {
+		return err
+	}
+
+	for _, node := range knownNodeList() {
+		if node != nodeAddress {
+			sendCmpctBlock(node, block)
+		}
+	}
+
+	return nil
+}
+
+// runMiner mines blocks paying address for as long as the node runs. It mines once
+// the template holds minetxs transactions, or mineinterval seconds after the last
+// block when that is set, and starts over when the tip or the mempool changes.
+func runMiner(bc *Blockchain, address string) {
+	target := powTarget()
+
+	for {
+		select {
+		case <-minerChanged:
+		default:
+		}
+
+		var template *BlockTemplate
+		if err := recoverPanic(func() { template = NewBlockTemplate(bc, address) }); err != nil {
+			log.Printf("Miner stopped, building a block template failed: %s\n", err)
+			return
+		}
+
+		var wait <-chan time.Time
+		due := len(template.Transactions)-1 >= minMempoolToMine()
+		if config.MineInterval > 0 {
+			lastBlock := time.Unix(bc.GetLastBlock().Timestamp, 0)
+			interval := time.Duration(config.MineInterval) * time.Second
+			due = due || time.Since(lastBlock) >= interval
+			wait = time.After(time.Until(lastBlock.Add(interval)))
+		}
+		if !due {
+			select {
+			case <-minerChanged:
+			case <-wait:
+			}
+			continue
+		}
+
+		var hashInt big.Int
+		for nonce := 0; nonce < maxNonce; nonce++ {
+			if nonce%minerCheckNonces == 0 && len(minerChanged) > 0 {
+				break
+			}
+			hash := sha256.Sum256(headerData(template.PrevBlockHash, template.MerkleRoot, template.Timestamp, nonce))
+			hashInt.SetBytes(hash[:])
+			if hashInt.Cmp(target) != -1 {
+				continue
+			}
+
+			block := template.Block(nonce)
+			if err := submitBlock(block, bc); err != nil {
+				log.Printf("Mined block %x rejected: %s\n", block.Hash, err)
+			} else {
+				fmt.Printf("New block %x is mined with %d transactions!\n", block.Hash, len(block.Transactions)-1)
+			}
+			break
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package domain
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Misbehavior points of protocol violations, a peer is banned at banThreshold
+const (
+	scoreUndecodable  = 20
+	scoreOversized    = 20
+	scoreRateLimited  = 1
+	scoreUnknown      = 10
+	scoreInvalidTx    = 10
+	scoreInvFlood     = 20
+	scoreUnsolicited  = 20
+	scoreInvalidBlock = 100
+	scoreBadPoW       = 100
+)
+
+// maxInvItems caps the hashes announced in one inv, maxAddrItems the addresses of an addr
+const maxInvItems = 50000
+const maxAddrItems = 1000
+
+var banList *BanList
+
+var peerScores = struct {
+	sync.Mutex
+	scores map[string]int
+}{scores: make(map[string]int)}
+
+func remoteIP(addr net.Addr) net.IP {
+	if addr == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+
+	return net.ParseIP(host)
+}
+
+// misbehaving adds points to the score of the peer at from, banning it when the
+// score reaches banThreshold. Scores are kept per IP until the node restarts.
+// Loopback peers are only logged, every node on the host shares their IP and a
+// ban would cut all of them off.
+func misbehaving(from net.Addr, points int, format string, v ...interface{}) {
+	ip := remoteIP(from)
+	if ip == nil {
+		return
+	}
+	reason := fmt.Sprintf(format, v...)
+
+	if ip.IsLoopback() {
+		log.Printf("Peer %s misbehaving, not scored as it's a loopback address: %s\n", from, reason)
+		return
+	}
+
+	peerScores.Lock()
+	peerScores.scores[ip.String()] += points
+	score := peerScores.scores[ip.String()]
+	if score >= banThreshold {
+		delete(peerScores.scores, ip.String())
+	}
+	peerScores.Unlock()
+
+	log.Printf("Peer %s misbehaving (%d points): %s\n", ip, score, reason)
+	if score < banThreshold {
+		return
+	}
+
+	subnet, err := banList.Ban(ip.String(), time.Now().Add(defaultBanTime), reason)
+	if err != nil {
+		log.Printf("Banning %s failed: %s\n", ip, err)
+		return
+	}
+	log.Printf("Banned %s for %s\n", subnet, defaultBanTime)
+}
+
+func isBannedAddr(addr net.Addr) bool {
+	ip := remoteIP(addr)
+
+	return banList != nil && ip != nil && banList.IsBanned(ip)
+}
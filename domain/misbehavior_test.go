@@ -0,0 +1,47 @@
+package domain
+
+import (
+	"net"
+	"testing"
+)
+
+func TestMisbehavingBans(t *testing.T) {
+	defer banList.Clear()
+
+	tests := []struct {
+		addr   *net.TCPAddr
+		banned bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 3000}, true},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 3000}, true},
+		{&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 3001}, false},
+		{&net.TCPAddr{IP: net.ParseIP("127.0.0.2"), Port: 3001}, false},
+		{&net.TCPAddr{IP: net.ParseIP("::1"), Port: 3001}, false},
+	}
+
+	for _, test := range tests {
+		misbehaving(test.addr, banThreshold/2, "test violation")
+		if isBannedAddr(test.addr) {
+			t.Errorf("%s: banned below the threshold", test.addr)
+		}
+
+		misbehaving(test.addr, banThreshold/2, "test violation")
+		if banned := isBannedAddr(test.addr); banned != test.banned {
+			t.Errorf("%s: banned %t, expected %t", test.addr, banned, test.banned)
+		}
+
+		// Bans cover every port of the IP, loopback peers are exempt on all of them
+		neighbor := &net.TCPAddr{IP: test.addr.IP, Port: test.addr.Port + 1}
+		if banned := isBannedAddr(neighbor); banned != test.banned {
+			t.Errorf("%s: banned %t, expected %t", neighbor, banned, test.banned)
+		}
+	}
+
+	peerScores.Lock()
+	defer peerScores.Unlock()
+	for _, ip := range []string{"127.0.0.1", "127.0.0.2", "::1"} {
+		if score, ok := peerScores.scores[ip]; ok {
+			t.Errorf("%s: loopback peer scored %d points", ip, score)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package domain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/aleksannder/gochain/util"
+	"log"
+	"os"
+	"strings"
+)
+
+type PartiallySignedTransaction struct {
+	Tx     Transaction
+	Inputs []PSBTInput
+}
+
+type PSBTInput struct {
+	PrevOut      TXOutput
+	RedeemScript []byte            // Empty for pay-to-pubkey-hash outputs
+	Signatures   map[string][]byte // Keyed by hex encoded public key
+}
+
+// NewMultiSigScript builds the redeem script "M <pubKey1> ... <pubKeyN> N OP_CHECKMULTISIG"
+func NewMultiSigScript(m int, pubKeys [][]byte) ([]byte, error) {
+	n := len(pubKeys)
+	if n == 0 || n > maxPubKeysPerMultiSig {
+		return nil, fmt.Errorf("multisig needs between 1 and %d public keys, got %d", maxPubKeysPerMultiSig, n)
+	}
+	if m < 1 || m > n {
+		return nil, fmt.Errorf("required signatures must be between 1 and %d, got %d", n, m)
+	}
+
+	builder := NewScriptBuilder().AddInt(int64(m))
+	for _, pubKey := range pubKeys {
+		builder.AddData(pubKey)
+	}
+	script := builder.AddInt(int64(n)).AddOp(opCheckMultiSig).Script()
+
+	if len(script) > maxScriptElementSize {
+		return nil, fmt.Errorf("redeem script is %d bytes, the limit is %d", len(script), maxScriptElementSize)
+	}
+
+	return script, nil
+}
+
+func ParseMultiSigScript(script []byte) (int, [][]byte, error) {
+	ops, err := parseScript(script)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(ops) < 4 || ops[len(ops)-1].opcode != opCheckMultiSig {
+		return 0, nil, errors.New("not a multisig script")
+	}
+
+	m, err := parseScriptNum(ops[0].pushedValue(), maxScriptNumLen)
+	if err != nil {
+		return 0, nil, err
+	}
+	n, err := parseScriptNum(ops[len(ops)-2].pushedValue(), maxScriptNumLen)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var pubKeys [][]byte
+	for _, op := range ops[1 : len(ops)-2] {
+		pubKeys = append(pubKeys, op.data)
+	}
+
+	if int(n) != len(pubKeys) || m < 1 || m > n {
+		return 0, nil, errors.New("malformed multisig script")
+	}
+
+	return int(m), pubKeys, nil
+}
+
+// NewMultiSigTransaction builds an unsigned transaction spending from a multisig address
+func NewMultiSigTransaction(from string, redeemScript []byte, payments []Payment, lockTime int64, coins CoinSelection, set *UTXOSet) *PartiallySignedTransaction {
+	return newPSBT(newUnsignedTransaction(from, payments, lockTime, coins, set), redeemScript, set)
+}
+
+// NewExternalTransaction builds an unsigned transaction spending from a pay-to-pubkey-hash
+// address whose key is kept elsewhere, like a watch-only address
+func NewExternalTransaction(from string, payments []Payment, lockTime int64, coins CoinSelection, set *UTXOSet) *PartiallySignedTransaction {
+	return newPSBT(newUnsignedTransaction(from, payments, lockTime, coins, set), nil, set)
+}
+
+func newPSBT(tx *Transaction, redeemScript []byte, set *UTXOSet) *PartiallySignedTransaction {
+	psbt := &PartiallySignedTransaction{Tx: *tx}
+	for _, vin := range tx.Vin {
+		prevTX, err := set.Blockchain.FindTransaction(vin.Txid)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		psbt.Inputs = append(psbt.Inputs, PSBTInput{
+			PrevOut:      prevTX.Vout[vin.Vout],
+			RedeemScript: redeemScript,
+			Signatures:   make(map[string][]byte),
+		})
+	}
+
+	return psbt
+}
+
+// Sign adds signatures for every input the wallet holds a key for, returning how many were added
+func (psbt *PartiallySignedTransaction) Sign(wallets *Wallets, hashType SigHashType) int {
+	signed := 0
+
+	for inID := range psbt.Inputs {
+		input := &psbt.Inputs[inID]
+		if input.Signatures == nil {
+			input.Signatures = make(map[string][]byte)
+		}
+
+		if len(input.RedeemScript) == 0 {
+			wallet := wallets.GetWalletByPubKeyHash(ExtractPubKeyHash(input.PrevOut.ScriptPubKey))
+			if wallet == nil || len(input.Signatures) > 0 {
+				continue
+			}
+
+			signature := psbt.Tx.SignInput(inID, input.PrevOut.ScriptPubKey, input.PrevOut.Value, hashType, wallet)
+			input.Signatures[hex.EncodeToString(wallet.PublicKey)] = signature
+			signed++
+			continue
+		}
+
+		_, pubKeys, err := ParseMultiSigScript(input.RedeemScript)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		for _, pubKey := range pubKeys {
+			wallet := wallets.GetWalletByPubKey(pubKey)
+			if wallet == nil {
+				continue
+			}
+
+			keyID := hex.EncodeToString(pubKey)
+			if _, ok := input.Signatures[keyID]; ok {
+				continue
+			}
+
+			input.Signatures[keyID] = psbt.Tx.SignInput(inID, input.RedeemScript, input.PrevOut.Value, hashType, wallet)
+			signed++
+		}
+	}
+
+	return signed
+}
+
+func (psbt *PartiallySignedTransaction) IsComplete() bool {
+	for _, input := range psbt.Inputs {
+		if len(input.RedeemScript) == 0 {
+			if len(input.Signatures) == 0 {
+				return false
+			}
+			continue
+		}
+
+		m, _, err := ParseMultiSigScript(input.RedeemScript)
+		if err != nil || len(input.Signatures) < m {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Finalize assembles the unlocking scripts, ordering signatures like their public keys
+func (psbt *PartiallySignedTransaction) Finalize() (*Transaction, error) {
+	if !psbt.IsComplete() {
+		return nil, errors.New("not enough signatures to finalize the transaction")
+	}
+
+	tx := psbt.Tx
+	tx.Vin = make([]TXInput, len(psbt.Tx.Vin))
+	copy(tx.Vin, psbt.Tx.Vin)
+
+	for inID, input := range psbt.Inputs {
+		if len(input.RedeemScript) == 0 {
+			for keyID, signature := range input.Signatures {
+				pubKey, err := hex.DecodeString(keyID)
+				if err != nil {
+					return nil, err
+				}
+				tx.Vin[inID].ScriptSig = NewScriptBuilder().AddData(signature).AddData(pubKey).Script()
+			}
+			continue
+		}
+
+		m, pubKeys, err := ParseMultiSigScript(input.RedeemScript)
+		if err != nil {
+			return nil, err
+		}
+
+		builder := NewScriptBuilder().AddOp(op0)
+		added := 0
+		for _, pubKey := range pubKeys {
+			signature, ok := input.Signatures[hex.EncodeToString(pubKey)]
+			if !ok || added == m {
+				continue
+			}
+			builder.AddData(signature)
+			added++
+		}
+		tx.Vin[inID].ScriptSig = builder.AddData(input.RedeemScript).Script()
+	}
+
+	var prevOuts []UTXO
+	for inID, vin := range tx.Vin {
+		prevOuts = append(prevOuts, UTXO{Outpoint{vin.Txid, vin.Vout}, psbt.Inputs[inID].PrevOut})
+	}
+	prevTXs, err := prevTransactions(&tx, prevOuts)
+	if err != nil {
+		return nil, err
+	}
+
+	if !tx.Verify(prevTXs) {
+		return nil, errors.New("finalized transaction does not verify")
+	}
+
+	return &tx, nil
+}
+
+// InputAddress returns the address spent by input inID, pay-to-pubkey-hash
+// inputs are only known once they are signed
+func (psbt *PartiallySignedTransaction) InputAddress(inID int) string {
+	input := psbt.Inputs[inID]
+	if len(input.RedeemScript) > 0 {
+		return fmt.Sprintf("%s", NewMultiSigAddress(input.RedeemScript))
+	}
+
+	for keyID := range input.Signatures {
+		pubKey, err := hex.DecodeString(keyID)
+		if err != nil {
+			break
+		}
+		if scheme := schemeForPubKey(pubKey); scheme != nil {
+			return fmt.Sprintf("%s", encodeAddress(scheme.AddressVersion(), util.HashPubKey(pubKey)))
+		}
+	}
+
+	return ""
+}
+
+func (psbt *PartiallySignedTransaction) Serialize() []byte {
+	var buf bytes.Buffer
+
+	enc := gob.NewEncoder(&buf)
+	err := enc.Encode(psbt)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return buf.Bytes()
+}
+
+func DeserializePSBT(data []byte) (*PartiallySignedTransaction, error) {
+	var psbt PartiallySignedTransaction
+
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	err := dec.Decode(&psbt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &psbt, nil
+}
+
+// PSBT files hold the hex encoded transaction so they can be passed around as text
+
+func (psbt *PartiallySignedTransaction) SaveToFile(file string) {
+	content := hex.EncodeToString(psbt.Serialize())
+
+	err := os.WriteFile(file, []byte(content+"\n"), 0644)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+func LoadPSBTFromFile(file string) (*PartiallySignedTransaction, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := hex.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil {
+		return nil, err
+	}
+
+	return DeserializePSBT(data)
+}
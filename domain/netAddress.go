@@ -0,0 +1,122 @@
+package domain
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// Node addresses are host:port, IPv6 hosts in brackets like [2001:db8::1]:3000
+
+// normalizeAddress checks a host:port address and writes it the way peers compare them
+func normalizeAddress(address string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", fmt.Errorf("address %s isn't host:port, IPv6 hosts go in brackets", address)
+	}
+	number, err := strconv.Atoi(port)
+	if err != nil || number < 0 || number > 65535 {
+		return "", fmt.Errorf("address %s has an invalid port", address)
+	}
+
+	return net.JoinHostPort(host, port), nil
+}
+
+// addressPort returns the port of a host:port address
+func addressPort(address string) string {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		log.Panicf("ERROR: %s", err)
+	}
+
+	return port
+}
+
+// isPublicHost reports whether peers elsewhere could reach host, which is false for
+// loopback and unspecified addresses
+func isPublicHost(host string) bool {
+	if host == "" || host == "localhost" {
+		return false
+	}
+
+	ip := net.ParseIP(host)
+	return ip == nil || !(ip.IsLoopback() || ip.IsUnspecified())
+}
+
+// The address peers observe this node at is only advertised once externalAddressVotes
+// peers at different IPs reported the same host
+const externalAddressVotes = 3
+
+// externalVotes holds the host each peer IP last observed this node at
+var externalVotes = struct {
+	sync.Mutex
+	byIP map[string]string
+}{byIP: make(map[string]string)}
+
+// peerAddress is the address an inbound peer is reached at. Only the port is taken
+// from the address the peer announces, the host is the IP the connection came from.
+// An announced IP equal to it is kept as written, and so is localhost on loopback
+// connections. Hostnames aren't resolved, a peer could stall the node on slow DNS.
+func peerAddress(remote net.Addr, announced string) string {
+	remoteHost, _, err := net.SplitHostPort(remote.String())
+	if err != nil {
+		return announced
+	}
+	host, port, err := net.SplitHostPort(announced)
+	if err != nil {
+		return remote.String()
+	}
+
+	remoteIP := net.ParseIP(remoteHost)
+	if remoteIP == nil {
+		return net.JoinHostPort(remoteHost, port)
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.Equal(remoteIP) {
+		return net.JoinHostPort(host, port)
+	}
+	if host == "localhost" && remoteIP.IsLoopback() {
+		return net.JoinHostPort(host, port)
+	}
+
+	return net.JoinHostPort(remoteIP.String(), port)
+}
+
+// learnExternalAddress counts the address the peer at from observed us at, and starts
+// advertising it once enough peers agree, as long as no -externalip is set and we only
+// know a local address for ourselves
+func learnExternalAddress(observed string, from net.Addr) {
+	host, _, err := net.SplitHostPort(observed)
+	if err != nil || config.ExternalIP != "" || !isPublicHost(host) {
+		return
+	}
+	ownHost, port, err := net.SplitHostPort(nodeAddress)
+	if err != nil || isPublicHost(ownHost) {
+		return
+	}
+	ip := remoteIP(from)
+	if ip == nil {
+		return
+	}
+
+	externalVotes.Lock()
+	defer externalVotes.Unlock()
+
+	if _, ok := externalVotes.byIP[ip.String()]; !ok && len(externalVotes.byIP) >= maxAddrItems {
+		return
+	}
+	externalVotes.byIP[ip.String()] = host
+	votes := 0
+	for _, votedHost := range externalVotes.byIP {
+		if votedHost == host {
+			votes++
+		}
+	}
+	if votes < externalAddressVotes {
+		return
+	}
+
+	nodeAddress = net.JoinHostPort(host, port)
+	infof("Peers see this node at %s, advertising it\n", nodeAddress)
+}
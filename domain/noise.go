@@ -0,0 +1,376 @@
+package domain
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Encrypted connections run the Noise XX handshake, both sides prove their static
+// identity key and agree on a pair of ChaCha20-Poly1305 keys:
+//
+//	-> e
+//	<- e, ee, s, es
+//	-> s, se
+//
+// The initiator then sends the message, magic bytes included, in frames closed by
+// an empty one. Handshake messages and frames are prefixed by a 2 byte length.
+const (
+	noiseProtocolName = "Noise_XX_25519_ChaChaPoly_SHA256"
+	noiseKeyLen       = 32
+	noiseTagLen       = chacha20poly1305.Overhead
+	noiseMaxFrame     = 65535
+)
+
+const identityKeyFile = "nodekey_%s.dat"
+
+// identityKey is the static key of this node, peers learn it from ver
+var identityKey *ecdh.PrivateKey
+
+// encryptedMagic opens encrypted connections instead of the magic bytes, so the
+// responder can tell them from plaintext ones
+func encryptedMagic() []byte {
+	magic := make([]byte, len(chainParams.Magic))
+	for i, b := range chainParams.Magic {
+		magic[i] = ^b
+	}
+
+	return magic
+}
+
+// LoadIdentityKey reads the identity key of the node, creating it on first start
+func LoadIdentityKey(nodeID string) (*ecdh.PrivateKey, error) {
+	file := config.dataFile(fmt.Sprintf(identityKeyFile, nodeID))
+
+	content, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		key, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		err = os.WriteFile(file, []byte(hex.EncodeToString(key.Bytes())+"\n"), 0600)
+		return key, err
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := hex.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+
+	return ecdh.X25519().NewPrivateKey(raw)
+}
+
+// noiseState is the symmetric state of the handshake
+type noiseState struct {
+	h, ck []byte
+	k     cipher.AEAD
+	n     uint64
+
+	static, ephemeral *ecdh.PrivateKey
+	remoteStatic      []byte
+	remoteEphemeral   []byte
+}
+
+func newNoiseState(static *ecdh.PrivateKey) (*noiseState, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	s := noiseState{h: []byte(noiseProtocolName), static: static, ephemeral: ephemeral}
+	s.ck = s.h
+	s.mixHash(append([]byte("gochain"), chainParams.Magic[:]...))
+
+	return &s, nil
+}
+
+func (s *noiseState) mixHash(data []byte) {
+	hash := sha256.New()
+	hash.Write(s.h)
+	hash.Write(data)
+	s.h = hash.Sum(nil)
+}
+
+// noiseHKDF derives two keys from the chaining key and input key material
+func noiseHKDF(ck, ikm []byte) ([]byte, []byte) {
+	mac := hmac.New(sha256.New, ck)
+	mac.Write(ikm)
+	tempKey := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, tempKey)
+	mac.Write([]byte{0x01})
+	out1 := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, tempKey)
+	mac.Write(out1)
+	mac.Write([]byte{0x02})
+	out2 := mac.Sum(nil)
+
+	return out1, out2
+}
+
+func (s *noiseState) mixKey(local *ecdh.PrivateKey, remote []byte) error {
+	remoteKey, err := ecdh.X25519().NewPublicKey(remote)
+	if err != nil {
+		return err
+	}
+	shared, err := local.ECDH(remoteKey)
+	if err != nil {
+		return err
+	}
+
+	var key []byte
+	s.ck, key = noiseHKDF(s.ck, shared)
+	s.k, err = chacha20poly1305.New(key)
+	s.n = 0
+
+	return err
+}
+
+func noiseNonce(n uint64) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[4:], n)
+
+	return nonce
+}
+
+func (s *noiseState) encryptAndHash(plaintext []byte) []byte {
+	ciphertext := s.k.Seal(nil, noiseNonce(s.n), plaintext, s.h)
+	s.n++
+	s.mixHash(ciphertext)
+
+	return ciphertext
+}
+
+func (s *noiseState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	plaintext, err := s.k.Open(nil, noiseNonce(s.n), ciphertext, s.h)
+	if err != nil {
+		return nil, errors.New("handshake failed to authenticate")
+	}
+	s.n++
+	s.mixHash(ciphertext)
+
+	return plaintext, nil
+}
+
+// split returns the initiator's sending and receiving keys
+func (s *noiseState) split() (cipher.AEAD, cipher.AEAD, error) {
+	k1, k2 := noiseHKDF(s.ck, nil)
+
+	c1, err := chacha20poly1305.New(k1)
+	if err != nil {
+		return nil, nil, err
+	}
+	c2, err := chacha20poly1305.New(k2)
+
+	return c1, c2, err
+}
+
+func writeNoiseMessage(w io.Writer, message []byte) error {
+	frame := make([]byte, 2, 2+len(message))
+	binary.BigEndian.PutUint16(frame, uint16(len(message)))
+
+	_, err := w.Write(append(frame, message...))
+	return err
+}
+
+func readNoiseMessage(r io.Reader, length int) ([]byte, error) {
+	var prefix [2]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+	if int(binary.BigEndian.Uint16(prefix[:])) != length {
+		return nil, errors.New("handshake message has the wrong length")
+	}
+
+	message := make([]byte, length)
+	_, err := io.ReadFull(r, message)
+	return message, err
+}
+
+// noiseInitiate runs the handshake as the dialing side, after the encrypted magic
+func noiseInitiate(conn net.Conn, static *ecdh.PrivateKey) (*noiseSession, error) {
+	s, err := newNoiseState(static)
+	if err != nil {
+		return nil, err
+	}
+
+	// -> e, with an empty payload like every handshake message
+	s.mixHash(s.ephemeral.PublicKey().Bytes())
+	s.mixHash(nil)
+	if err := writeNoiseMessage(conn, s.ephemeral.PublicKey().Bytes()); err != nil {
+		return nil, err
+	}
+
+	// <- e, ee, s, es
+	message, err := readNoiseMessage(conn, 2*noiseKeyLen+2*noiseTagLen)
+	if err != nil {
+		return nil, err
+	}
+	s.remoteEphemeral = message[:noiseKeyLen]
+	s.mixHash(s.remoteEphemeral)
+	if err := s.mixKey(s.ephemeral, s.remoteEphemeral); err != nil {
+		return nil, err
+	}
+	if s.remoteStatic, err = s.decryptAndHash(message[noiseKeyLen : 2*noiseKeyLen+noiseTagLen]); err != nil {
+		return nil, err
+	}
+	if err := s.mixKey(s.ephemeral, s.remoteStatic); err != nil {
+		return nil, err
+	}
+	if _, err := s.decryptAndHash(message[2*noiseKeyLen+noiseTagLen:]); err != nil {
+		return nil, err
+	}
+
+	// -> s, se
+	message = s.encryptAndHash(s.static.PublicKey().Bytes())
+	if err := s.mixKey(s.static, s.remoteEphemeral); err != nil {
+		return nil, err
+	}
+	message = append(message, s.encryptAndHash(nil)...)
+	if err := writeNoiseMessage(conn, message); err != nil {
+		return nil, err
+	}
+
+	send, recv, err := s.split()
+	if err != nil {
+		return nil, err
+	}
+
+	return &noiseSession{conn: conn, send: send, recv: recv, remoteStatic: s.remoteStatic}, nil
+}
+
+// noiseRespond runs the handshake as the accepting side, after the encrypted magic
+func noiseRespond(conn net.Conn, static *ecdh.PrivateKey) (*noiseSession, error) {
+	s, err := newNoiseState(static)
+	if err != nil {
+		return nil, err
+	}
+
+	// -> e
+	if s.remoteEphemeral, err = readNoiseMessage(conn, noiseKeyLen); err != nil {
+		return nil, err
+	}
+	s.mixHash(s.remoteEphemeral)
+	s.mixHash(nil)
+
+	// <- e, ee, s, es
+	message := append([]byte{}, s.ephemeral.PublicKey().Bytes()...)
+	s.mixHash(s.ephemeral.PublicKey().Bytes())
+	if err := s.mixKey(s.ephemeral, s.remoteEphemeral); err != nil {
+		return nil, err
+	}
+	message = append(message, s.encryptAndHash(s.static.PublicKey().Bytes())...)
+	if err := s.mixKey(s.static, s.remoteEphemeral); err != nil {
+		return nil, err
+	}
+	message = append(message, s.encryptAndHash(nil)...)
+	if err := writeNoiseMessage(conn, message); err != nil {
+		return nil, err
+	}
+
+	// -> s, se
+	if message, err = readNoiseMessage(conn, noiseKeyLen+2*noiseTagLen); err != nil {
+		return nil, err
+	}
+	if s.remoteStatic, err = s.decryptAndHash(message[:noiseKeyLen+noiseTagLen]); err != nil {
+		return nil, err
+	}
+	if err := s.mixKey(s.ephemeral, s.remoteStatic); err != nil {
+		return nil, err
+	}
+	if _, err := s.decryptAndHash(message[noiseKeyLen+noiseTagLen:]); err != nil {
+		return nil, err
+	}
+
+	recv, send, err := s.split()
+	if err != nil {
+		return nil, err
+	}
+
+	return &noiseSession{conn: conn, send: send, recv: recv, remoteStatic: s.remoteStatic}, nil
+}
+
+// noiseSession carries one message over an established handshake, reading it
+// returns io.EOF only after the closing empty frame, so a cut connection is noticed
+type noiseSession struct {
+	conn         net.Conn
+	send, recv   cipher.AEAD
+	sendN, recvN uint64
+	remoteStatic []byte
+
+	pending []byte
+	done    bool
+}
+
+func (ns *noiseSession) WriteMessage(message []byte) error {
+	maxPlaintext := noiseMaxFrame - noiseTagLen
+
+	for {
+		chunk := message
+		if len(chunk) > maxPlaintext {
+			chunk = chunk[:maxPlaintext]
+		}
+		message = message[len(chunk):]
+
+		frame := ns.send.Seal(nil, noiseNonce(ns.sendN), chunk, nil)
+		ns.sendN++
+		if err := writeNoiseMessage(ns.conn, frame); err != nil {
+			return err
+		}
+
+		if len(chunk) == 0 {
+			return nil
+		}
+	}
+}
+
+func (ns *noiseSession) Read(p []byte) (int, error) {
+	for len(ns.pending) == 0 {
+		if ns.done {
+			return 0, io.EOF
+		}
+
+		var prefix [2]byte
+		if _, err := io.ReadFull(ns.conn, prefix[:]); err != nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+		frame := make([]byte, binary.BigEndian.Uint16(prefix[:]))
+		if _, err := io.ReadFull(ns.conn, frame); err != nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+
+		plaintext, err := ns.recv.Open(nil, noiseNonce(ns.recvN), frame, nil)
+		if err != nil {
+			return 0, errors.New("encrypted frame failed to authenticate")
+		}
+		ns.recvN++
+		ns.pending = plaintext
+		ns.done = len(plaintext) == 0
+	}
+
+	n := copy(p, ns.pending)
+	ns.pending = ns.pending[n:]
+
+	return n, nil
+}
+
+func (ns *noiseSession) hasRemoteStatic(key []byte) bool {
+	return bytes.Equal(ns.remoteStatic, key)
+}
@@ -0,0 +1,239 @@
+package domain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"sync"
+	"time"
+)
+
+// Blocks whose parent isn't in the chain and transactions spending outputs of
+// transactions that aren't in the chain wait in the orphan pools until the parent
+// is added, the parent is requested from the peer that sent the orphan
+const maxOrphanBlocks = 50
+const maxOrphanTxs = 100
+const maxOrphanTxSize = 100 << 10
+const orphanExpiry = 20 * time.Minute
+
+type orphanBlock struct {
+	block    *Block
+	from     net.Addr
+	addrFrom string
+	expires  time.Time
+}
+
+type orphanTx struct {
+	tx       Transaction
+	from     net.Addr
+	addrFrom string
+	expires  time.Time
+	parents  []string
+}
+
+var orphanBlocks = struct {
+	sync.Mutex
+	byHash map[string]*orphanBlock
+	byPrev map[string][]string
+}{byHash: make(map[string]*orphanBlock), byPrev: make(map[string][]string)}
+
+var orphanTxs = struct {
+	sync.Mutex
+	byID     map[string]*orphanTx
+	byParent map[string][]string
+}{byID: make(map[string]*orphanTx), byParent: make(map[string][]string)}
+
+func removeID(ids []string, id string) []string {
+	for i := range ids {
+		if ids[i] == id {
+			return append(ids[:i], ids[i+1:]...)
+		}
+	}
+
+	return ids
+}
+
+// removeOrphanBlock needs orphanBlocks locked
+func removeOrphanBlock(hash string) {
+	orphan, ok := orphanBlocks.byHash[hash]
+	if !ok {
+		return
+	}
+	delete(orphanBlocks.byHash, hash)
+
+	prev := hex.EncodeToString(orphan.block.PrevBlockHash)
+	orphanBlocks.byPrev[prev] = removeID(orphanBlocks.byPrev[prev], hash)
+	if len(orphanBlocks.byPrev[prev]) == 0 {
+		delete(orphanBlocks.byPrev, prev)
+	}
+}
+
+// addOrphanBlock keeps a block until its parent arrives and returns the hash to
+// request from the peer, the oldest ancestor missing from the pool. It returns nil
+// when the block is already in the pool.
+func addOrphanBlock(block *Block, from net.Addr, addrFrom string) []byte {
+	orphanBlocks.Lock()
+	defer orphanBlocks.Unlock()
+
+	hash := hex.EncodeToString(block.Hash)
+	if _, ok := orphanBlocks.byHash[hash]; ok {
+		return nil
+	}
+
+	now := time.Now()
+	for hash, orphan := range orphanBlocks.byHash {
+		if now.After(orphan.expires) {
+			removeOrphanBlock(hash)
+		}
+	}
+	for hash := range orphanBlocks.byHash {
+		if len(orphanBlocks.byHash) < maxOrphanBlocks {
+			break
+		}
+		removeOrphanBlock(hash)
+	}
+
+	orphanBlocks.byHash[hash] = &orphanBlock{block, from, addrFrom, now.Add(orphanExpiry)}
+	prev := hex.EncodeToString(block.PrevBlockHash)
+	orphanBlocks.byPrev[prev] = append(orphanBlocks.byPrev[prev], hash)
+
+	missing := block.PrevBlockHash
+	for range orphanBlocks.byHash {
+		orphan, ok := orphanBlocks.byHash[hex.EncodeToString(missing)]
+		if !ok {
+			break
+		}
+		missing = orphan.block.PrevBlockHash
+	}
+
+	return missing
+}
+
+// takeOrphanBlocks removes the orphans whose parent is the block with hash and returns them
+func takeOrphanBlocks(hash []byte) []*orphanBlock {
+	orphanBlocks.Lock()
+	defer orphanBlocks.Unlock()
+
+	var children []*orphanBlock
+	for _, childHash := range append([]string{}, orphanBlocks.byPrev[hex.EncodeToString(hash)]...) {
+		orphan := orphanBlocks.byHash[childHash]
+		if time.Now().Before(orphan.expires) {
+			children = append(children, orphan)
+		}
+		removeOrphanBlock(childHash)
+	}
+
+	return children
+}
+
+func isOrphanBlock(hash []byte) bool {
+	orphanBlocks.Lock()
+	defer orphanBlocks.Unlock()
+
+	_, ok := orphanBlocks.byHash[hex.EncodeToString(hash)]
+	return ok
+}
+
+func isOrphanTx(id []byte) bool {
+	orphanTxs.Lock()
+	defer orphanTxs.Unlock()
+
+	_, ok := orphanTxs.byID[hex.EncodeToString(id)]
+	return ok
+}
+
+// removeOrphanTx needs orphanTxs locked
+func removeOrphanTx(id string) {
+	orphan, ok := orphanTxs.byID[id]
+	if !ok {
+		return
+	}
+	delete(orphanTxs.byID, id)
+
+	for _, parent := range orphan.parents {
+		orphanTxs.byParent[parent] = removeID(orphanTxs.byParent[parent], id)
+		if len(orphanTxs.byParent[parent]) == 0 {
+			delete(orphanTxs.byParent, parent)
+		}
+	}
+}
+
+// addOrphanTx keeps a transaction until all its missing parents are in the chain,
+// false means it's too large to be kept
+func addOrphanTx(tx Transaction, missing [][]byte, from net.Addr, addrFrom string) bool {
+	if len(tx.Serialize()) > maxOrphanTxSize {
+		return false
+	}
+
+	orphanTxs.Lock()
+	defer orphanTxs.Unlock()
+
+	id := hex.EncodeToString(tx.ID)
+	if _, ok := orphanTxs.byID[id]; ok {
+		return true
+	}
+
+	now := time.Now()
+	for id, orphan := range orphanTxs.byID {
+		if now.After(orphan.expires) {
+			removeOrphanTx(id)
+		}
+	}
+	for id := range orphanTxs.byID {
+		if len(orphanTxs.byID) < maxOrphanTxs {
+			break
+		}
+		removeOrphanTx(id)
+	}
+
+	var parents []string
+	for _, parent := range missing {
+		parents = append(parents, hex.EncodeToString(parent))
+	}
+	orphanTxs.byID[id] = &orphanTx{tx, from, addrFrom, now.Add(orphanExpiry), parents}
+	for _, parent := range parents {
+		orphanTxs.byParent[parent] = append(orphanTxs.byParent[parent], id)
+	}
+
+	return true
+}
+
+// takeOrphanTxs removes the orphans spending outputs of the transactions of block
+// and returns them, they may still miss other parents
+func takeOrphanTxs(block *Block) []*orphanTx {
+	orphanTxs.Lock()
+	defer orphanTxs.Unlock()
+
+	var orphans []*orphanTx
+	for _, tx := range block.Transactions {
+		for _, id := range append([]string{}, orphanTxs.byParent[hex.EncodeToString(tx.ID)]...) {
+			orphan := orphanTxs.byID[id]
+			if time.Now().Before(orphan.expires) {
+				orphans = append(orphans, orphan)
+			}
+			removeOrphanTx(id)
+		}
+	}
+
+	return orphans
+}
+
+// missingParents returns the IDs of the transactions tx spends that aren't in the chain
+func (bc *Blockchain) missingParents(tx *Transaction) [][]byte {
+	var missing [][]byte
+
+	for _, vin := range tx.Vin {
+		known := false
+		for _, id := range missing {
+			known = known || bytes.Equal(id, vin.Txid)
+		}
+		if known {
+			continue
+		}
+		if _, err := bc.FindTransaction(vin.Txid); err != nil {
+			missing = append(missing, vin.Txid)
+		}
+	}
+
+	return missing
+}
@@ -0,0 +1,131 @@
+package domain
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Payment is one recipient of a transaction
+type Payment struct {
+	Address string `json:"address"`
+	Amount  int    `json:"amount"`
+}
+
+func totalAmount(payments []Payment) int {
+	total := 0
+	for _, payment := range payments {
+		total += payment.Amount
+	}
+
+	return total
+}
+
+// ValidatePayments checks every address and amount, an address may only be paid once
+func ValidatePayments(payments []Payment) error {
+	if len(payments) == 0 {
+		return errors.New("no recipients")
+	}
+
+	seen := make(map[string]bool)
+	for _, payment := range payments {
+		if _, err := ParseAddress(payment.Address); err != nil {
+			return fmt.Errorf("recipient %s", err)
+		}
+		if payment.Amount <= 0 {
+			return fmt.Errorf("amount for %s must be positive", payment.Address)
+		}
+		if seen[payment.Address] {
+			return fmt.Errorf("recipient %s is listed more than once", payment.Address)
+		}
+		seen[payment.Address] = true
+	}
+
+	return nil
+}
+
+// ParsePayments parses an inline list of address:amount pairs separated by commas
+func ParsePayments(list string) ([]Payment, error) {
+	var payments []Payment
+
+	for _, item := range strings.Split(list, ",") {
+		parts := strings.Split(strings.TrimSpace(item), ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("recipient %s is not in the form address:amount", item)
+		}
+
+		amount, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("amount of %s isn't a number", parts[0])
+		}
+		payments = append(payments, Payment{parts[0], amount})
+	}
+
+	return payments, nil
+}
+
+// LoadPaymentsFromFile reads recipients from a JSON file, either a list of
+// {"address", "amount"} objects or an object mapping addresses to amounts, or from
+// a CSV file with address,amount rows and an optional header
+func LoadPaymentsFromFile(file string) ([]Payment, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	trimmed := bytes.TrimSpace(content)
+	switch {
+	case bytes.HasPrefix(trimmed, []byte("[")):
+		var payments []Payment
+		err := json.Unmarshal(trimmed, &payments)
+		return payments, err
+	case bytes.HasPrefix(trimmed, []byte("{")):
+		var amounts map[string]int
+		if err := json.Unmarshal(trimmed, &amounts); err != nil {
+			return nil, err
+		}
+
+		var payments []Payment
+		for address, amount := range amounts {
+			payments = append(payments, Payment{address, amount})
+		}
+		return payments, nil
+	}
+
+	return parsePaymentsCSV(bytes.NewReader(trimmed))
+}
+
+func parsePaymentsCSV(r io.Reader) ([]Payment, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = 2
+	reader.TrimLeadingSpace = true
+	reader.Comment = '#'
+
+	var payments []Payment
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		amount, err := strconv.Atoi(strings.TrimSpace(record[1]))
+		if err != nil {
+			if line == 1 {
+				continue // Header
+			}
+			return nil, fmt.Errorf("line %d: amount %s isn't a number", line, record[1])
+		}
+		payments = append(payments, Payment{strings.TrimSpace(record[0]), amount})
+	}
+
+	return payments, nil
+}
@@ -0,0 +1,133 @@
+package domain
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// PeerInfo is what the node knows about a peer, from its ver and its last connection
+type PeerInfo struct {
+	Address     string `json:"address"`
+	IdentityKey string `json:"identity_key,omitempty"` // Empty for peers without encryption
+	Inbound     bool   `json:"inbound"`                // Direction of the last connection
+	Encrypted   bool   `json:"encrypted"`              // Whether the last connection was encrypted
+	LastSeen    int64  `json:"last_seen"`              // Unix time
+	BanScore    int    `json:"ban_score"`
+}
+
+var peers = struct {
+	sync.Mutex
+	info map[string]*PeerInfo
+}{info: make(map[string]*PeerInfo)}
+
+func peerEntry(address string) *PeerInfo {
+	info, ok := peers.info[address]
+	if !ok {
+		info = &PeerInfo{Address: address}
+		peers.info[address] = info
+	}
+
+	return info
+}
+
+// pinPeerIdentityKey remembers the first key a peer announced or proved, connections
+// to it are encrypted from then on. The peer can't change or drop the key afterwards.
+func pinPeerIdentityKey(address string, key []byte) error {
+	peers.Lock()
+	defer peers.Unlock()
+
+	info := peerEntry(address)
+	if info.IdentityKey == "" {
+		info.IdentityKey = hex.EncodeToString(key)
+		return nil
+	}
+	if len(key) == 0 {
+		return fmt.Errorf("no identity key instead of the pinned key %s", info.IdentityKey)
+	}
+	if hex.EncodeToString(key) != info.IdentityKey {
+		return fmt.Errorf("identity key %x isn't the pinned key %s", key, info.IdentityKey)
+	}
+
+	return nil
+}
+
+// checkPeerIdentity checks a message from the peer at address against its pinned key,
+// session is nil for a plaintext message. Once a key is pinned only ver may come in
+// plaintext, a restarted peer doesn't know our key yet, and handleVersion refuses it
+// when it announces another key or none.
+func checkPeerIdentity(address, command string, session *noiseSession) error {
+	if session != nil {
+		return pinPeerIdentityKey(address, session.remoteStatic)
+	}
+	if command != "ver" && config.Encrypt && identityKey != nil && peerIdentityKey(address) != nil {
+		return errors.New("plaintext message from a peer with a pinned identity key")
+	}
+
+	return nil
+}
+
+// peerIdentityKey returns the announced key of a peer, nil when it has none
+func peerIdentityKey(address string) []byte {
+	peers.Lock()
+	defer peers.Unlock()
+
+	info, ok := peers.info[address]
+	if !ok {
+		return nil
+	}
+	key, err := hex.DecodeString(info.IdentityKey)
+	if err != nil || len(key) == 0 {
+		return nil
+	}
+
+	return key
+}
+
+func recordConnection(address string, inbound, encrypted bool) {
+	peers.Lock()
+	defer peers.Unlock()
+
+	info := peerEntry(address)
+	info.Inbound = inbound
+	info.Encrypted = encrypted
+	info.LastSeen = time.Now().Unix()
+}
+
+// peerInfos lists the known nodes, sorted by address
+func peerInfos() []PeerInfo {
+	nodes := knownNodeList()
+
+	peers.Lock()
+	var infos []PeerInfo
+	for _, node := range nodes {
+		if node == nodeAddress {
+			continue
+		}
+		info := PeerInfo{Address: node}
+		if known, ok := peers.info[node]; ok {
+			info = *known
+		}
+		infos = append(infos, info)
+	}
+	peers.Unlock()
+
+	peerScores.Lock()
+	for i, info := range infos {
+		host, _, err := net.SplitHostPort(info.Address)
+		if ip := net.ParseIP(host); err == nil && ip != nil {
+			infos[i].BanScore = peerScores.scores[ip.String()]
+		}
+	}
+	peerScores.Unlock()
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Address < infos[j].Address
+	})
+
+	return infos
+}
@@ -0,0 +1,121 @@
+package domain
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const poolSharesFile = "poolshares_%s.json"
+
+// Share counts are saved at most every poolSharesSaveInterval, and right away when
+// a worker finds a block
+const poolSharesSaveInterval = 10 * time.Second
+
+// WorkerShares are the shares a pool worker submitted since the last reset
+type WorkerShares struct {
+	Worker    string `json:"worker"`
+	Accepted  int    `json:"accepted"`
+	Rejected  int    `json:"rejected"`
+	Blocks    int    `json:"blocks"`
+	LastShare int64  `json:"last_share"` // Unix time
+}
+
+// PoolShares counts the shares of every worker of the Stratum server for payouts
+type PoolShares struct {
+	file string
+
+	mu      sync.Mutex
+	workers map[string]*WorkerShares
+	saved   time.Time
+}
+
+func LoadPoolShares(nodeID string) (*PoolShares, error) {
+	ps := PoolShares{file: config.dataFile(fmt.Sprintf(poolSharesFile, nodeID)), workers: make(map[string]*WorkerShares)}
+
+	content, err := os.ReadFile(ps.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return &ps, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var workers []WorkerShares
+	if err := json.Unmarshal(content, &workers); err != nil {
+		return nil, fmt.Errorf("%s: %s", ps.file, err)
+	}
+	for i := range workers {
+		ps.workers[workers[i].Worker] = &workers[i]
+	}
+
+	return &ps, nil
+}
+
+// Record counts a share of worker, block tells whether it was a block solution
+func (ps *PoolShares) Record(worker string, accepted, block bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	shares, ok := ps.workers[worker]
+	if !ok {
+		shares = &WorkerShares{Worker: worker}
+		ps.workers[worker] = shares
+	}
+	if !accepted {
+		shares.Rejected++
+	} else {
+		shares.Accepted++
+		shares.LastShare = time.Now().Unix()
+	}
+	if block {
+		shares.Blocks++
+	}
+
+	if block || time.Since(ps.saved) >= poolSharesSaveInterval {
+		if err := ps.save(); err != nil {
+			log.Printf("Saving pool shares failed: %s\n", err)
+		}
+	}
+}
+
+// List returns the share counts sorted by worker, reset clears them for the next payout
+func (ps *PoolShares) List(reset bool) ([]WorkerShares, error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	workers := []WorkerShares{}
+	for _, shares := range ps.workers {
+		workers = append(workers, *shares)
+	}
+	sort.Slice(workers, func(i, j int) bool {
+		return workers[i].Worker < workers[j].Worker
+	})
+
+	if reset {
+		ps.workers = make(map[string]*WorkerShares)
+		return workers, ps.save()
+	}
+
+	return workers, nil
+}
+
+func (ps *PoolShares) save() error {
+	workers := []WorkerShares{}
+	for _, shares := range ps.workers {
+		workers = append(workers, *shares)
+	}
+
+	content, err := json.MarshalIndent(workers, "", "  ")
+	if err != nil {
+		return err
+	}
+	ps.saved = time.Now()
+
+	return os.WriteFile(ps.file, append(content, '\n'), 0644)
+}
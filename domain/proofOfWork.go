@@ -13,30 +13,38 @@ var (
 	maxNonce = math.MaxInt64
 )
 
-const targetBits = 16
-
 type ProofOfWork struct {
 	block  *Block
 	target *big.Int
 }
 
 func NewProofOfWork(b *Block) *ProofOfWork {
-	target := big.NewInt(1)
-	target.Lsh(target, uint(256-targetBits))
-
 	return &ProofOfWork{
 		block:  b,
-		target: target,
+		target: powTarget(),
 	}
 }
 
+func powTarget() *big.Int {
+	target := big.NewInt(1)
+	target.Lsh(target, uint(256-chainParams.TargetBits))
+
+	return target
+}
+
 func (pow *ProofOfWork) prepareData(nonce int) []byte {
+	return headerData(pow.block.PrevBlockHash, pow.block.HashTransactions(), pow.block.Timestamp, nonce)
+}
+
+// headerData is what the block hash is taken of, the transactions only count through
+// their merkle root
+func headerData(prevBlockHash, merkleRoot []byte, timestamp int64, nonce int) []byte {
 	data := bytes.Join(
 		[][]byte{
-			pow.block.PrevBlockHash,
-			pow.block.HashTransactions(),
-			util.IntToHex(pow.block.Timestamp),
-			util.IntToHex(int64(targetBits)),
+			prevBlockHash,
+			merkleRoot,
+			util.IntToHex(timestamp),
+			util.IntToHex(int64(chainParams.TargetBits)),
 			util.IntToHex(int64(nonce)),
 		},
 		[]byte{},
@@ -68,6 +76,7 @@ func (pow *ProofOfWork) Run() (int, []byte) {
 	return nonce, hash[:]
 }
 
+// Validate checks that the block hash is the one its nonce produces and meets the target
 func (pow *ProofOfWork) Validate() bool {
 	var hashInt big.Int
 
@@ -75,5 +84,5 @@ func (pow *ProofOfWork) Validate() bool {
 	hash := sha256.Sum256(data)
 	hashInt.SetBytes(hash[:])
 
-	return hashInt.Cmp(pow.target) == -1
+	return hashInt.Cmp(pow.target) == -1 && bytes.Equal(hash[:], pow.block.Hash)
 }
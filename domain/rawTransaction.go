@@ -0,0 +1,266 @@
+package domain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aleksannder/gochain/util"
+)
+
+// Raw transactions are the gob serialized Transaction encoded as hex, so they can be
+// carried to and from an offline machine as text
+
+// rawPrevOutput is how a spent output is written for signrawtransaction
+type rawPrevOutput struct {
+	Txid         string `json:"txid"`
+	Vout         int    `json:"vout"`
+	ScriptPubKey string `json:"scriptPubKey"`
+	Amount       int    `json:"amount"`
+}
+
+// NewRawTransaction builds an unsigned transaction spending exactly inputs, with one
+// output per payment. Nothing is added for change.
+func NewRawTransaction(inputs []Outpoint, payments []Payment, lockTime int64) (*Transaction, error) {
+	if len(inputs) == 0 {
+		return nil, errors.New("no inputs")
+	}
+	if err := ValidatePayments(payments); err != nil {
+		return nil, err
+	}
+	if lockTime < 0 {
+		return nil, errors.New("lock time can't be negative")
+	}
+
+	// Lock time is only enforced when at least one input isn't final
+	sequence := uint32(maxTxInSequence)
+	if lockTime != 0 {
+		sequence = maxTxInSequence - 1
+	}
+
+	var vin []TXInput
+	for i, outpoint := range inputs {
+		for _, previous := range inputs[:i] {
+			if bytes.Equal(previous.Txid, outpoint.Txid) && previous.Vout == outpoint.Vout {
+				return nil, fmt.Errorf("input %x:%d is listed twice", outpoint.Txid, outpoint.Vout)
+			}
+		}
+		vin = append(vin, TXInput{outpoint.Txid, outpoint.Vout, nil, sequence})
+	}
+
+	var vout []TXOutput
+	for _, payment := range payments {
+		vout = append(vout, *NewTXOutput(payment.Amount, payment.Address))
+	}
+
+	tx := Transaction{nil, vin, vout, lockTime}
+	tx.ID = tx.Hash()
+
+	return &tx, nil
+}
+
+func EncodeRawTransaction(tx *Transaction) string {
+	return hex.EncodeToString(tx.Serialize())
+}
+
+func DecodeRawTransaction(raw string) (*Transaction, error) {
+	data, err := hex.DecodeString(strings.TrimSpace(raw))
+	if err != nil {
+		return nil, err
+	}
+
+	var tx Transaction
+	err = gob.NewDecoder(bytes.NewReader(data)).Decode(&tx)
+	if err != nil {
+		return nil, fmt.Errorf("not a raw transaction: %s", err)
+	}
+	if len(tx.Vin) == 0 || len(tx.Vout) == 0 {
+		return nil, errors.New("raw transaction has no inputs or no outputs")
+	}
+
+	return &tx, nil
+}
+
+// FindPrevOutputs looks up the unspent outputs spent by tx, for signing it elsewhere
+func (u UTXOSet) FindPrevOutputs(tx *Transaction) ([]UTXO, error) {
+	var prevOuts []UTXO
+
+	for _, vin := range tx.Vin {
+		outs, ok := u.FindOutputs(vin.Txid)
+		out, unspent := outs.Outputs[vin.Vout]
+		if !ok || !unspent {
+			return nil, fmt.Errorf("input %x:%d isn't an unspent output", vin.Txid, vin.Vout)
+		}
+
+		prevOuts = append(prevOuts, UTXO{Outpoint{vin.Txid, vin.Vout}, out})
+	}
+
+	return prevOuts, nil
+}
+
+func SavePrevOutputs(file string, prevOuts []UTXO) error {
+	var raw []rawPrevOutput
+	for _, prevOut := range prevOuts {
+		raw = append(raw, rawPrevOutput{
+			hex.EncodeToString(prevOut.Txid),
+			prevOut.Vout,
+			hex.EncodeToString(prevOut.Output.ScriptPubKey),
+			prevOut.Output.Value,
+		})
+	}
+
+	content, err := json.MarshalIndent(raw, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(file, append(content, '\n'), 0644)
+}
+
+func LoadPrevOutputs(file string) ([]UTXO, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw []rawPrevOutput
+	if err := json.Unmarshal(content, &raw); err != nil {
+		return nil, err
+	}
+
+	var prevOuts []UTXO
+	for _, r := range raw {
+		txID, err := hex.DecodeString(r.Txid)
+		if err != nil {
+			return nil, fmt.Errorf("previous output %s has an invalid transaction ID", r.Txid)
+		}
+		script, err := hex.DecodeString(r.ScriptPubKey)
+		if err != nil {
+			return nil, fmt.Errorf("previous output %s:%d has an invalid script", r.Txid, r.Vout)
+		}
+
+		prevOuts = append(prevOuts, UTXO{Outpoint{txID, r.Vout}, TXOutput{r.Amount, script}})
+	}
+
+	return prevOuts, nil
+}
+
+// prevTransactions arranges prevOuts the way Verify expects them, as transactions
+// that only have the spent outputs filled in
+func prevTransactions(tx *Transaction, prevOuts []UTXO) (map[string]Transaction, error) {
+	prevTXs := make(map[string]Transaction)
+
+	for _, vin := range tx.Vin {
+		prevOut, ok := findPrevOutput(prevOuts, vin)
+		if !ok {
+			return nil, fmt.Errorf("previous output %x:%d is missing", vin.Txid, vin.Vout)
+		}
+
+		prevTX := prevTXs[hex.EncodeToString(vin.Txid)]
+		prevTX.ID = vin.Txid
+		for len(prevTX.Vout) <= vin.Vout {
+			prevTX.Vout = append(prevTX.Vout, TXOutput{})
+		}
+		prevTX.Vout[vin.Vout] = prevOut
+		prevTXs[hex.EncodeToString(vin.Txid)] = prevTX
+	}
+
+	return prevTXs, nil
+}
+
+func findPrevOutput(prevOuts []UTXO, vin TXInput) (TXOutput, bool) {
+	for _, prevOut := range prevOuts {
+		if bytes.Equal(prevOut.Txid, vin.Txid) && prevOut.Vout == vin.Vout {
+			return prevOut.Output, true
+		}
+	}
+
+	return TXOutput{}, false
+}
+
+// SignRawTransaction signs every pay-to-pubkey-hash input the wallet holds a key for,
+// using only the given previous outputs. It returns whether every input is signed and
+// the complete transaction verifies.
+func (ws *Wallets) SignRawTransaction(tx *Transaction, prevOuts []UTXO, hashType SigHashType) (bool, error) {
+	prevTXs, err := prevTransactions(tx, prevOuts)
+	if err != nil {
+		return false, err
+	}
+
+	spent := 0
+	for _, vin := range tx.Vin {
+		prevOut, _ := findPrevOutput(prevOuts, vin)
+		spent += prevOut.Value
+	}
+	if paid := sumOutputs(tx.Vout); paid > spent {
+		return false, fmt.Errorf("outputs pay %d but the inputs only hold %d", paid, spent)
+	}
+
+	complete := true
+	for inID, vin := range tx.Vin {
+		if len(vin.ScriptSig) > 0 {
+			continue
+		}
+
+		prevOut, _ := findPrevOutput(prevOuts, vin)
+		if !IsP2PKHScript(prevOut.ScriptPubKey) {
+			complete = false
+			continue
+		}
+		wallet := ws.GetWalletByPubKeyHash(ExtractPubKeyHash(prevOut.ScriptPubKey))
+		if wallet == nil {
+			complete = false
+			continue
+		}
+
+		signature := tx.SignInput(inID, prevOut.ScriptPubKey, prevOut.Value, hashType, wallet)
+		tx.Vin[inID].ScriptSig = NewScriptBuilder().AddData(signature).AddData(wallet.PublicKey).Script()
+	}
+
+	if complete && !tx.Verify(prevTXs) {
+		return false, errors.New("signed transaction does not verify")
+	}
+
+	return complete, nil
+}
+
+func sumOutputs(outputs []TXOutput) int {
+	total := 0
+	for _, out := range outputs {
+		total += out.Value
+	}
+
+	return total
+}
+
+// IsSigned reports whether every input of tx has an unlocking script
+func (tx *Transaction) IsSigned() bool {
+	for _, vin := range tx.Vin {
+		if len(vin.ScriptSig) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// signerAddress returns the pay-to-pubkey-hash address that signed input inID, or
+// an empty string when the input isn't signed with a single key
+func (tx *Transaction) signerAddress(inID int) string {
+	pushes, err := PushedData(tx.Vin[inID].ScriptSig)
+	if err != nil || len(pushes) != 2 {
+		return ""
+	}
+
+	scheme := schemeForPubKey(pushes[1])
+	if scheme == nil {
+		return ""
+	}
+
+	return fmt.Sprintf("%s", encodeAddress(scheme.AddressVersion(), util.HashPubKey(pushes[1])))
+}
@@ -0,0 +1,445 @@
+package domain
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/rpc"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The control interface of a running node listens on localhost, on the node port shifted
+// by rpcPortOffset, unless rpclisten is configured
+const rpcPortOffset = 10000
+
+// Clients of the control interface prove they know rpcpassword, or the cookie the node
+// writes on start to a file only the user running it can read, before their first call
+const rpcCookieFile = "rpc_%s.cookie"
+
+type NodeRPC struct {
+	nodeID string
+	bc     *Blockchain
+
+	mu        sync.Mutex
+	wallets   *Wallets
+	lockTimer *time.Timer
+}
+
+type WalletPassphraseArgs struct {
+	Passphrase []byte
+	Timeout    int // Seconds until the wallet locks again
+}
+
+type SendArgs struct {
+	From       string
+	Payments   []Payment
+	LockTime   int64
+	CoinSelect string
+	Inputs     []Outpoint
+	DryRun     bool // Reply with the transaction instead of broadcasting it
+}
+
+type GenerateArgs struct {
+	Address string
+	Blocks  int
+}
+
+type GetBlockTemplateArgs struct {
+	Address string // Paid the block reward, the node's mining address when empty
+}
+
+type SubmitBlockArgs struct {
+	Block []byte // Serialized
+}
+
+type GetPoolSharesArgs struct {
+	Reset bool // Start counting from zero again, after a payout
+}
+
+type SetBanArgs struct {
+	Subnet  string
+	Remove  bool
+	BanTime int64 // Seconds
+}
+
+func rpcAddress(nodeID string) string {
+	if config.RPCListen != "" {
+		return config.RPCListen
+	}
+
+	port, err := strconv.Atoi(nodeID)
+	if err != nil {
+		log.Panicf("NODE_ID %s is not a port number", nodeID)
+	}
+
+	return fmt.Sprintf("localhost:%d", port+rpcPortOffset)
+}
+
+func startRPCServer(nodeID string, bc *Blockchain) {
+	if !config.RPC {
+		return
+	}
+
+	secret := []byte(config.RPCPassword)
+	if len(secret) == 0 {
+		var err error
+		secret, err = createRPCCookie(nodeID)
+		if err != nil {
+			log.Printf("RPC server disabled, writing the cookie failed: %s\n", err)
+			return
+		}
+	}
+
+	service := &NodeRPC{nodeID: nodeID, bc: bc}
+
+	server := rpc.NewServer()
+	err := server.RegisterName("Node", service)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	ln, err := net.Listen(protocol, rpcAddress(nodeID))
+	if err != nil {
+		log.Printf("RPC server disabled: %s\n", err)
+		return
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				log.Printf("RPC server stopped: %s\n", err)
+				return
+			}
+			go func() {
+				if !authenticateRPCClient(conn, secret) {
+					conn.Close()
+					return
+				}
+				server.ServeConn(conn)
+			}()
+		}
+	}()
+}
+
+// DialNode connects to the control interface of the node running with nodeID
+func DialNode(nodeID string) (*rpc.Client, error) {
+	secret := []byte(config.RPCPassword)
+	if len(secret) == 0 {
+		content, err := os.ReadFile(config.dataFile(fmt.Sprintf(rpcCookieFile, nodeID)))
+		if err != nil {
+			return nil, err
+		}
+		secret = []byte(strings.TrimSpace(string(content)))
+	}
+
+	conn, err := net.DialTimeout(protocol, rpcAddress(nodeID), dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(secret)
+	ack := make([]byte, 1)
+	err = conn.SetDeadline(time.Now().Add(readTimeout))
+	if err == nil {
+		_, err = conn.Write(digest[:])
+	}
+	if err == nil {
+		_, err = io.ReadFull(conn, ack)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, errors.New("the node refused the RPC password or cookie")
+	}
+	err = conn.SetDeadline(time.Time{})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return rpc.NewClient(conn), nil
+}
+
+// createRPCCookie writes a new random cookie for the clients of the control interface
+func createRPCCookie(nodeID string) ([]byte, error) {
+	raw := make([]byte, 32)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return nil, err
+	}
+	cookie := []byte(hex.EncodeToString(raw))
+
+	file := config.dataFile(fmt.Sprintf(rpcCookieFile, nodeID))
+	os.Remove(file)
+	err = os.WriteFile(file, append(cookie, '\n'), 0600)
+
+	return cookie, err
+}
+
+// authenticateRPCClient reads the digest of the secret a client sends first and
+// acknowledges it when it matches
+func authenticateRPCClient(conn net.Conn, secret []byte) bool {
+	expected := sha256.Sum256(secret)
+	digest := make([]byte, len(expected))
+
+	err := conn.SetDeadline(time.Now().Add(readTimeout))
+	if err == nil {
+		_, err = io.ReadFull(conn, digest)
+	}
+	if err != nil || subtle.ConstantTimeCompare(digest, expected[:]) != 1 {
+		log.Printf("Refused an RPC client at %s, wrong password or cookie\n", conn.RemoteAddr())
+		return false
+	}
+	if _, err := conn.Write([]byte{1}); err != nil {
+		return false
+	}
+
+	return conn.SetDeadline(time.Time{}) == nil
+}
+
+// WalletPassphrase reloads the wallet file and keeps it unlocked for Timeout seconds
+func (n *NodeRPC) WalletPassphrase(args WalletPassphraseArgs, reply *struct{}) error {
+	if args.Timeout <= 0 {
+		return errors.New("timeout must be a positive number of seconds")
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	wallets, err := NewWallets(n.nodeID)
+	if err != nil {
+		return err
+	}
+	if err := wallets.Unlock(args.Passphrase); err != nil {
+		return err
+	}
+
+	n.lockWallet()
+	n.wallets = wallets
+	n.lockTimer = time.AfterFunc(time.Duration(args.Timeout)*time.Second, func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+
+		if n.wallets == wallets {
+			n.lockWallet()
+			infof("Wallet locked after timeout\n")
+		}
+	})
+
+	return nil
+}
+
+func (n *NodeRPC) WalletLock(args struct{}, reply *struct{}) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.lockWallet()
+
+	return nil
+}
+
+// Send signs a payment to one or more recipients with the unlocked wallet and broadcasts
+// it, replying with the transaction ID, or with the whole transaction on a dry run
+func (n *NodeRPC) Send(args SendArgs, reply *string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.wallets == nil {
+		return errWalletLocked
+	}
+
+	selector, err := GetCoinSelector(args.CoinSelect)
+	if err != nil {
+		return err
+	}
+
+	var tx *Transaction
+	err = recoverPanic(func() {
+		UTXOSet := UTXOSet{n.bc}
+		coins := CoinSelection{selector, args.Inputs}
+		tx = NewUTXOTransaction(n.wallets, args.From, args.Payments, args.LockTime, coins, &UTXOSet)
+		if n.wallets.HasSeed() && !args.DryRun {
+			if err := n.saveWallets(); err != nil {
+				log.Panic(err)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if args.DryRun {
+		*reply = tx.String()
+		return nil
+	}
+
+	// The node's own transactions enter its mempool and are relayed like any other
+	if !acceptTransaction(*tx, nil, nodeAddress, n.bc) {
+		return fmt.Errorf("transaction %x was rejected, see the node log", tx.ID)
+	}
+	*reply = fmt.Sprintf("%x", tx.ID)
+
+	return nil
+}
+
+// Generate mines blocks on demand and announces them, replying with their hashes
+func (n *NodeRPC) Generate(args GenerateArgs, reply *[]string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	var hashes [][]byte
+	chainLock.Lock()
+	err := recoverPanic(func() {
+		hashes = n.bc.Generate(args.Address, args.Blocks)
+	})
+	chainLock.Unlock()
+	if err != nil {
+		return err
+	}
+	notifyMiner()
+
+	for _, node := range knownNodeList() {
+		if node != nodeAddress {
+			sendInv(node, "block", hashes)
+		}
+	}
+	for _, hash := range hashes {
+		*reply = append(*reply, fmt.Sprintf("%x", hash))
+	}
+
+	return nil
+}
+
+// GetBlockTemplate replies with a block on the tip for external mining software,
+// which only has to find the nonce
+func (n *NodeRPC) GetBlockTemplate(args GetBlockTemplateArgs, reply *BlockTemplate) error {
+	address := args.Address
+	if address == "" {
+		address = miningAddress
+	}
+	if address == "" {
+		address = config.Miner
+	}
+	if address == "" {
+		return errors.New("no address to pay the block reward to, pass one or start the node with -miner")
+	}
+	if _, err := ParseAddress(address); err != nil {
+		return err
+	}
+
+	return recoverPanic(func() {
+		*reply = *NewBlockTemplate(n.bc, address)
+	})
+}
+
+// SubmitBlock adds a block mined on the tip and announces it, replying with its hash
+func (n *NodeRPC) SubmitBlock(args SubmitBlockArgs, reply *string) error {
+	var block *Block
+	if err := recoverPanic(func() { block = DeserializeBlock(args.Block) }); err != nil {
+		return fmt.Errorf("undecodable block: %s", err)
+	}
+
+	if err := submitBlock(block, n.bc); err != nil {
+		return err
+	}
+	*reply = fmt.Sprintf("%x", block.Hash)
+
+	return nil
+}
+
+// GetPoolShares replies with the share counts of the Stratum workers
+func (n *NodeRPC) GetPoolShares(args GetPoolSharesArgs, reply *[]WorkerShares) error {
+	if poolShares == nil {
+		return errors.New("the Stratum server isn't running")
+	}
+
+	shares, err := poolShares.List(args.Reset)
+	*reply = shares
+
+	return err
+}
+
+func (n *NodeRPC) GetPeerInfo(args struct{}, reply *[]PeerInfo) error {
+	*reply = peerInfos()
+
+	return nil
+}
+
+func (n *NodeRPC) ListBanned(args struct{}, reply *[]BanEntry) error {
+	*reply = banList.List()
+
+	return nil
+}
+
+// SetBan bans or unbans an IP or subnet of the running node
+func (n *NodeRPC) SetBan(args SetBanArgs, reply *struct{}) error {
+	if args.Remove {
+		return banList.Unban(args.Subnet)
+	}
+	if args.BanTime <= 0 {
+		return errors.New("ban time must be a positive number of seconds")
+	}
+
+	subnet, err := banList.Ban(args.Subnet, time.Now().Add(time.Duration(args.BanTime)*time.Second), "manually banned")
+	if err != nil {
+		return err
+	}
+	infof("Banned %s\n", subnet)
+
+	return nil
+}
+
+func (n *NodeRPC) ClearBanned(args struct{}, reply *struct{}) error {
+	return banList.Clear()
+}
+
+// saveWallets writes the unlocked wallet back to its file, merged with what the CLI
+// added to the file since walletpassphrase
+func (n *NodeRPC) saveWallets() error {
+	current, err := NewWallets(n.nodeID)
+	if err != nil {
+		return err
+	}
+	if err := current.unlockWithKey(n.wallets.key); err != nil {
+		return errors.New("the wallet passphrase changed, unlock the wallet again with walletpassphrase")
+	}
+	n.wallets.merge(current)
+	current.Lock()
+
+	n.wallets.SaveToFile(n.nodeID)
+
+	return nil
+}
+
+func (n *NodeRPC) lockWallet() {
+	if n.lockTimer != nil {
+		n.lockTimer.Stop()
+		n.lockTimer = nil
+	}
+	if n.wallets != nil {
+		n.wallets.Lock()
+		n.wallets = nil
+	}
+}
+
+// recoverPanic turns the panics used for errors throughout the package into an error,
+// so a bad request doesn't bring the node down
+func recoverPanic(f func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	f()
+
+	return nil
+}
@@ -0,0 +1,26 @@
+package domain
+
+import (
+	"testing"
+)
+
+func TestRPCAuthentication(t *testing.T) {
+	startRPCServer("3002", testChain)
+
+	client, err := DialNode("3002")
+	if err != nil {
+		t.Fatalf("dialing with the cookie failed: %s", err)
+	}
+	var peers []PeerInfo
+	if err := client.Call("Node.GetPeerInfo", struct{}{}, &peers); err != nil {
+		t.Errorf("call with the cookie failed: %s", err)
+	}
+	client.Close()
+
+	config.RPCPassword = "wrong"
+	defer func() { config.RPCPassword = "" }()
+	if client, err := DialNode("3002"); err == nil {
+		client.Close()
+		t.Error("dialing with a wrong password succeeded")
+	}
+}
@@ -0,0 +1,678 @@
+package domain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/aleksannder/gochain/util"
+	"strings"
+)
+
+// Opcodes are a subset of Bitcoin script and use the same byte values
+const (
+	op0                   = 0x00
+	opPushData1           = 0x4c
+	opPushData2           = 0x4d
+	op1                   = 0x51
+	op16                  = 0x60
+	opVerify              = 0x69
+	opReturn              = 0x6a
+	opDrop                = 0x75
+	opDup                 = 0x76
+	opEqual               = 0x87
+	opEqualVerify         = 0x88
+	opHash160             = 0xa9
+	opCheckSig            = 0xac
+	opCheckSigVerify      = 0xad
+	opCheckMultiSig       = 0xae
+	opCheckMultiSigVerify = 0xaf
+	opCheckLockTimeVerify = 0xb1
+)
+
+// Execution limits
+const (
+	maxScriptSize         = 10000
+	maxScriptElementSize  = 520
+	maxOpsPerScript       = 201
+	maxStackSize          = 1000
+	maxPubKeysPerMultiSig = 20
+	maxScriptNumLen       = 4
+	lockTimeNumLen        = 5
+)
+
+var opcodeNames = map[byte]string{
+	op0:                   "OP_0",
+	opPushData1:           "OP_PUSHDATA1",
+	opPushData2:           "OP_PUSHDATA2",
+	opVerify:              "OP_VERIFY",
+	opReturn:              "OP_RETURN",
+	opDrop:                "OP_DROP",
+	opDup:                 "OP_DUP",
+	opEqual:               "OP_EQUAL",
+	opEqualVerify:         "OP_EQUALVERIFY",
+	opHash160:             "OP_HASH160",
+	opCheckSig:            "OP_CHECKSIG",
+	opCheckSigVerify:      "OP_CHECKSIGVERIFY",
+	opCheckMultiSig:       "OP_CHECKMULTISIG",
+	opCheckMultiSigVerify: "OP_CHECKMULTISIGVERIFY",
+	opCheckLockTimeVerify: "OP_CHECKLOCKTIMEVERIFY",
+}
+
+var (
+	errScriptTooLarge    = errors.New("script is too large")
+	errElementTooLarge   = errors.New("push exceeds max element size")
+	errTooManyOps        = errors.New("too many operations in script")
+	errStackOverflow     = errors.New("stack size limit exceeded")
+	errStackUnderflow    = errors.New("not enough items on the stack")
+	errMalformedPush     = errors.New("malformed push data")
+	errVerifyFailed      = errors.New("verify failed")
+	errEarlyReturn       = errors.New("script returned early")
+	errEvalFalse         = errors.New("script evaluated to false")
+	errNotPushOnly       = errors.New("unlocking script is not push only")
+	errUnlockingLockTime = errors.New("lock time requirement not satisfied")
+	errNegativeLockTime  = errors.New("negative lock time")
+	errInvalidPubKeyNum  = errors.New("invalid public key count")
+	errInvalidSigNum     = errors.New("invalid signature count")
+	errScriptNumTooLong  = errors.New("script number is too long")
+	errSigNullFail       = errors.New("non-empty signature failed verification")
+)
+
+// SigChecker connects the script engine to the transaction being validated
+type SigChecker interface {
+	CheckSig(sig, pubKey, subScript []byte) bool
+	CheckLockTime(lockTime int64) bool
+}
+
+// DeferringSigChecker may postpone verification of CHECKSIG signatures, for example to
+// batch them. This is only sound because a failing non-empty signature fails the script.
+type DeferringSigChecker interface {
+	SigChecker
+	DeferSig(sig, pubKey, subScript []byte) bool
+}
+
+type parsedOp struct {
+	opcode byte
+	data   []byte
+}
+
+type ScriptBuilder struct {
+	script []byte
+}
+
+func NewScriptBuilder() *ScriptBuilder {
+	return &ScriptBuilder{}
+}
+
+func (b *ScriptBuilder) AddOp(opcode byte) *ScriptBuilder {
+	b.script = append(b.script, opcode)
+
+	return b
+}
+
+func (b *ScriptBuilder) AddData(data []byte) *ScriptBuilder {
+	dataLen := len(data)
+
+	switch {
+	case dataLen < opPushData1:
+		b.script = append(b.script, byte(dataLen))
+	case dataLen <= 0xff:
+		b.script = append(b.script, opPushData1, byte(dataLen))
+	default:
+		var lenBytes [2]byte
+		binary.LittleEndian.PutUint16(lenBytes[:], uint16(dataLen))
+		b.script = append(b.script, opPushData2)
+		b.script = append(b.script, lenBytes[:]...)
+	}
+	b.script = append(b.script, data...)
+
+	return b
+}
+
+func (b *ScriptBuilder) AddInt(n int64) *ScriptBuilder {
+	if n == 0 {
+		return b.AddOp(op0)
+	}
+	if n >= 1 && n <= 16 {
+		return b.AddOp(byte(op1 - 1 + n))
+	}
+
+	return b.AddData(scriptNumBytes(n))
+}
+
+func (b *ScriptBuilder) Script() []byte {
+	return b.script
+}
+
+// Standard templates
+
+func NewP2PKHScript(pubKeyHash []byte) []byte {
+	return NewScriptBuilder().
+		AddOp(opDup).
+		AddOp(opHash160).
+		AddData(pubKeyHash).
+		AddOp(opEqualVerify).
+		AddOp(opCheckSig).
+		Script()
+}
+
+func NewP2SHScript(scriptHash []byte) []byte {
+	return NewScriptBuilder().
+		AddOp(opHash160).
+		AddData(scriptHash).
+		AddOp(opEqual).
+		Script()
+}
+
+func IsP2PKHScript(script []byte) bool {
+	return len(script) == 25 &&
+		script[0] == opDup &&
+		script[1] == opHash160 &&
+		script[2] == 20 &&
+		script[23] == opEqualVerify &&
+		script[24] == opCheckSig
+}
+
+func IsP2SHScript(script []byte) bool {
+	return len(script) == 23 &&
+		script[0] == opHash160 &&
+		script[1] == 20 &&
+		script[22] == opEqual
+}
+
+// ExtractPubKeyHash returns the hash a P2PKH script is locked to, or nil for any other script
+func ExtractPubKeyHash(script []byte) []byte {
+	if !IsP2PKHScript(script) {
+		return nil
+	}
+
+	return script[3:23]
+}
+
+func ExtractScriptHash(script []byte) []byte {
+	if !IsP2SHScript(script) {
+		return nil
+	}
+
+	return script[2:22]
+}
+
+// PushedData returns the data pushes of a push only script, such as an unlocking script
+func PushedData(script []byte) ([][]byte, error) {
+	ops, err := parseScript(script)
+	if err != nil {
+		return nil, err
+	}
+
+	var pushes [][]byte
+	for _, op := range ops {
+		if !isPushOp(op.opcode) {
+			return nil, errNotPushOnly
+		}
+		pushes = append(pushes, op.pushedValue())
+	}
+
+	return pushes, nil
+}
+
+func DisasmScript(script []byte) string {
+	ops, err := parseScript(script)
+	if err != nil {
+		return fmt.Sprintf("[error: %s] %x", err, script)
+	}
+
+	var parts []string
+	for _, op := range ops {
+		if op.opcode > op0 && op.opcode <= opPushData2 {
+			parts = append(parts, hex.EncodeToString(op.data))
+		} else {
+			parts = append(parts, opcodeName(op.opcode))
+		}
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func opcodeName(opcode byte) string {
+	if opcode >= op1 && opcode <= op16 {
+		return fmt.Sprintf("OP_%d", opcode-op1+1)
+	}
+	if name, ok := opcodeNames[opcode]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("OP_UNKNOWN%d", opcode)
+}
+
+// Interpreter
+
+func parseScript(script []byte) ([]parsedOp, error) {
+	var ops []parsedOp
+
+	if len(script) > maxScriptSize {
+		return nil, errScriptTooLarge
+	}
+
+	for i := 0; i < len(script); {
+		opcode := script[i]
+		i++
+
+		dataLen := 0
+		switch {
+		case opcode > op0 && opcode < opPushData1:
+			dataLen = int(opcode)
+		case opcode == opPushData1:
+			if i+1 > len(script) {
+				return nil, errMalformedPush
+			}
+			dataLen = int(script[i])
+			i++
+		case opcode == opPushData2:
+			if i+2 > len(script) {
+				return nil, errMalformedPush
+			}
+			dataLen = int(binary.LittleEndian.Uint16(script[i : i+2]))
+			i += 2
+		}
+
+		if i+dataLen > len(script) {
+			return nil, errMalformedPush
+		}
+		if dataLen > maxScriptElementSize {
+			return nil, errElementTooLarge
+		}
+
+		ops = append(ops, parsedOp{opcode, script[i : i+dataLen]})
+		i += dataLen
+	}
+
+	return ops, nil
+}
+
+func isPushOp(opcode byte) bool {
+	return opcode <= opPushData2 || (opcode >= op1 && opcode <= op16)
+}
+
+func (op parsedOp) pushedValue() []byte {
+	if op.opcode >= op1 && op.opcode <= op16 {
+		return scriptNumBytes(int64(op.opcode - op1 + 1))
+	}
+
+	return op.data
+}
+
+type scriptEngine struct {
+	stack   [][]byte
+	ops     int
+	checker SigChecker
+}
+
+// ExecuteScript runs the unlocking script followed by the locking script and succeeds
+// only if the locking script leaves a true value on the stack. Pay-to-script-hash
+// outputs additionally execute the redeem script pushed last by the unlocking script.
+func ExecuteScript(scriptSig, scriptPubKey []byte, checker SigChecker) error {
+	engine := &scriptEngine{checker: checker}
+
+	if _, err := PushedData(scriptSig); err != nil {
+		return err
+	}
+
+	err := engine.run(scriptSig)
+	if err != nil {
+		return err
+	}
+
+	sigStack := make([][]byte, len(engine.stack))
+	copy(sigStack, engine.stack)
+
+	err = engine.run(scriptPubKey)
+	if err != nil {
+		return err
+	}
+	if err = engine.checkTopTrue(); err != nil {
+		return err
+	}
+
+	if !IsP2SHScript(scriptPubKey) {
+		return nil
+	}
+	if len(sigStack) == 0 {
+		return errStackUnderflow
+	}
+
+	redeemScript := sigStack[len(sigStack)-1]
+	engine.stack = sigStack[:len(sigStack)-1]
+	engine.ops = 0
+
+	err = engine.run(redeemScript)
+	if err != nil {
+		return err
+	}
+
+	return engine.checkTopTrue()
+}
+
+func (e *scriptEngine) checkTopTrue() error {
+	if len(e.stack) == 0 || !castToBool(e.stack[len(e.stack)-1]) {
+		return errEvalFalse
+	}
+
+	return nil
+}
+
+func (e *scriptEngine) run(script []byte) error {
+	ops, err := parseScript(script)
+	if err != nil {
+		return err
+	}
+
+	for _, op := range ops {
+		if !isPushOp(op.opcode) {
+			e.ops++
+			if e.ops > maxOpsPerScript {
+				return errTooManyOps
+			}
+		}
+
+		err = e.step(op, script)
+		if err != nil {
+			return fmt.Errorf("%s: %w", opcodeName(op.opcode), err)
+		}
+
+		if len(e.stack) > maxStackSize {
+			return errStackOverflow
+		}
+	}
+
+	return nil
+}
+
+func (e *scriptEngine) step(op parsedOp, script []byte) error {
+	if isPushOp(op.opcode) {
+		e.push(op.pushedValue())
+		return nil
+	}
+
+	switch op.opcode {
+	case opVerify:
+		top, err := e.pop()
+		if err != nil {
+			return err
+		}
+		if !castToBool(top) {
+			return errVerifyFailed
+		}
+
+	case opReturn:
+		return errEarlyReturn
+
+	case opDrop:
+		_, err := e.pop()
+		return err
+
+	case opDup:
+		top, err := e.peek()
+		if err != nil {
+			return err
+		}
+		e.push(top)
+
+	case opEqual, opEqualVerify:
+		a, err := e.pop()
+		if err != nil {
+			return err
+		}
+		b, err := e.pop()
+		if err != nil {
+			return err
+		}
+		equal := bytes.Equal(a, b)
+		if op.opcode == opEqualVerify {
+			if !equal {
+				return errVerifyFailed
+			}
+			return nil
+		}
+		e.push(boolBytes(equal))
+
+	case opHash160:
+		top, err := e.pop()
+		if err != nil {
+			return err
+		}
+		e.push(util.HashPubKey(top))
+
+	case opCheckSig, opCheckSigVerify:
+		pubKey, err := e.pop()
+		if err != nil {
+			return err
+		}
+		sig, err := e.pop()
+		if err != nil {
+			return err
+		}
+		valid := len(sig) > 0 && e.checkSig(sig, pubKey, script)
+		if !valid && len(sig) > 0 {
+			return errSigNullFail
+		}
+		if op.opcode == opCheckSigVerify {
+			if !valid {
+				return errVerifyFailed
+			}
+			return nil
+		}
+		e.push(boolBytes(valid))
+
+	case opCheckMultiSig, opCheckMultiSigVerify:
+		valid, err := e.checkMultiSig(script)
+		if err != nil {
+			return err
+		}
+		if op.opcode == opCheckMultiSigVerify {
+			if !valid {
+				return errVerifyFailed
+			}
+			return nil
+		}
+		e.push(boolBytes(valid))
+
+	case opCheckLockTimeVerify:
+		top, err := e.peek()
+		if err != nil {
+			return err
+		}
+		lockTime, err := parseScriptNum(top, lockTimeNumLen)
+		if err != nil {
+			return err
+		}
+		if lockTime < 0 {
+			return errNegativeLockTime
+		}
+		if !e.checker.CheckLockTime(lockTime) {
+			return errUnlockingLockTime
+		}
+
+	default:
+		return fmt.Errorf("unsupported opcode 0x%02x", op.opcode)
+	}
+
+	return nil
+}
+
+// checkMultiSig expects: <dummy> <sig1> ... <sigM> <M> <pubKey1> ... <pubKeyN> <N>.
+// Signatures have to appear in the same order as their public keys.
+func (e *scriptEngine) checkMultiSig(script []byte) (bool, error) {
+	n, err := e.popInt()
+	if err != nil {
+		return false, err
+	}
+	if n < 0 || n > maxPubKeysPerMultiSig {
+		return false, errInvalidPubKeyNum
+	}
+	e.ops += int(n)
+	if e.ops > maxOpsPerScript {
+		return false, errTooManyOps
+	}
+
+	pubKeys := make([][]byte, n)
+	for i := range pubKeys {
+		pubKeys[i], err = e.pop()
+		if err != nil {
+			return false, err
+		}
+	}
+
+	m, err := e.popInt()
+	if err != nil {
+		return false, err
+	}
+	if m < 0 || m > n {
+		return false, errInvalidSigNum
+	}
+
+	sigs := make([][]byte, m)
+	for i := range sigs {
+		sigs[i], err = e.pop()
+		if err != nil {
+			return false, err
+		}
+	}
+
+	// Mirrors Bitcoin's off-by-one CHECKMULTISIG bug, the extra element must be empty
+	dummy, err := e.pop()
+	if err != nil {
+		return false, err
+	}
+	if len(dummy) != 0 {
+		return false, errors.New("multisig dummy element must be empty")
+	}
+
+	// Both slices were popped in reverse, so walk them from the end
+	sigIdx, keyIdx := len(sigs)-1, len(pubKeys)-1
+	for sigIdx >= 0 {
+		if sigIdx > keyIdx {
+			return false, nil
+		}
+		if len(sigs[sigIdx]) > 0 && e.checker.CheckSig(sigs[sigIdx], pubKeys[keyIdx], script) {
+			sigIdx--
+		}
+		keyIdx--
+	}
+
+	return true, nil
+}
+
+func (e *scriptEngine) checkSig(sig, pubKey, script []byte) bool {
+	if deferring, ok := e.checker.(DeferringSigChecker); ok {
+		return deferring.DeferSig(sig, pubKey, script)
+	}
+
+	return e.checker.CheckSig(sig, pubKey, script)
+}
+
+func (e *scriptEngine) push(data []byte) {
+	e.stack = append(e.stack, data)
+}
+
+func (e *scriptEngine) pop() ([]byte, error) {
+	if len(e.stack) == 0 {
+		return nil, errStackUnderflow
+	}
+	top := e.stack[len(e.stack)-1]
+	e.stack = e.stack[:len(e.stack)-1]
+
+	return top, nil
+}
+
+func (e *scriptEngine) peek() ([]byte, error) {
+	if len(e.stack) == 0 {
+		return nil, errStackUnderflow
+	}
+
+	return e.stack[len(e.stack)-1], nil
+}
+
+func (e *scriptEngine) popInt() (int64, error) {
+	top, err := e.pop()
+	if err != nil {
+		return 0, err
+	}
+
+	return parseScriptNum(top, maxScriptNumLen)
+}
+
+// Script numbers are little endian with the sign in the most significant bit
+
+func scriptNumBytes(n int64) []byte {
+	if n == 0 {
+		return []byte{}
+	}
+
+	negative := n < 0
+	abs := n
+	if negative {
+		abs = -n
+	}
+
+	var result []byte
+	for abs > 0 {
+		result = append(result, byte(abs&0xff))
+		abs >>= 8
+	}
+
+	if result[len(result)-1]&0x80 != 0 {
+		extra := byte(0x00)
+		if negative {
+			extra = 0x80
+		}
+		result = append(result, extra)
+	} else if negative {
+		result[len(result)-1] |= 0x80
+	}
+
+	return result
+}
+
+func parseScriptNum(data []byte, maxLen int) (int64, error) {
+	if len(data) > maxLen {
+		return 0, errScriptNumTooLong
+	}
+	if len(data) == 0 {
+		return 0, nil
+	}
+
+	var result int64
+	for i, b := range data {
+		result |= int64(b) << uint(8*i)
+	}
+
+	if data[len(data)-1]&0x80 != 0 {
+		result &= ^(int64(0x80) << uint(8*(len(data)-1)))
+		return -result, nil
+	}
+
+	return result, nil
+}
+
+func castToBool(data []byte) bool {
+	for i, b := range data {
+		if b != 0 {
+			// Negative zero is still false
+			if i == len(data)-1 && b == 0x80 {
+				return false
+			}
+			return true
+		}
+	}
+
+	return false
+}
+
+func boolBytes(value bool) []byte {
+	if value {
+		return []byte{1}
+	}
+
+	return []byte{}
+}
@@ -0,0 +1,224 @@
+package domain
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/aleksannder/gochain/util"
+)
+
+// errAnyScript stands for failures the interpreter has no sentinel error for
+var errAnyScript = errors.New("any error")
+
+// testSigChecker accepts "sig" followed by the public key as its signature and lock
+// times up to lockTime
+type testSigChecker struct {
+	lockTime int64
+}
+
+func (c testSigChecker) CheckSig(sig, pubKey, subScript []byte) bool {
+	return bytes.Equal(sig, testSig(pubKey))
+}
+
+func (c testSigChecker) CheckLockTime(lockTime int64) bool {
+	return lockTime <= c.lockTime
+}
+
+func testSig(pubKey []byte) []byte {
+	return append([]byte("sig"), pubKey...)
+}
+
+func testPubKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 33)
+}
+
+func pushes(data ...[]byte) []byte {
+	builder := NewScriptBuilder()
+	for _, d := range data {
+		builder.AddData(d)
+	}
+
+	return builder.Script()
+}
+
+func repeatOp(builder *ScriptBuilder, opcode byte, count int) *ScriptBuilder {
+	for i := 0; i < count; i++ {
+		builder.AddOp(opcode)
+	}
+
+	return builder
+}
+
+func TestExecuteScript(t *testing.T) {
+	pk1, pk2, pk3 := testPubKey(1), testPubKey(2), testPubKey(3)
+	sig1, sig2, sig3 := testSig(pk1), testSig(pk2), testSig(pk3)
+
+	p2pkh := NewP2PKHScript(util.HashPubKey(pk1))
+	multiSig, err := NewMultiSigScript(2, [][]byte{pk1, pk2, pk3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	multiSigVerify := append(append([]byte{}, multiSig[:len(multiSig)-1]...), opCheckMultiSigVerify, op1)
+	p2sh := NewP2SHScript(util.HashPubKey(multiSig))
+	cltv := func(lockTime []byte) []byte {
+		return append(NewScriptBuilder().AddData(lockTime).AddOp(opCheckLockTimeVerify).AddOp(opDrop).Script(), p2pkh...)
+	}
+	// Large pushes that are dropped again, padded with OP_1 to maxScriptSize
+	maxSize := NewScriptBuilder()
+	for len(maxSize.Script())+503 <= maxScriptSize {
+		maxSize.AddData(make([]byte, 500)).AddOp(opDrop)
+	}
+	repeatOp(maxSize, op1, maxScriptSize-len(maxSize.Script()))
+	// multiSigOps runs dups operations before a 1 of 20 multisig, whose keys count as operations
+	multiSigOps := func(dups int) []byte {
+		builder := repeatOp(NewScriptBuilder().AddInt(1), opDup, dups).AddInt(0).AddData(sig1).AddInt(1).AddData(pk1)
+		for i := 1; i < maxPubKeysPerMultiSig; i++ {
+			builder.AddData(testPubKey(byte(10 + i)))
+		}
+		return builder.AddInt(maxPubKeysPerMultiSig).AddOp(opCheckMultiSig).Script()
+	}
+	tooManyKeys := NewScriptBuilder().AddInt(1)
+	for i := 0; i <= maxPubKeysPerMultiSig; i++ {
+		tooManyKeys.AddData(testPubKey(byte(i)))
+	}
+	tooManyKeys.AddInt(maxPubKeysPerMultiSig + 1).AddOp(opCheckMultiSig)
+
+	tests := []struct {
+		name         string
+		scriptSig    []byte
+		scriptPubKey []byte
+		err          error
+	}{
+		{"p2pkh", pushes(sig1, pk1), p2pkh, nil},
+		{"p2pkh wrong key", pushes(sig2, pk2), p2pkh, errVerifyFailed},
+		{"p2pkh bad signature", pushes(sig2, pk1), p2pkh, errSigNullFail},
+		{"p2pkh empty signature", pushes([]byte{}, pk1), p2pkh, errEvalFalse},
+		{"p2pkh missing key", pushes(sig1), p2pkh, errVerifyFailed},
+		{"p2pkh empty unlocking script", nil, p2pkh, errStackUnderflow},
+		{"unlocking script not push only", append(pushes(sig1, pk1), opDup), p2pkh, errNotPushOnly},
+
+		{"checksigverify", pushes(sig1), NewScriptBuilder().AddData(pk1).AddOp(opCheckSigVerify).AddInt(1).Script(), nil},
+		{"checksigverify bad signature", pushes(sig2), NewScriptBuilder().AddData(pk1).AddOp(opCheckSigVerify).AddInt(1).Script(), errSigNullFail},
+		{"checksigverify empty signature", pushes([]byte{}), NewScriptBuilder().AddData(pk1).AddOp(opCheckSigVerify).AddInt(1).Script(), errVerifyFailed},
+
+		{"multisig", pushes([]byte{}, sig1, sig3), multiSig, nil},
+		{"multisig every key", pushes([]byte{}, sig2, sig3), multiSig, nil},
+		{"multisig out of key order", pushes([]byte{}, sig3, sig1), multiSig, errEvalFalse},
+		{"multisig same signature twice", pushes([]byte{}, sig1, sig1), multiSig, errEvalFalse},
+		{"multisig bad signature", pushes([]byte{}, sig1, testSig(testPubKey(9))), multiSig, errEvalFalse},
+		{"multisig non-empty dummy", pushes([]byte{1}, sig1, sig3), multiSig, errAnyScript},
+		{"multisig missing dummy", pushes(sig1, sig3), multiSig, errStackUnderflow},
+		{"multisig too many keys", pushes([]byte{}, sig1), tooManyKeys.Script(), errInvalidPubKeyNum},
+		{"multisig more signatures than keys", pushes([]byte{}, sig1, sig2), NewScriptBuilder().AddInt(2).AddData(pk1).AddInt(1).AddOp(opCheckMultiSig).Script(), errInvalidSigNum},
+		{"checkmultisigverify", pushes([]byte{}, sig1, sig2), multiSigVerify, nil},
+		{"checkmultisigverify bad signatures", pushes([]byte{}, sig2, sig1), multiSigVerify, errVerifyFailed},
+
+		{"p2sh multisig", pushes([]byte{}, sig1, sig2, multiSig), p2sh, nil},
+		{"p2sh wrong redeem script", pushes([]byte{}, sig1, sig2, p2pkh), p2sh, errEvalFalse},
+		{"p2sh redeem script fails", pushes([]byte{}, sig2, sig1, multiSig), p2sh, errEvalFalse},
+		{"p2sh no redeem script", nil, p2sh, errStackUnderflow},
+
+		{"cltv reached", pushes(sig1, pk1), cltv(scriptNumBytes(100)), nil},
+		{"cltv not reached", pushes(sig1, pk1), cltv(scriptNumBytes(101)), errUnlockingLockTime},
+		{"cltv negative", pushes(sig1, pk1), cltv(scriptNumBytes(-1)), errNegativeLockTime},
+		{"cltv five byte lock time", pushes(sig1, pk1), cltv([]byte{0, 0, 0, 0, 0}), nil},
+		{"cltv six byte lock time", pushes(sig1, pk1), cltv([]byte{0, 0, 0, 0, 0, 0}), errScriptNumTooLong},
+		{"cltv empty stack", nil, []byte{opCheckLockTimeVerify}, errStackUnderflow},
+
+		{"script at size limit", nil, maxSize.Script(), nil},
+		{"script above size limit", nil, append(maxSize.Script(), op1), errScriptTooLarge},
+		{"element at size limit", pushes(make([]byte, maxScriptElementSize)), []byte{opDrop, op1}, nil},
+		{"element above size limit", pushes(make([]byte, maxScriptElementSize+1)), []byte{op1}, errElementTooLarge},
+		{"ops at limit", nil, repeatOp(NewScriptBuilder().AddInt(1), opDup, maxOpsPerScript).Script(), nil},
+		{"ops above limit", nil, repeatOp(NewScriptBuilder().AddInt(1), opDup, maxOpsPerScript+1).Script(), errTooManyOps},
+		{"multisig keys count as ops at limit", nil, multiSigOps(maxOpsPerScript - maxPubKeysPerMultiSig - 1), nil},
+		{"multisig keys count as ops above limit", nil, multiSigOps(maxOpsPerScript - maxPubKeysPerMultiSig), errTooManyOps},
+		{"stack at limit", nil, bytes.Repeat([]byte{op1}, maxStackSize), nil},
+		{"stack above limit", nil, bytes.Repeat([]byte{op1}, maxStackSize+1), errStackOverflow},
+		{"truncated push", nil, []byte{5, 1, 2}, errMalformedPush},
+		{"truncated pushdata1", nil, []byte{opPushData1}, errMalformedPush},
+		{"truncated pushdata2", nil, []byte{opPushData2, 1}, errMalformedPush},
+		{"op_return", nil, []byte{op1, opReturn}, errEarlyReturn},
+		{"verify false", nil, []byte{op0, opVerify, op1}, errVerifyFailed},
+		{"unsupported opcode", nil, []byte{op1, 0xff}, errAnyScript},
+		{"empty result", nil, nil, errEvalFalse},
+		{"negative zero is false", pushes([]byte{0x80}), nil, errEvalFalse},
+	}
+
+	for _, test := range tests {
+		err := ExecuteScript(test.scriptSig, test.scriptPubKey, testSigChecker{100})
+		switch {
+		case test.err == nil && err != nil:
+			t.Errorf("%s: %s", test.name, err)
+		case test.err == errAnyScript && err == nil:
+			t.Errorf("%s: succeeded, expected an error", test.name)
+		case test.err != nil && test.err != errAnyScript && !errors.Is(err, test.err):
+			t.Errorf("%s: got %v, expected %v", test.name, err, test.err)
+		}
+	}
+}
+
+func TestScriptNum(t *testing.T) {
+	tests := []struct {
+		n       int64
+		encoded []byte
+	}{
+		{0, []byte{}},
+		{1, []byte{0x01}},
+		{-1, []byte{0x81}},
+		{16, []byte{0x10}},
+		{127, []byte{0x7f}},
+		{-127, []byte{0xff}},
+		{128, []byte{0x80, 0x00}},
+		{-128, []byte{0x80, 0x80}},
+		{255, []byte{0xff, 0x00}},
+		{256, []byte{0x00, 0x01}},
+		{-32768, []byte{0x00, 0x80, 0x80}},
+		{2147483647, []byte{0xff, 0xff, 0xff, 0x7f}},
+		{-2147483647, []byte{0xff, 0xff, 0xff, 0xff}},
+	}
+
+	for _, test := range tests {
+		if encoded := scriptNumBytes(test.n); !bytes.Equal(encoded, test.encoded) {
+			t.Errorf("scriptNumBytes(%d) = %x, expected %x", test.n, encoded, test.encoded)
+		}
+		n, err := parseScriptNum(test.encoded, maxScriptNumLen)
+		if err != nil || n != test.n {
+			t.Errorf("parseScriptNum(%x) = %d, %v, expected %d", test.encoded, n, err, test.n)
+		}
+	}
+
+	if _, err := parseScriptNum([]byte{0, 0, 0, 0, 1}, maxScriptNumLen); !errors.Is(err, errScriptNumTooLong) {
+		t.Errorf("parseScriptNum of 5 bytes = %v, expected %v", err, errScriptNumTooLong)
+	}
+	if n, err := parseScriptNum([]byte{0, 0, 0, 0, 1}, lockTimeNumLen); err != nil || n != 1<<32 {
+		t.Errorf("parseScriptNum of a 5 byte lock time = %d, %v, expected %d", n, err, int64(1)<<32)
+	}
+	if n, err := parseScriptNum([]byte{0x80}, maxScriptNumLen); err != nil || n != 0 {
+		t.Errorf("parseScriptNum of negative zero = %d, %v, expected 0", n, err)
+	}
+}
+
+func TestCastToBool(t *testing.T) {
+	tests := []struct {
+		data []byte
+		want bool
+	}{
+		{[]byte{}, false},
+		{[]byte{0x00}, false},
+		{[]byte{0x00, 0x00}, false},
+		{[]byte{0x80}, false},
+		{[]byte{0x00, 0x80}, false},
+		{[]byte{0x01}, true},
+		{[]byte{0x00, 0x01}, true},
+		{[]byte{0x80, 0x00}, true},
+		{[]byte{0x81}, true},
+	}
+
+	for _, test := range tests {
+		if got := castToBool(test.data); got != test.want {
+			t.Errorf("castToBool(%x) = %t, expected %t", test.data, got, test.want)
+		}
+	}
+}
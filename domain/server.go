@@ -3,11 +3,12 @@ package domain
 import (
 	"bytes"
 	"encoding/gob"
-	"encoding/hex"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"sync"
+	"time"
 )
 
 const protocol = "tcp"
@@ -16,9 +17,12 @@ const commandLength = 12
 
 var nodeAddress string
 var miningAddress string
-var knownNodes = []string{"localhost:3000"}
-var blocksInTransit [][]byte
-var mempool = make(map[string]Transaction)
+
+// knownNodes are the peers of the node, the first one is the seed
+var knownNodes = struct {
+	sync.Mutex
+	addresses []string
+}{addresses: []string{fmt.Sprintf("localhost:%d", chainParams.DefaultPort)}}
 
 type addr struct {
 	AddrList []string
@@ -51,19 +55,23 @@ type getdata struct {
 }
 
 type ver struct {
-	Version    int
-	BestHeight int
-	AddrFrom   string
+	Version     int
+	BestHeight  int
+	AddrFrom    string
+	GenesisHash []byte
+	AddrRecv    string // Address the sender reaches the receiver at
+	Reply       bool   // Answers a ver, which isn't answered again
+	IdentityKey []byte // Static key for encrypted connections, empty when the sender doesn't encrypt
 }
 
 func StartServer(nodeID, minerAddr string) {
-	nodeAddress = fmt.Sprintf("localhost:%s", nodeID)
+	nodeAddress = config.externalAddress(nodeID)
 	miningAddress = minerAddr
-	ln, err := net.Listen(protocol, nodeAddress)
+	ln, err := net.Listen(protocol, config.listenAddress(nodeID))
 	if err != nil {
 		log.Fatal(err)
 	}
-	fmt.Printf("Server listening on %s", miningAddress)
+	fmt.Printf("Server listening on %s, announcing %s\n", config.listenAddress(nodeID), nodeAddress)
 	defer func(ln net.Listener) {
 		err := ln.Close()
 		if err != nil {
@@ -71,10 +79,31 @@ func StartServer(nodeID, minerAddr string) {
 		}
 	}(ln)
 
+	banList, err = LoadBanList(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	identityKey, err = LoadIdentityKey(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+
 	bc := NewBlockchain(nodeID)
+	startRPCServer(nodeID, bc)
+	if config.Stratum != "" {
+		if len(miningAddress) == 0 {
+			log.Panic("ERROR: The Stratum server needs a -miner address to pay blocks to")
+		}
+		startStratumServer(nodeID, miningAddress, bc)
+	} else if len(miningAddress) > 0 {
+		go runMiner(bc, miningAddress)
+	}
 
-	if nodeAddress != knownNodes[0] {
-		sendVersion(knownNodes[0], bc)
+	// Every seed is contacted, so one being down doesn't leave the node isolated
+	for _, seed := range knownNodeList() {
+		if seed != nodeAddress {
+			go sendVersion(seed, bc, false)
+		}
 	}
 
 	for {
@@ -86,9 +115,13 @@ func StartServer(nodeID, minerAddr string) {
 	}
 }
 
-func sendVersion(addr string, bc *Blockchain) {
+func sendVersion(addr string, bc *Blockchain, reply bool) {
 	bestHeight := bc.GetBestHeight()
-	payload := gobEncode(ver{nodeVersion, bestHeight, nodeAddress})
+	var key []byte
+	if config.Encrypt {
+		key = identityKey.PublicKey().Bytes()
+	}
+	payload := gobEncode(ver{nodeVersion, bestHeight, nodeAddress, bc.GenesisHash(), addr, reply, key})
 
 	request := append(commandToBytes("ver"), payload...)
 
@@ -118,40 +151,128 @@ func bytesToCommand(data []byte) string {
 }
 
 func handleConnection(conn net.Conn, bc *Blockchain) {
-	req, err := io.ReadAll(conn)
+	// A malformed message that gets past the checks must not bring the node down
+	defer func() {
+		if r := recover(); r != nil {
+			recoveredPanic(conn.RemoteAddr(), r)
+		}
+	}()
+	defer func(conn net.Conn) {
+		err := conn.Close()
+		if err != nil {
+			log.Panic(err)
+		}
+	}(conn)
+
+	if isBannedAddr(conn.RemoteAddr()) {
+		debugf("Refused a connection from banned %s\n", conn.RemoteAddr())
+		return
+	}
+	if !acquireInbound(conn.RemoteAddr()) {
+		debugf("Refused a connection from %s, too many connections\n", conn.RemoteAddr())
+		return
+	}
+	defer releaseInbound(conn.RemoteAddr())
+
+	err := conn.SetDeadline(time.Now().Add(readTimeout))
 	if err != nil {
 		log.Panic(err)
 	}
-	command := bytesToCommand(req[:commandLength])
-	log.Printf("Received command %s\n", command)
 
+	// Encrypted connections start with the inverted magic bytes and a handshake,
+	// the message inside them is the same as on plaintext ones
+	var reader io.Reader = conn
+	var session *noiseSession
+	magic := make([]byte, len(chainParams.Magic))
+	_, err = io.ReadFull(reader, magic)
+	if err == nil && bytes.Equal(magic, encryptedMagic()) {
+		session, err = noiseRespond(conn, identityKey)
+		if err != nil {
+			log.Printf("Encrypted handshake with %s failed: %s\n", conn.RemoteAddr(), err)
+			return
+		}
+		reader = session
+		_, err = io.ReadFull(reader, magic)
+	}
+	if err != nil || !bytes.Equal(magic, chainParams.Magic[:]) {
+		log.Printf("Dropped a message from %s that isn't for the %s network\n", conn.RemoteAddr(), chainParams.Name)
+		return
+	}
+
+	header := make([]byte, commandLength)
+	_, err = io.ReadFull(reader, header)
+	if err != nil {
+		log.Printf("Dropped a truncated message from %s\n", conn.RemoteAddr())
+		return
+	}
+	command := bytesToCommand(header)
+
+	maxSize, ok := maxPayloadSizes[command]
+	if !ok {
+		misbehaving(conn.RemoteAddr(), scoreUnknown, "unknown command %s", command)
+		return
+	}
+	if !allowMessage(conn.RemoteAddr(), command) {
+		misbehaving(conn.RemoteAddr(), scoreRateLimited, "more than %g %s messages a second", messageRates[command], command)
+		return
+	}
+
+	payload, err := io.ReadAll(io.LimitReader(reader, int64(maxSize)+1))
+	if err != nil {
+		log.Printf("Reading from %s failed: %s\n", conn.RemoteAddr(), err)
+		return
+	}
+	if len(payload) > maxSize {
+		misbehaving(conn.RemoteAddr(), scoreOversized, "%s message larger than %d bytes", command, maxSize)
+		return
+	}
+	req := append(header, payload...)
+
+	// Every message but addr names its sender
+	var sender struct{ AddrFrom string }
+	if gob.NewDecoder(bytes.NewReader(payload)).Decode(&sender) == nil && sender.AddrFrom != "" {
+		address := peerAddress(conn.RemoteAddr(), sender.AddrFrom)
+		if err := checkPeerIdentity(address, command, session); err != nil {
+			log.Printf("Dropped a %s message from %s: %s\n", command, address, err)
+			return
+		}
+		recordConnection(address, true, session != nil)
+	}
+	debugf("Received command %s\n", command)
+
+	handleMessage(command, req, conn.RemoteAddr(), bc)
+}
+
+// handleMessage hands a message that passed the checks of handleConnection to the
+// handler of its command
+func handleMessage(command string, req []byte, from net.Addr, bc *Blockchain) {
 	switch command {
 	case "addr":
-		handleAddr(req)
+		handleAddr(req, from)
 	case "block":
-		handleBlock(req, bc)
+		handleBlock(req, from, bc)
+	case "cmpctblock":
+		handleCmpctBlock(req, from, bc)
+	case "getblocktxn":
+		handleGetBlockTxn(req, from, bc)
+	case "blocktxn":
+		handleBlockTxn(req, from, bc)
 	case "inv":
-		handleInv(req, bc)
+		handleInv(req, from, bc)
 	case "getblocks":
-		handleGetBlocks(req, bc)
+		handleGetBlocks(req, from, bc)
 	case "getdata":
-		handleGetData(req, bc)
+		handleGetData(req, from, bc)
+	case "notfound":
+		handleNotFound(req, from)
 	case "tx":
-		handleTx(req, bc)
+		handleTx(req, from, bc)
 	case "ver":
-		handleVersion(req, bc)
-	default:
-		log.Printf("Unknown command %s\n", command)
+		handleVersion(req, from, bc)
 	}
-
-	err = conn.Close()
-	if err != nil {
-		log.Panic(err)
-	}
-
 }
 
-func handleVersion(req []byte, bc *Blockchain) {
+func handleVersion(req []byte, from net.Addr, bc *Blockchain) {
 	var buf bytes.Buffer
 	var payload ver
 
@@ -159,24 +280,41 @@ func handleVersion(req []byte, bc *Blockchain) {
 	dec := gob.NewDecoder(&buf)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		misbehaving(from, scoreUndecodable, "undecodable ver message")
+		return
+	}
+
+	payload.AddrFrom = peerAddress(from, payload.AddrFrom)
+
+	if !bytes.Equal(payload.GenesisHash, bc.GenesisHash()) {
+		log.Printf("Rejected %s, its genesis block %x isn't ours\n", payload.AddrFrom, payload.GenesisHash)
+		return
+	}
+	key := payload.IdentityKey
+	if len(key) != noiseKeyLen {
+		key = nil
+	}
+	if err := pinPeerIdentityKey(payload.AddrFrom, key); err != nil {
+		log.Printf("Rejected %s: %s\n", payload.AddrFrom, err)
+		return
 	}
+	learnExternalAddress(payload.AddrRecv, from)
 
 	localBestHeight := bc.GetBestHeight()
 	foreignerBestHeight := payload.BestHeight
 
 	if localBestHeight < foreignerBestHeight {
 		sendGetBlocks(payload.AddrFrom)
-	} else if localBestHeight > foreignerBestHeight {
-		sendVersion(payload.AddrFrom, bc)
 	}
-
-	if !nodeIsKnown(payload.AddrFrom) {
-		knownNodes = append(knownNodes, payload.AddrFrom)
+	// The reply tells the peer the address it was seen at, and lets it sync from us
+	if !payload.Reply {
+		sendVersion(payload.AddrFrom, bc, true)
 	}
+
+	addKnownNode(payload.AddrFrom)
 }
 
-func handleGetBlocks(req []byte, bc *Blockchain) {
+func handleGetBlocks(req []byte, from net.Addr, bc *Blockchain) {
 	var buf bytes.Buffer
 	var payload getblocks
 
@@ -184,14 +322,17 @@ func handleGetBlocks(req []byte, bc *Blockchain) {
 	dec := gob.NewDecoder(&buf)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		misbehaving(from, scoreUndecodable, "undecodable getblocks message")
+		return
 	}
 
+	payload.AddrFrom = peerAddress(from, payload.AddrFrom)
+
 	blocks := bc.GetBlockHashes()
 	sendInv(payload.AddrFrom, "block", blocks)
 }
 
-func handleInv(req []byte, bc *Blockchain) {
+func handleInv(req []byte, from net.Addr, bc *Blockchain) {
 	var buf bytes.Buffer
 	var payload inv
 
@@ -199,34 +340,56 @@ func handleInv(req []byte, bc *Blockchain) {
 	dec := gob.NewDecoder(&buf)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		misbehaving(from, scoreUndecodable, "undecodable inv message")
+		return
 	}
 
-	if payload.Type == "block" {
-		blocksInTransit = payload.Items
+	payload.AddrFrom = peerAddress(from, payload.AddrFrom)
 
-		blockHash := payload.Items[0]
-		sendGetData(payload.AddrFrom, "block", blockHash)
+	if len(payload.Items) == 0 || len(payload.Items) > maxInvItems {
+		misbehaving(from, scoreInvFlood, "inv with %d items", len(payload.Items))
+		return
+	}
 
-		newInTransit := [][]byte{}
-		for _, b := range blocksInTransit {
-			if bytes.Compare(b, blockHash) != 0 {
-				newInTransit = append(newInTransit, b)
+	if payload.Type == "block" {
+		// Every node starts from the same genesis block, there is no need to fetch blocks we have.
+		// Hashes come newest first and are fetched oldest first, so every block finds its parent.
+		var missing [][]byte
+		for i := len(payload.Items) - 1; i >= 0; i-- {
+			hash := payload.Items[i]
+			if _, err := bc.GetBlock(hash); err != nil && !isOrphanBlock(hash) {
+				missing = append(missing, hash)
 			}
 		}
-		blocksInTransit = newInTransit
+		setBlocksInTransit(missing)
+
+		if blockHash := nextBlockInTransit(); blockHash != nil {
+			sendGetData(payload.AddrFrom, "block", blockHash)
+		}
 	}
 
 	if payload.Type == "tx" {
-		txID := payload.Items[0]
+		// Peers announce transactions in batches of maxInvBatch
+		if len(payload.Items) > maxInvBatch {
+			misbehaving(from, scoreInvFlood, "inv with %d transactions", len(payload.Items))
+			return
+		}
+		markInventoryKnown(payload.AddrFrom, payload.Items)
 
-		if mempool[hex.EncodeToString(txID)].ID == nil {
-			sendGetData(payload.AddrFrom, "tx", txID)
+		UTXOSet := UTXOSet{bc}
+		for _, txID := range payload.Items {
+			if _, ok := mempoolTx(txID); ok || isOrphanTx(txID) {
+				continue
+			}
+			if _, ok := UTXOSet.FindOutputs(txID); ok {
+				continue
+			}
+			requestTx(payload.AddrFrom, txID)
 		}
 	}
 }
 
-func handleGetData(req []byte, bc *Blockchain) {
+func handleGetData(req []byte, from net.Addr, bc *Blockchain) {
 	var buf bytes.Buffer
 	var payload getdata
 
@@ -234,12 +397,16 @@ func handleGetData(req []byte, bc *Blockchain) {
 	dec := gob.NewDecoder(&buf)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		misbehaving(from, scoreUndecodable, "undecodable getdata message")
+		return
 	}
 
+	payload.AddrFrom = peerAddress(from, payload.AddrFrom)
+
 	if payload.Type == "block" {
 		block, err := bc.GetBlock([]byte(payload.ID))
 		if err != nil {
+			sendNotFound(payload.AddrFrom, "block", payload.ID)
 			return
 		}
 
@@ -247,14 +414,17 @@ func handleGetData(req []byte, bc *Blockchain) {
 	}
 
 	if payload.Type == "tx" {
-		txID := hex.EncodeToString(payload.ID)
-		tx := mempool[txID]
+		tx, ok := mempoolTx(payload.ID)
+		if !ok {
+			sendNotFound(payload.AddrFrom, "tx", payload.ID)
+			return
+		}
 
 		SendTx(payload.AddrFrom, &tx)
 	}
 }
 
-func handleBlock(req []byte, bc *Blockchain) {
+func handleBlock(req []byte, from net.Addr, bc *Blockchain) {
 	var buf bytes.Buffer
 	var payload block
 
@@ -262,31 +432,101 @@ func handleBlock(req []byte, bc *Blockchain) {
 	dec := gob.NewDecoder(&buf)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		misbehaving(from, scoreUndecodable, "undecodable block message")
+		return
 	}
 
+	payload.AddrFrom = peerAddress(from, payload.AddrFrom)
+
 	blockData := payload.Block
-	block := DeserializeBlock(blockData)
+	var block *Block
+	if err := recoverPanic(func() { block = DeserializeBlock(blockData) }); err != nil {
+		misbehaving(from, scoreUndecodable, "undecodable block")
+		return
+	}
 
-	log.Printf("Received new block")
+	debugf("Received new block %x\n", block.Hash)
 
-	bc.AddBlock(block)
+	if !takeBlockRequest(block.Hash) {
+		misbehaving(from, scoreUnsolicited, "unsolicited block %x", block.Hash)
+		return
+	}
 
-	log.Printf("Added block %x\n", block.Hash)
+	processBlock(block, from, payload.AddrFrom, bc)
+}
 
-	if len(blocksInTransit) > 0 {
-		blockHash := blocksInTransit[0]
-		sendGetData(payload.AddrFrom, "block", blockHash)
+// processBlock checks a block received from the peer at addrFrom and adds it to the chain
+func processBlock(block *Block, from net.Addr, addrFrom string, bc *Blockchain) {
+	chainLock.Lock()
+	defer chainLock.Unlock()
 
-		blocksInTransit = blocksInTransit[1:]
-	} else {
-		UTXOSet := UTXOSet{Blockchain: bc}
+	connectBlock(block, from, addrFrom, bc)
+}
+
+// connectBlock is processBlock with chainLock held
+func connectBlock(block *Block, from net.Addr, addrFrom string, bc *Blockchain) {
+	if !NewProofOfWork(block).Validate() {
+		misbehaving(from, scoreBadPoW, "block %x has an invalid proof of work", block.Hash)
+		return
+	}
+
+	parent, err := bc.GetBlock(block.PrevBlockHash)
+	if err != nil {
+		missing := addOrphanBlock(block, from, addrFrom)
+		debugf("Block %x is an orphan, its parent %x is missing\n", block.Hash, block.PrevBlockHash)
+		if missing != nil && !isBlockPending(missing) {
+			sendGetData(addrFrom, "block", missing)
+		}
+		return
+	}
+	// The height isn't part of the proof of work, a block must sit right on its parent
+	if block.Height != parent.Height+1 {
+		misbehaving(from, scoreInvalidBlock, "block %x claims height %d on a parent at height %d", block.Hash, block.Height, parent.Height)
+		return
+	}
+
+	UTXOSet := UTXOSet{bc}
+	if err := UTXOSet.CheckBlockLocks(block); err != nil {
+		misbehaving(from, scoreInvalidBlock, "block %x: %s", block.Hash, err)
+		return
+	}
+	if err := bc.VerifyBlockTransactions(block); err != nil {
+		misbehaving(from, scoreInvalidBlock, "block %x: %s", block.Hash, err)
+		return
+	}
+
+	addBlock(block, bc)
+
+	if blockHash := nextBlockInTransit(); blockHash != nil {
+		sendGetData(addrFrom, "block", blockHash)
+	}
+}
+
+// addBlock adds a verified block to the chain, updates the UTXO set and the mempool
+// and connects the orphans waiting for it, chainLock must be held
+func addBlock(block *Block, bc *Blockchain) {
+	previousTip := bc.tip
+	bc.AddBlock(block)
+
+	infof("Added block %x\n", block.Hash)
+
+	UTXOSet := UTXOSet{bc}
+	if bytes.Equal(block.PrevBlockHash, previousTip) {
 		UTXOSet.Update(block)
+	} else {
+		UTXOSet.Reindex()
 	}
+	removeFromMempool(block.Transactions)
 
+	for _, orphan := range takeOrphanBlocks(block.Hash) {
+		connectBlock(orphan.block, orphan.from, orphan.addrFrom, bc)
+	}
+	for _, orphan := range takeOrphanTxs(block) {
+		acceptTransaction(orphan.tx, orphan.from, orphan.addrFrom, bc)
+	}
 }
 
-func handleTx(request []byte, bc *Blockchain) {
+func handleTx(request []byte, from net.Addr, bc *Blockchain) {
 	var buff bytes.Buffer
 	var payload tx
 
@@ -294,64 +534,90 @@ func handleTx(request []byte, bc *Blockchain) {
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		misbehaving(from, scoreUndecodable, "undecodable tx message")
+		return
 	}
 
+	payload.AddrFrom = peerAddress(from, payload.AddrFrom)
+
 	txData := payload.Transaction
-	tx := DeserializeTransaction(txData)
-	mempool[hex.EncodeToString(tx.ID)] = tx
+	var tx Transaction
+	if err := recoverPanic(func() { tx = DeserializeTransaction(txData) }); err != nil {
+		misbehaving(from, scoreUndecodable, "undecodable transaction")
+		return
+	}
+	txArrived(tx.ID)
 
-	if nodeAddress == knownNodes[0] {
-		for _, node := range knownNodes {
-			if node != nodeAddress && node != payload.AddrFrom {
-				sendInv(node, "tx", [][]byte{tx.ID})
-			}
-		}
-	} else {
-		if len(mempool) >= 2 && len(miningAddress) > 0 {
-		MineTransactions:
-			var txs []*Transaction
-
-			for id := range mempool {
-				tx := mempool[id]
-				if bc.VerifyTransaction(&tx) {
-					txs = append(txs, &tx)
-				}
-			}
+	if tx.IsCoinbase() || len(tx.Vin) == 0 || len(tx.Vout) == 0 {
+		misbehaving(from, scoreInvalidTx, "malformed transaction %x", tx.ID)
+		return
+	}
+	acceptTransaction(tx, from, payload.AddrFrom, bc)
+}
 
-			if len(txs) == 0 {
-				fmt.Println("All transactions are invalid! Waiting for new ones...")
-				return
+// acceptTransaction adds a valid transaction from the peer at addrFrom to the mempool
+// and relays it. A transaction spending unknown ones goes to the orphan pool and its
+// missing parents are requested. It reports whether tx entered the mempool. The
+// node's own transactions come with a nil from and addrFrom set to nodeAddress.
+func acceptTransaction(tx Transaction, from net.Addr, addrFrom string, bc *Blockchain) bool {
+	markInventoryKnown(addrFrom, [][]byte{tx.ID})
+
+	if missing := bc.missingParents(&tx); len(missing) > 0 {
+		if !addOrphanTx(tx, missing, from, addrFrom) {
+			log.Printf("Dropped orphan transaction %x, it's too large\n", tx.ID)
+			return false
+		}
+		debugf("Transaction %x is an orphan, %d parents are missing\n", tx.ID, len(missing))
+		for _, parent := range missing {
+			if _, ok := mempoolTx(parent); !ok && addrFrom != nodeAddress {
+				requestTx(addrFrom, parent)
 			}
+		}
+		return false
+	}
 
-			cbTx := NewCoinbaseTX(miningAddress, "")
-			txs = append(txs, cbTx)
-
-			newBlock := bc.MineBlock(txs)
-			UTXOSet := UTXOSet{bc}
-			UTXOSet.Update(newBlock)
-
-			fmt.Println("New block is mined!")
-
-			for _, tx := range txs {
-				txID := hex.EncodeToString(tx.ID)
-				delete(mempool, txID)
-			}
+	valid := false
+	if err := recoverPanic(func() { valid = bc.VerifyTransaction(&tx) }); err != nil {
+		log.Printf("Dropped transaction %x: %s\n", tx.ID, err)
+		return false
+	}
+	if !valid {
+		misbehaving(from, scoreInvalidTx, "invalid transaction %x", tx.ID)
+		return false
+	}
+	UTXOSet := UTXOSet{bc}
+	prevOuts, err := UTXOSet.FindPrevOutputs(&tx)
+	if err != nil {
+		log.Printf("Dropped transaction %x: %s\n", tx.ID, err)
+		return false
+	}
+	if _, err := transactionFee(&tx, prevOuts); err != nil {
+		misbehaving(from, scoreInvalidTx, "%s", err)
+		return false
+	}
+	if err := checkMempoolLocks(&tx, bc); err != nil {
+		log.Println(err)
+		return false
+	}
+	addToMempool(tx)
+	relayTransaction(&tx, addrFrom)
 
-			for _, node := range knownNodes {
-				if node != nodeAddress {
-					sendInv(node, "block", [][]byte{newBlock.Hash})
-				}
-			}
+	return true
+}
 
-			if len(mempool) > 0 {
-				goto MineTransactions
-			}
-		}
+// minMempoolToMine is how many transactions a miner waits for before mining a block
+func minMempoolToMine() int {
+	if config.MineTxs >= 0 {
+		return config.MineTxs
 	}
+	if chainParams.MineOnDemand {
+		return 1
+	}
+
+	return 2
 }
 
-func handleAddr(req []byte) {
+func handleAddr(req []byte, from net.Addr) {
 	var buf bytes.Buffer
 	var payload addr
 
@@ -359,11 +625,22 @@ func handleAddr(req []byte) {
 	dec := gob.NewDecoder(&buf)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		misbehaving(from, scoreUndecodable, "undecodable addr message")
+		return
+	}
+
+	if len(payload.AddrList) > maxAddrItems {
+		misbehaving(from, scoreInvFlood, "addr with %d addresses", len(payload.AddrList))
+		return
 	}
 
-	knownNodes = append(knownNodes, payload.AddrList...)
-	log.Printf("Known nodes updated, there are %d known nodes now\n", len(knownNodes))
+	for _, address := range payload.AddrList {
+		address, err := normalizeAddress(address)
+		if err == nil && address != nodeAddress {
+			addKnownNode(address)
+		}
+	}
+	infof("Known nodes updated, there are %d known nodes now\n", len(knownNodeList()))
 	requestBlocks()
 }
 
@@ -375,19 +652,21 @@ func sendInv(addr, kind string, items [][]byte) {
 	sendData(addr, req)
 }
 
+// recoveredPanic reports a panic handleConnection recovered from
+var recoveredPanic = func(from net.Addr, r interface{}) {
+	log.Printf("Handling a message from %s failed: %v\n", from, r)
+}
+
+// dialNode opens the connection a message is sent over
+var dialNode = func(address string) (net.Conn, error) {
+	return net.DialTimeout(protocol, address, dialTimeout)
+}
+
 func sendData(address string, data []byte) {
-	conn, err := net.Dial(protocol, address)
+	conn, err := dialNode(address)
 	if err != nil {
 		log.Printf("%s isn't available\n. Error message: %x", address, err)
-		var updatedNodes []string
-
-		for _, node := range knownNodes {
-			if node != address {
-				updatedNodes = append(updatedNodes, node)
-			}
-		}
-
-		knownNodes = updatedNodes
+		forgetNode(address)
 
 		return
 	}
@@ -398,13 +677,56 @@ func sendData(address string, data []byte) {
 		}
 	}(conn)
 
-	_, err = io.Copy(conn, bytes.NewReader(data))
+	if isBannedAddr(conn.RemoteAddr()) {
+		debugf("Not sending to banned %s\n", address)
+		forgetNode(address)
+
+		return
+	}
+	err = conn.SetDeadline(time.Now().Add(writeTimeout))
 	if err != nil {
 		log.Panic(err)
 	}
+
+	message := append(chainParams.Magic[:], data...)
+	key := peerIdentityKey(address)
+	encrypted := config.Encrypt && identityKey != nil && key != nil
+
+	if encrypted {
+		err = sendEncrypted(conn, key, message)
+	} else {
+		_, err = io.Copy(conn, bytes.NewReader(message))
+	}
+	if err != nil {
+		log.Printf("Sending to %s failed: %s\n", address, err)
+		return
+	}
+	recordConnection(address, false, encrypted)
+}
+
+// sendEncrypted sends message over a handshake with the peer holding key, it's
+// never sent to a peer that proves another key
+func sendEncrypted(conn net.Conn, key, message []byte) error {
+	_, err := conn.Write(encryptedMagic())
+	if err != nil {
+		return err
+	}
+
+	session, err := noiseInitiate(conn, identityKey)
+	if err != nil {
+		return err
+	}
+	if !session.hasRemoteStatic(key) {
+		return fmt.Errorf("peer proved identity key %x instead of %x", session.remoteStatic, key)
+	}
+
+	return session.WriteMessage(message)
 }
 
 func sendGetData(addr, kind string, id []byte) {
+	if kind == "block" {
+		markBlockRequested(id)
+	}
 	payload := gobEncode(getdata{nodeAddress, kind, id})
 	req := append(commandToBytes("getdata"), payload...)
 
@@ -446,13 +768,57 @@ func gobEncode(data interface{}) []byte {
 }
 
 func requestBlocks() {
-	for _, node := range knownNodes {
+	for _, node := range knownNodeList() {
 		sendGetBlocks(node)
 	}
 }
 
+// knownNodeList returns a copy of the known nodes, to iterate over without the lock
+func knownNodeList() []string {
+	knownNodes.Lock()
+	defer knownNodes.Unlock()
+
+	return append([]string{}, knownNodes.addresses...)
+}
+
+func setKnownNodes(addresses []string) {
+	knownNodes.Lock()
+	knownNodes.addresses = append([]string{}, addresses...)
+	knownNodes.Unlock()
+}
+
+// addKnownNode adds a node that isn't known yet
+func addKnownNode(address string) {
+	knownNodes.Lock()
+	defer knownNodes.Unlock()
+
+	for _, node := range knownNodes.addresses {
+		if node == address {
+			return
+		}
+	}
+	knownNodes.addresses = append(knownNodes.addresses, address)
+}
+
+func forgetNode(address string) {
+	knownNodes.Lock()
+	defer knownNodes.Unlock()
+
+	var updatedNodes []string
+	for _, node := range knownNodes.addresses {
+		if node != address {
+			updatedNodes = append(updatedNodes, node)
+		}
+	}
+
+	knownNodes.addresses = updatedNodes
+}
+
 func nodeIsKnown(addr string) bool {
-	for _, node := range knownNodes {
+	knownNodes.Lock()
+	defer knownNodes.Unlock()
+
+	for _, node := range knownNodes.addresses {
 		if node == addr {
 			return true
 		}
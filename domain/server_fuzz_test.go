@@ -0,0 +1,140 @@
+package domain
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"sync/atomic"
+	"testing"
+)
+
+// maxFuzzAlloc bounds what handling a single message may allocate
+const maxFuzzAlloc = 64 << 20
+
+// fuzzPeer is the sender of the messages handed to the handlers directly
+var fuzzPeer = &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 3000}
+
+// fuzzConns numbers the connections of FuzzHandleConnection, each comes from its own
+// IP so rate limits and bans don't hide the handlers from the fuzzer
+var fuzzConns uint32
+
+type fuzzConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c fuzzConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// fuzzSeeds are well formed messages of every command
+func fuzzSeeds() map[string][]interface{} {
+	genesis := genesisBlock()
+	address := string(encodeAddress(p256Scheme{}.AddressVersion(), make([]byte, addressHashLen)))
+	coinbase := NewCoinbaseTX(address, "")
+	header := blockHeader{genesis.Timestamp, genesis.PrevBlockHash, genesis.HashTransactions(), genesis.Hash, genesis.Nonce, genesis.Height}
+	peer := "localhost:3001"
+
+	return map[string][]interface{}{
+		"addr":        {addr{[]string{peer, "192.0.2.2:3000"}}},
+		"block":       {block{peer, genesis.Serialize()}, block{peer, NewBlockTemplate(testChain, address).Block(0).Serialize()}},
+		"blocktxn":    {blocktxn{peer, genesis.Hash, [][]byte{coinbase.Serialize()}}},
+		"cmpctblock":  {cmpctblock{peer, header, 1, [][]byte{{1, 2, 3, 4, 5, 6}}, []prefilledTx{{0, coinbase.Serialize()}}}},
+		"getblocks":   {getblocks{peer}},
+		"getblocktxn": {getblocktxn{peer, genesis.Hash, []int{0, 1}}},
+		"getdata":     {getdata{peer, "block", genesis.Hash}, getdata{peer, "tx", coinbase.ID}},
+		"inv":         {inv{peer, "block", [][]byte{genesis.Hash, {1}}}, inv{peer, "tx", [][]byte{coinbase.ID}}},
+		"notfound":    {notfound{peer, "block", genesis.Hash}, notfound{peer, "tx", coinbase.ID}},
+		"tx":          {tx{peer, coinbase.Serialize()}},
+		"ver":         {ver{nodeVersion, 1, peer, genesis.Hash, nodeAddress, false, identityKey.PublicKey().Bytes()}},
+	}
+}
+
+// fuzzMessage fails the test when handle panics or allocates more than maxFuzzAlloc
+func fuzzMessage(t *testing.T, handle func()) {
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				t.Fatalf("handling the message panicked: %v", r)
+			}
+		}()
+		handle()
+	}()
+
+	runtime.ReadMemStats(&after)
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > maxFuzzAlloc {
+		t.Fatalf("handling the message allocated %d bytes", alloc)
+	}
+}
+
+// fuzzHandler feeds arbitrary payloads of command to its handler, up to the size
+// handleConnection lets through
+func fuzzHandler(f *testing.F, command string) {
+	for _, seed := range fuzzSeeds()[command] {
+		f.Add(gobEncode(seed))
+	}
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		if len(payload) > maxPayloadSizes[command] {
+			return
+		}
+		req := append(commandToBytes(command), payload...)
+
+		fuzzMessage(t, func() { handleMessage(command, req, fuzzPeer, testChain) })
+	})
+}
+
+func FuzzHandleConnection(f *testing.F) {
+	for command, seeds := range fuzzSeeds() {
+		for _, seed := range seeds {
+			message := append(chainParams.Magic[:], commandToBytes(command)...)
+			f.Add(append(message, gobEncode(seed)...))
+		}
+	}
+	f.Add(append(encryptedMagic(), make([]byte, 64)...))
+
+	// handleConnection recovers from panics in the handlers, so they are caught here instead
+	var recovered atomic.Value
+	defaultRecoveredPanic := recoveredPanic
+	recoveredPanic = func(from net.Addr, r interface{}) { recovered.Store(fmt.Sprint(r)) }
+	f.Cleanup(func() { recoveredPanic = defaultRecoveredPanic })
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		recovered.Store("")
+		n := atomic.AddUint32(&fuzzConns, 1)
+		server, client := net.Pipe()
+		remote := &net.TCPAddr{IP: net.IPv4(10, byte(n>>16), byte(n>>8), byte(n)), Port: 3000}
+
+		sent := make(chan struct{})
+		go func() {
+			client.Write(data)
+			client.Close()
+			close(sent)
+		}()
+		go io.Copy(io.Discard, client)
+
+		fuzzMessage(t, func() { handleConnection(fuzzConn{server, remote}, testChain) })
+		<-sent
+
+		if r := recovered.Load().(string); r != "" {
+			t.Fatalf("handling the message panicked: %s", r)
+		}
+	})
+}
+
+func FuzzHandleVersion(f *testing.F)     { fuzzHandler(f, "ver") }
+func FuzzHandleAddr(f *testing.F)        { fuzzHandler(f, "addr") }
+func FuzzHandleInv(f *testing.F)         { fuzzHandler(f, "inv") }
+func FuzzHandleGetData(f *testing.F)     { fuzzHandler(f, "getdata") }
+func FuzzHandleGetBlocks(f *testing.F)   { fuzzHandler(f, "getblocks") }
+func FuzzHandleBlock(f *testing.F)       { fuzzHandler(f, "block") }
+func FuzzHandleTx(f *testing.F)          { fuzzHandler(f, "tx") }
+func FuzzHandleCmpctBlock(f *testing.F)  { fuzzHandler(f, "cmpctblock") }
+func FuzzHandleGetBlockTxn(f *testing.F) { fuzzHandler(f, "getblocktxn") }
+func FuzzHandleBlockTxn(f *testing.F)    { fuzzHandler(f, "blocktxn") }
+func FuzzHandleNotFound(f *testing.F)    { fuzzHandler(f, "notfound") }
@@ -0,0 +1,164 @@
+package domain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"strings"
+)
+
+type SigHashType uint32
+
+// Signature hash types follow Bitcoin: the base type picks which outputs are
+// committed to and ANYONECANPAY restricts the inputs to the one being signed
+const (
+	SigHashAll          SigHashType = 0x01
+	SigHashNone         SigHashType = 0x02
+	SigHashSingle       SigHashType = 0x03
+	SigHashAnyoneCanPay SigHashType = 0x80
+
+	sigHashBaseMask = 0x1f
+)
+
+func ParseSigHashType(name string) (SigHashType, error) {
+	var hashType SigHashType
+
+	parts := strings.Split(strings.ToUpper(name), "|")
+	switch strings.TrimSpace(parts[0]) {
+	case "ALL":
+		hashType = SigHashAll
+	case "NONE":
+		hashType = SigHashNone
+	case "SINGLE":
+		hashType = SigHashSingle
+	default:
+		return 0, fmt.Errorf("unknown signature hash type %s", name)
+	}
+
+	if len(parts) == 2 && strings.TrimSpace(parts[1]) == "ANYONECANPAY" {
+		hashType |= SigHashAnyoneCanPay
+	} else if len(parts) != 1 {
+		return 0, fmt.Errorf("unknown signature hash type %s", name)
+	}
+
+	return hashType, nil
+}
+
+func (t SigHashType) isValid() bool {
+	base := t & sigHashBaseMask
+	return t&^(sigHashBaseMask|SigHashAnyoneCanPay) == 0 && base >= SigHashAll && base <= SigHashSingle
+}
+
+// SignatureHash computes the digest signed by input inID. The trimmed transaction is
+// serialized with subScript in place of the input's unlocking script, followed by the
+// value of the spent output and the hash type, and hashed twice with SHA-256.
+func (tx *Transaction) SignatureHash(inID int, subScript []byte, value int, hashType SigHashType) ([]byte, error) {
+	if inID < 0 || inID >= len(tx.Vin) {
+		return nil, fmt.Errorf("input %d out of range", inID)
+	}
+	if !hashType.isValid() {
+		return nil, fmt.Errorf("invalid signature hash type 0x%x", uint32(hashType))
+	}
+
+	txCopy := tx.TrimmedCopy()
+	txCopy.Vin[inID].ScriptSig = subScript
+
+	switch hashType & sigHashBaseMask {
+	case SigHashNone:
+		txCopy.Vout = nil
+		txCopy.zeroOtherSequences(inID)
+	case SigHashSingle:
+		if inID >= len(txCopy.Vout) {
+			return nil, fmt.Errorf("SIGHASH_SINGLE input %d has no matching output", inID)
+		}
+		txCopy.Vout = txCopy.Vout[:inID+1]
+		for i := 0; i < inID; i++ {
+			txCopy.Vout[i] = TXOutput{-1, nil}
+		}
+		txCopy.zeroOtherSequences(inID)
+	}
+
+	if hashType&SigHashAnyoneCanPay != 0 {
+		txCopy.Vin = txCopy.Vin[inID : inID+1]
+		inID = 0
+	}
+
+	var buf bytes.Buffer
+	txCopy.serializeForSignature(&buf, inID, value)
+	writeUint32(&buf, uint32(hashType))
+
+	first := sha256.Sum256(buf.Bytes())
+	second := sha256.Sum256(first[:])
+
+	return second[:], nil
+}
+
+func (tx *Transaction) zeroOtherSequences(inID int) {
+	for i := range tx.Vin {
+		if i != inID {
+			tx.Vin[i].Sequence = 0
+		}
+	}
+}
+
+func (tx *Transaction) serializeForSignature(buf *bytes.Buffer, inID int, value int) {
+	writeVarInt(buf, uint64(len(tx.Vin)))
+	for i, vin := range tx.Vin {
+		writeVarBytes(buf, vin.Txid)
+		writeUint32(buf, uint32(vin.Vout))
+		writeVarBytes(buf, vin.ScriptSig)
+		if i == inID {
+			writeInt64(buf, int64(value))
+		}
+		writeUint32(buf, vin.Sequence)
+	}
+
+	writeVarInt(buf, uint64(len(tx.Vout)))
+	for _, vout := range tx.Vout {
+		writeInt64(buf, int64(vout.Value))
+		writeVarBytes(buf, vout.ScriptPubKey)
+	}
+
+	writeInt64(buf, tx.LockTime)
+}
+
+// SignInput signs input inID against subScript, the script that will run CHECKSIG,
+// and returns the scheme's signature with the hash type appended
+func (tx *Transaction) SignInput(inID int, subScript []byte, value int, hashType SigHashType, wallet *Wallet) []byte {
+	hash, err := tx.SignatureHash(inID, subScript, value, hashType)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	signature, err := wallet.SignHash(hash)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return append(signature, byte(hashType))
+}
+
+func writeVarInt(buf *bytes.Buffer, n uint64) {
+	var b [binary.MaxVarintLen64]byte
+	l := binary.PutUvarint(b[:], n)
+	buf.Write(b[:l])
+}
+
+func writeVarBytes(buf *bytes.Buffer, data []byte) {
+	writeVarInt(buf, uint64(len(data)))
+	buf.Write(data)
+}
+
+func writeUint32(buf *bytes.Buffer, n uint32) {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], n)
+	buf.Write(b[:])
+}
+
+func writeInt64(buf *bytes.Buffer, n int64) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], uint64(n))
+	buf.Write(b[:])
+}
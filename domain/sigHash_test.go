@@ -0,0 +1,225 @@
+package domain
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+
+	"github.com/aleksannder/gochain/util"
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+// sigHashTestTx has three inputs and three outputs, input 1 is the one signed
+func sigHashTestTx() *Transaction {
+	tx := &Transaction{nil, nil, nil, 500}
+	for i := 0; i < 3; i++ {
+		tx.Vin = append(tx.Vin, TXInput{bytes.Repeat([]byte{byte(i + 1)}, 32), i, []byte{byte(i)}, maxTxInSequence - 1})
+		tx.Vout = append(tx.Vout, TXOutput{10 * (i + 1), []byte{opDup, byte(i)}})
+	}
+
+	return tx
+}
+
+func TestSignatureHashCommitments(t *testing.T) {
+	const inID = 1
+	const value = 50
+
+	mutations := []struct {
+		name   string
+		change func(tx *Transaction, value *int)
+	}{
+		{"other outpoint", func(tx *Transaction, value *int) { tx.Vin[0].Vout++ }},
+		{"other sequence", func(tx *Transaction, value *int) { tx.Vin[2].Sequence-- }},
+		{"other unlocking script", func(tx *Transaction, value *int) { tx.Vin[0].ScriptSig = []byte{9} }},
+		{"added input", func(tx *Transaction, value *int) { tx.Vin = append(tx.Vin, tx.Vin[0]) }},
+		{"own outpoint", func(tx *Transaction, value *int) { tx.Vin[inID].Txid = []byte{9} }},
+		{"own sequence", func(tx *Transaction, value *int) { tx.Vin[inID].Sequence-- }},
+		{"spent value", func(tx *Transaction, value *int) { *value++ }},
+		{"lock time", func(tx *Transaction, value *int) { tx.LockTime++ }},
+		{"earlier output", func(tx *Transaction, value *int) { tx.Vout[0].Value++ }},
+		{"matching output", func(tx *Transaction, value *int) { tx.Vout[inID].Value++ }},
+		{"matching output script", func(tx *Transaction, value *int) { tx.Vout[inID].ScriptPubKey = []byte{opDrop} }},
+		{"later output", func(tx *Transaction, value *int) { tx.Vout[2].Value++ }},
+		{"added output", func(tx *Transaction, value *int) { tx.Vout = append(tx.Vout, tx.Vout[0]) }},
+	}
+
+	// Which mutations change the hash, in the order above
+	tests := []struct {
+		hashType  SigHashType
+		committed []bool
+	}{
+		{SigHashAll, []bool{true, true, false, true, true, true, true, true, true, true, true, true, true}},
+		{SigHashNone, []bool{true, false, false, true, true, true, true, true, false, false, false, false, false}},
+		{SigHashSingle, []bool{true, false, false, true, true, true, true, true, false, true, true, false, false}},
+		{SigHashAll | SigHashAnyoneCanPay, []bool{false, false, false, false, true, true, true, true, true, true, true, true, true}},
+		{SigHashNone | SigHashAnyoneCanPay, []bool{false, false, false, false, true, true, true, true, false, false, false, false, false}},
+		{SigHashSingle | SigHashAnyoneCanPay, []bool{false, false, false, false, true, true, true, true, false, true, true, false, false}},
+	}
+
+	for _, test := range tests {
+		base, err := sigHashTestTx().SignatureHash(inID, []byte{opCheckSig}, value, test.hashType)
+		if err != nil {
+			t.Fatalf("hash type 0x%02x: %s", uint32(test.hashType), err)
+		}
+
+		for i, mutation := range mutations {
+			tx, changedValue := sigHashTestTx(), value
+			mutation.change(tx, &changedValue)
+			hash, err := tx.SignatureHash(inID, []byte{opCheckSig}, changedValue, test.hashType)
+			if err != nil {
+				t.Fatalf("hash type 0x%02x, %s: %s", uint32(test.hashType), mutation.name, err)
+			}
+
+			if changed := !bytes.Equal(hash, base); changed != test.committed[i] {
+				t.Errorf("hash type 0x%02x, %s: hash changed %t, expected %t", uint32(test.hashType), mutation.name, changed, test.committed[i])
+			}
+		}
+	}
+}
+
+func TestSignatureHashCommitsToType(t *testing.T) {
+	hashes := make(map[string]SigHashType)
+	for _, hashType := range []SigHashType{SigHashAll, SigHashNone, SigHashSingle, SigHashAll | SigHashAnyoneCanPay, SigHashNone | SigHashAnyoneCanPay, SigHashSingle | SigHashAnyoneCanPay} {
+		hash, err := sigHashTestTx().SignatureHash(1, nil, 50, hashType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if other, ok := hashes[string(hash)]; ok {
+			t.Errorf("hash types 0x%02x and 0x%02x share a hash", uint32(other), uint32(hashType))
+		}
+		hashes[string(hash)] = hashType
+	}
+}
+
+func TestSignatureHashErrors(t *testing.T) {
+	tx := sigHashTestTx()
+	tx.Vout = tx.Vout[:1]
+
+	tests := []struct {
+		name     string
+		inID     int
+		hashType SigHashType
+	}{
+		{"single past the outputs", 1, SigHashSingle},
+		{"single anyonecanpay past the outputs", 2, SigHashSingle | SigHashAnyoneCanPay},
+		{"input out of range", 3, SigHashAll},
+		{"negative input", -1, SigHashAll},
+		{"zero type", 0, 0},
+		{"unknown base type", 0, 0x04},
+		{"anyonecanpay alone", 0, SigHashAnyoneCanPay},
+		{"unknown flag", 0, SigHashAll | 0x40},
+	}
+
+	for _, test := range tests {
+		if _, err := tx.SignatureHash(test.inID, nil, 50, test.hashType); err == nil {
+			t.Errorf("%s: got a hash, expected an error", test.name)
+		}
+	}
+
+	if _, err := tx.SignatureHash(0, nil, 50, SigHashSingle); err != nil {
+		t.Errorf("single with a matching output: %s", err)
+	}
+}
+
+func TestCheckSigHashTypes(t *testing.T) {
+	wallet := NewWallet(secp256k1Scheme{})
+	subScript := NewP2PKHScript(util.HashPubKey(wallet.PublicKey))
+
+	for _, hashType := range []SigHashType{SigHashAll, SigHashNone, SigHashSingle | SigHashAnyoneCanPay} {
+		tx := sigHashTestTx()
+		sig := tx.SignInput(1, subScript, 50, hashType, wallet)
+		checker := txSigChecker{tx, 1, 50}
+
+		if !checker.CheckSig(sig, wallet.PublicKey, subScript) {
+			t.Errorf("hash type 0x%02x: signature rejected", uint32(hashType))
+		}
+
+		other := append([]byte{}, sig...)
+		other[len(other)-1] = byte(SigHashAll)
+		if hashType != SigHashAll && checker.CheckSig(other, wallet.PublicKey, subScript) {
+			t.Errorf("hash type 0x%02x: signature accepted with hash type ALL", uint32(hashType))
+		}
+
+		// Outputs past the signed input's are only covered by ALL
+		tx.Vout[2].Value++
+		if accepted := checker.CheckSig(sig, wallet.PublicKey, subScript); accepted != (hashType != SigHashAll) {
+			t.Errorf("hash type 0x%02x: signature accepted %t after changing a later output", uint32(hashType), accepted)
+		}
+	}
+}
+
+// derSignature encodes r and s as given, without normalizing them
+func derSignature(r, s []byte) []byte {
+	sig := []byte{0x30, byte(4 + len(r) + len(s)), 0x02, byte(len(r))}
+	sig = append(sig, r...)
+	sig = append(sig, 0x02, byte(len(s)))
+
+	return append(sig, s...)
+}
+
+func TestECDSARejectsNonCanonicalSignatures(t *testing.T) {
+	hash := bytes.Repeat([]byte{0x42}, 32)
+
+	for _, test := range []struct {
+		scheme SignatureScheme
+		order  *big.Int
+	}{
+		{p256Scheme{}, elliptic.P256().Params().N},
+		{secp256k1Scheme{}, btcec.S256().N},
+	} {
+		wallet := NewWallet(test.scheme)
+		sig, err := test.scheme.Sign(wallet.PrivateKey, hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !test.scheme.Verify(wallet.PublicKey, hash, sig) {
+			t.Fatalf("%s: valid signature rejected", test.scheme.Name())
+		}
+
+		var parsed ecdsaSignature
+		if _, err := asn1.Unmarshal(sig, &parsed); err != nil {
+			t.Fatal(err)
+		}
+		if parsed.S.Cmp(new(big.Int).Rsh(test.order, 1)) > 0 {
+			t.Errorf("%s: Sign produced a high S signature", test.scheme.Name())
+		}
+		highS, err := asn1.Marshal(ecdsaSignature{parsed.R, new(big.Int).Sub(test.order, parsed.S)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rBytes, sBytes := parsed.R.Bytes(), parsed.S.Bytes()
+		if rBytes[0]&0x80 != 0 {
+			rBytes = append([]byte{0}, rBytes...)
+		}
+		if sBytes[0]&0x80 != 0 {
+			sBytes = append([]byte{0}, sBytes...)
+		}
+		longLength := append([]byte{0x30, 0x81}, sig[1:]...)
+
+		invalid := []struct {
+			name string
+			sig  []byte
+		}{
+			{"high S", highS},
+			{"trailing byte", append(append([]byte{}, sig...), 0)},
+			{"padded R", derSignature(append([]byte{0, 0}, rBytes...), sBytes)},
+			{"padded S", derSignature(rBytes, append([]byte{0, 0}, sBytes...))},
+			{"long form length", longLength},
+			{"raw R and S", append(parsed.R.FillBytes(make([]byte, 32)), parsed.S.FillBytes(make([]byte, 32))...)},
+			{"zero S", derSignature(rBytes, []byte{0})},
+			{"truncated", sig[:len(sig)-1]},
+			{"empty", nil},
+		}
+		if !bytes.Equal(derSignature(rBytes, sBytes), sig) {
+			t.Fatalf("%s: derSignature doesn't reproduce the signature", test.scheme.Name())
+		}
+
+		for _, bad := range invalid {
+			if test.scheme.Verify(wallet.PublicKey, hash, bad.sig) {
+				t.Errorf("%s: %s signature accepted", test.scheme.Name(), bad.name)
+			}
+		}
+	}
+}
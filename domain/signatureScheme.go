@@ -0,0 +1,432 @@
+package domain
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/btcec/v2"
+	btcecdsa "github.com/btcsuite/btcd/btcec/v2/ecdsa"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"math/big"
+	"sort"
+	"strings"
+)
+
+// SignatureScheme abstracts the key type behind a wallet. Every scheme has its own
+// public key length so CHECKSIG can tell them apart, and its own address version on
+// every network.
+type SignatureScheme interface {
+	ID() byte
+	Name() string
+	AddressVersion() byte
+	GenerateKey() ([]byte, error)
+	PublicKey(privKey []byte) ([]byte, error)
+	Sign(privKey, hash []byte) ([]byte, error)
+	Verify(pubKey, hash, sig []byte) bool
+}
+
+const (
+	schemeP256 byte = iota
+	schemeSecp256k1
+	schemeSchnorr
+)
+
+const (
+	p256PubKeyLen      = 65 // Uncompressed, 0x04 || X || Y
+	secp256k1PubKeyLen = 33 // Compressed
+	schnorrPubKeyLen   = 32 // X only, BIP-340
+)
+
+const defaultSignatureScheme = "secp256k1"
+
+var signatureSchemes = map[byte]SignatureScheme{
+	schemeP256:      p256Scheme{},
+	schemeSecp256k1: secp256k1Scheme{},
+	schemeSchnorr:   schnorrScheme{},
+}
+
+func GetSignatureScheme(id byte) (SignatureScheme, error) {
+	scheme, ok := signatureSchemes[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown signature scheme %d", id)
+	}
+
+	return scheme, nil
+}
+
+func GetSignatureSchemeByName(name string) (SignatureScheme, error) {
+	var names []string
+
+	for _, scheme := range signatureSchemes {
+		if strings.EqualFold(scheme.Name(), name) {
+			return scheme, nil
+		}
+		names = append(names, scheme.Name())
+	}
+	sort.Strings(names)
+
+	return nil, fmt.Errorf("unknown signature scheme %s, expected one of %s", name, strings.Join(names, ", "))
+}
+
+func schemeForPubKey(pubKey []byte) SignatureScheme {
+	switch len(pubKey) {
+	case p256PubKeyLen:
+		return signatureSchemes[schemeP256]
+	case secp256k1PubKeyLen:
+		return signatureSchemes[schemeSecp256k1]
+	case schnorrPubKeyLen:
+		return signatureSchemes[schemeSchnorr]
+	}
+
+	return nil
+}
+
+func isAddressVersion(addressVersion byte) bool {
+	for _, scheme := range signatureSchemes {
+		if scheme.AddressVersion() == addressVersion {
+			return true
+		}
+	}
+
+	return false
+}
+
+// NIST P-256 ECDSA
+
+type p256Scheme struct{}
+
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+func (p256Scheme) ID() byte             { return schemeP256 }
+func (p256Scheme) Name() string         { return "p256" }
+func (p256Scheme) AddressVersion() byte { return chainParams.PubKeyHashVersions[schemeP256] }
+
+func (p256Scheme) GenerateKey() ([]byte, error) {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return private.D.FillBytes(make([]byte, 32)), nil
+}
+
+func (s p256Scheme) PublicKey(privKey []byte) ([]byte, error) {
+	private, err := s.privateKey(privKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return elliptic.Marshal(private.Curve, private.X, private.Y), nil
+}
+
+func (s p256Scheme) Sign(privKey, hash []byte) ([]byte, error) {
+	private, err := s.privateKey(privKey)
+	if err != nil {
+		return nil, err
+	}
+
+	r, sigS, err := ecdsa.Sign(rand.Reader, private, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	// Normalize to low S so every signature has exactly one valid encoding
+	order := private.Curve.Params().N
+	if sigS.Cmp(new(big.Int).Rsh(order, 1)) > 0 {
+		sigS = new(big.Int).Sub(order, sigS)
+	}
+
+	return asn1.Marshal(ecdsaSignature{r, sigS})
+}
+
+func (p256Scheme) Verify(pubKey, hash, sig []byte) bool {
+	curve := elliptic.P256()
+
+	x, y := elliptic.Unmarshal(curve, pubKey)
+	if x == nil {
+		return false
+	}
+
+	var parsed ecdsaSignature
+	rest, err := asn1.Unmarshal(sig, &parsed)
+	if err != nil || len(rest) != 0 {
+		return false
+	}
+	canonical, err := asn1.Marshal(parsed)
+	if err != nil || !bytes.Equal(canonical, sig) {
+		return false
+	}
+
+	order := curve.Params().N
+	if parsed.R.Sign() <= 0 || parsed.S.Sign() <= 0 || parsed.R.Cmp(order) >= 0 {
+		return false
+	}
+	if parsed.S.Cmp(new(big.Int).Rsh(order, 1)) > 0 {
+		return false
+	}
+
+	return ecdsa.Verify(&ecdsa.PublicKey{Curve: curve, X: x, Y: y}, hash, parsed.R, parsed.S)
+}
+
+func (p256Scheme) privateKey(privKey []byte) (*ecdsa.PrivateKey, error) {
+	curve := elliptic.P256()
+	d := new(big.Int).SetBytes(privKey)
+
+	if len(privKey) != 32 || d.Sign() == 0 || d.Cmp(curve.Params().N) >= 0 {
+		return nil, errors.New("invalid P-256 private key")
+	}
+
+	private := &ecdsa.PrivateKey{D: d}
+	private.Curve = curve
+	private.X, private.Y = curve.ScalarBaseMult(privKey)
+
+	return private, nil
+}
+
+// secp256k1 ECDSA
+
+type secp256k1Scheme struct{}
+
+func (secp256k1Scheme) ID() byte             { return schemeSecp256k1 }
+func (secp256k1Scheme) Name() string         { return "secp256k1" }
+func (secp256k1Scheme) AddressVersion() byte { return chainParams.PubKeyHashVersions[schemeSecp256k1] }
+
+func (secp256k1Scheme) GenerateKey() ([]byte, error) {
+	private, err := btcec.NewPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return private.Serialize(), nil
+}
+
+func (secp256k1Scheme) PublicKey(privKey []byte) ([]byte, error) {
+	private, err := parseSecp256k1PrivateKey(privKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return private.PubKey().SerializeCompressed(), nil
+}
+
+func (secp256k1Scheme) Sign(privKey, hash []byte) ([]byte, error) {
+	private, err := parseSecp256k1PrivateKey(privKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return btcecdsa.Sign(private, hash).Serialize(), nil
+}
+
+func (secp256k1Scheme) Verify(pubKey, hash, sig []byte) bool {
+	if len(pubKey) != secp256k1PubKeyLen {
+		return false
+	}
+	publicKey, err := btcec.ParsePubKey(pubKey)
+	if err != nil {
+		return false
+	}
+
+	signature, err := btcecdsa.ParseDERSignature(sig)
+	if err != nil {
+		return false
+	}
+	// Serialize always produces the low S form, so this rejects high S signatures
+	if !bytes.Equal(signature.Serialize(), sig) {
+		return false
+	}
+
+	return signature.Verify(hash, publicKey)
+}
+
+// BIP-340 Schnorr over secp256k1
+
+type schnorrScheme struct{}
+
+func (schnorrScheme) ID() byte             { return schemeSchnorr }
+func (schnorrScheme) Name() string         { return "schnorr" }
+func (schnorrScheme) AddressVersion() byte { return chainParams.PubKeyHashVersions[schemeSchnorr] }
+
+func (schnorrScheme) GenerateKey() ([]byte, error) {
+	return secp256k1Scheme{}.GenerateKey()
+}
+
+func (schnorrScheme) PublicKey(privKey []byte) ([]byte, error) {
+	private, err := parseSecp256k1PrivateKey(privKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return schnorr.SerializePubKey(private.PubKey()), nil
+}
+
+func (schnorrScheme) Sign(privKey, hash []byte) ([]byte, error) {
+	private, err := parseSecp256k1PrivateKey(privKey)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := schnorr.Sign(private, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	return signature.Serialize(), nil
+}
+
+func (schnorrScheme) Verify(pubKey, hash, sig []byte) bool {
+	publicKey, err := schnorr.ParsePubKey(pubKey)
+	if err != nil {
+		return false
+	}
+
+	signature, err := schnorr.ParseSignature(sig)
+	if err != nil {
+		return false
+	}
+
+	return signature.Verify(hash, publicKey)
+}
+
+func parseSecp256k1PrivateKey(privKey []byte) (*btcec.PrivateKey, error) {
+	if len(privKey) != 32 {
+		return nil, errors.New("invalid secp256k1 private key")
+	}
+
+	var scalar btcec.ModNScalar
+	overflow := scalar.SetByteSlice(privKey)
+	if overflow || scalar.IsZero() {
+		return nil, errors.New("invalid secp256k1 private key")
+	}
+
+	return btcec.PrivKeyFromScalar(&scalar), nil
+}
+
+// Batch verification of BIP-340 signatures, used when validating whole blocks
+
+type schnorrBatchItem struct {
+	pubKey []byte
+	hash   []byte
+	sig    []byte
+}
+
+type SchnorrBatch struct {
+	items []schnorrBatchItem
+}
+
+func (b *SchnorrBatch) Add(pubKey, hash, sig []byte) {
+	b.items = append(b.items, schnorrBatchItem{pubKey, hash, sig})
+}
+
+func (b *SchnorrBatch) Len() int {
+	return len(b.items)
+}
+
+// Verify checks (s1 + a2*s2 + ... + au*su)G = R1 + a2*R2 + ... + au*Ru + e1*P1 + (a2*e2)P2 + ... + (au*eu)Pu
+// with random coefficients a2..au, which holds for all signatures at once only if every one of them is valid
+func (b *SchnorrBatch) Verify() bool {
+	if len(b.items) == 0 {
+		return true
+	}
+	if len(b.items) == 1 {
+		item := b.items[0]
+		return schnorrScheme{}.Verify(item.pubKey, item.hash, item.sig)
+	}
+
+	var sumS btcec.ModNScalar
+	var rhs btcec.JacobianPoint
+
+	for i, item := range b.items {
+		if len(item.sig) != 64 || len(item.hash) != 32 {
+			return false
+		}
+
+		publicKey, err := schnorr.ParsePubKey(item.pubKey)
+		if err != nil {
+			return false
+		}
+		var pubPoint btcec.JacobianPoint
+		publicKey.AsJacobian(&pubPoint)
+
+		var r btcec.FieldVal
+		if overflow := r.SetByteSlice(item.sig[:32]); overflow {
+			return false
+		}
+		var rPoint btcec.JacobianPoint
+		if !liftX(&r, &rPoint) {
+			return false
+		}
+
+		var s btcec.ModNScalar
+		if overflow := s.SetByteSlice(item.sig[32:]); overflow {
+			return false
+		}
+
+		var e btcec.ModNScalar
+		e.SetByteSlice(taggedHash("BIP0340/challenge", item.sig[:32], item.pubKey, item.hash))
+
+		var a btcec.ModNScalar
+		a.SetInt(1)
+		if i > 0 {
+			var random [32]byte
+			if _, err := rand.Read(random[:]); err != nil {
+				return false
+			}
+			a.SetBytes(&random)
+		}
+
+		s.Mul(&a)
+		sumS.Add(&s)
+
+		var scaledR, scaledP btcec.JacobianPoint
+		btcec.ScalarMultNonConst(&a, &rPoint, &scaledR)
+		e.Mul(&a)
+		btcec.ScalarMultNonConst(&e, &pubPoint, &scaledP)
+
+		btcec.AddNonConst(&rhs, &scaledR, &rhs)
+		btcec.AddNonConst(&rhs, &scaledP, &rhs)
+	}
+
+	var lhs btcec.JacobianPoint
+	btcec.ScalarBaseMultNonConst(&sumS, &lhs)
+
+	lhs.ToAffine()
+	rhs.ToAffine()
+
+	return lhs.X.Equals(&rhs.X) && lhs.Y.Equals(&rhs.Y) && lhs.Z.Equals(&rhs.Z)
+}
+
+// liftX returns the point with the given x coordinate and an even y coordinate
+func liftX(x *btcec.FieldVal, result *btcec.JacobianPoint) bool {
+	var y btcec.FieldVal
+	if !btcec.DecompressY(x, false, &y) {
+		return false
+	}
+	y.Normalize()
+
+	result.X.Set(x)
+	result.Y.Set(&y)
+	result.Z.SetInt(1)
+
+	return true
+}
+
+func taggedHash(tag string, data ...[]byte) []byte {
+	tagHash := sha256.Sum256([]byte(tag))
+
+	hasher := sha256.New()
+	hasher.Write(tagHash[:])
+	hasher.Write(tagHash[:])
+	for _, d := range data {
+		hasher.Write(d)
+	}
+
+	return hasher.Sum(nil)
+}
@@ -0,0 +1,469 @@
+package domain
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"math/big"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The Stratum server speaks Stratum v1, JSON-RPC lines over TCP, with gochain's
+// block header. A job carries the coinbase split around the connection's extranonce1,
+// the merkle branch of the coinbase, the target bits and the timestamp, the worker
+// searches the 64 bit nonce:
+//
+//	coinbase = coinb1 || extranonce1 || coinb2
+//	root     = sha256(coinbase), then root = sha256(root || branch[i]) for every i
+//	hash     = sha256(prevhash || root || ntime || nbits || nonce), 8 bytes each big endian
+//
+// The nonce is large enough that extranonce2 isn't needed, its size is 0.
+// mining.set_difficulty carries the target bits of a share.
+const (
+	stratumCoinbaseTag = "/gochain pool/"
+	stratumMaxJobs     = 8
+	stratumMaxLine     = 16 << 10
+	stratumMaxConns    = 256
+	stratumIdleTimeout = 10 * time.Minute
+)
+
+// A new job goes out right away when the tip changes, and at most every
+// stratumJobInterval when only the mempool does
+const stratumJobInterval = 5 * time.Second
+
+// Error codes of mining.submit
+const (
+	stratumErrOther         = 20
+	stratumErrJobNotFound   = 21
+	stratumErrDuplicate     = 22
+	stratumErrLowDiff       = 23
+	stratumErrUnauthorized  = 24
+	stratumErrNotSubscribed = 25
+)
+
+type stratumRequest struct {
+	ID     interface{}       `json:"id"`
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+}
+
+type stratumResponse struct {
+	ID     interface{} `json:"id"`
+	Result interface{} `json:"result"`
+	Error  interface{} `json:"error"`
+}
+
+type stratumNotification struct {
+	ID     interface{}   `json:"id"`
+	Method string        `json:"method"`
+	Params []interface{} `json:"params"`
+}
+
+type stratumJob struct {
+	id       string
+	template *BlockTemplate // With the connection's coinbase
+	coinb1   []byte
+	coinb2   []byte
+	branch   [][]byte
+	nonces   map[uint64]bool
+}
+
+type stratumConn struct {
+	conn        net.Conn
+	extranonce1 []byte
+	writeMu     sync.Mutex
+
+	mu         sync.Mutex
+	subscribed bool
+	workers    map[string]bool
+	jobs       map[string]*stratumJob
+	jobOrder   []string
+}
+
+type stratumServer struct {
+	bc          *Blockchain
+	address     string
+	shares      *PoolShares
+	shareTarget *big.Int
+
+	mu              sync.Mutex
+	conns           map[*stratumConn]bool
+	nextExtranonce1 uint32
+	nextJob         uint64
+	template        *BlockTemplate
+}
+
+// poolShares is set while the Stratum server runs
+var poolShares *PoolShares
+
+func shareBits() int {
+	if config.ShareBits >= 0 {
+		return config.ShareBits
+	}
+
+	return chainParams.TargetBits / 2
+}
+
+// startStratumServer serves pool workers on the stratum address, paying the blocks
+// they find to address
+func startStratumServer(nodeID, address string, bc *Blockchain) {
+	if shareBits() > chainParams.TargetBits {
+		log.Panicf("ERROR: sharebits %d is above the block target bits %d", shareBits(), chainParams.TargetBits)
+	}
+	shares, err := LoadPoolShares(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	poolShares = shares
+
+	ln, err := net.Listen(protocol, config.Stratum)
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Printf("Stratum server listening on %s, share target bits %d\n", config.Stratum, shareBits())
+
+	target := big.NewInt(1)
+	target.Lsh(target, uint(256-shareBits()))
+	s := &stratumServer{bc: bc, address: address, shares: shares, shareTarget: target, conns: make(map[*stratumConn]bool)}
+
+	go s.updateJobs()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				log.Panic(err)
+			}
+			go s.serve(conn)
+		}
+	}()
+}
+
+// updateJobs builds a new template whenever the tip or the mempool changes and
+// hands it to every subscribed worker
+func (s *stratumServer) updateJobs() {
+	ticker := time.NewTicker(stratumJobInterval)
+	defer ticker.Stop()
+	pending := false
+	s.newTemplate()
+
+	for {
+		select {
+		case <-minerChanged:
+			pending = true
+			if !bytes.Equal(s.currentTemplate().PrevBlockHash, s.bc.GetLastBlock().Hash) {
+				s.newTemplate()
+				pending = false
+			}
+		case <-ticker.C:
+			if pending {
+				s.newTemplate()
+				pending = false
+			}
+		}
+	}
+}
+
+func (s *stratumServer) currentTemplate() *BlockTemplate {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.template == nil {
+		return &BlockTemplate{}
+	}
+	return s.template
+}
+
+func (s *stratumServer) newTemplate() {
+	var template *BlockTemplate
+	if err := recoverPanic(func() { template = NewBlockTemplate(s.bc, s.address) }); err != nil {
+		log.Printf("Building a block template failed: %s\n", err)
+		return
+	}
+
+	s.mu.Lock()
+	clean := s.template == nil || !bytes.Equal(s.template.PrevBlockHash, template.PrevBlockHash)
+	s.template = template
+	var conns []*stratumConn
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+
+	debugf("New Stratum job at height %d with %d transactions\n", template.Height, len(template.Transactions)-1)
+	for _, c := range conns {
+		s.sendJob(c, template, clean)
+	}
+}
+
+// coinbaseTemplate returns template with a coinbase carrying extranonce1
+func coinbaseTemplate(template *BlockTemplate, address string, extranonce1 []byte) *BlockTemplate {
+	coinbase := NewCoinbaseTX(address, string(extranonce1)+stratumCoinbaseTag)
+	coinbase.Vout[0].Value += template.Fees
+	coinbase.ID = coinbase.Hash()
+
+	job := *template
+	job.Transactions = append([]*Transaction{coinbase}, template.Transactions[1:]...)
+	job.MerkleRoot = job.Block(0).HashTransactions()
+
+	return &job
+}
+
+// merkleBranch returns the hashes the merkle root is folded from, starting with the
+// hash of the first transaction
+func merkleBranch(transactions []*Transaction) [][]byte {
+	var level [][]byte
+	for _, tx := range transactions {
+		hash := sha256.Sum256(tx.Serialize())
+		level = append(level, hash[:])
+	}
+
+	var branch [][]byte
+	for len(level) > 1 || len(branch) == 0 {
+		if len(level)%2 != 0 {
+			level = append(level, level[len(level)-1])
+		}
+		branch = append(branch, level[1])
+
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			hash := sha256.Sum256(append(append([]byte{}, level[i]...), level[i+1]...))
+			next = append(next, hash[:])
+		}
+		level = next
+	}
+
+	return branch
+}
+
+func (s *stratumServer) sendJob(c *stratumConn, template *BlockTemplate, clean bool) {
+	job := &stratumJob{template: coinbaseTemplate(template, s.address, c.extranonce1), nonces: make(map[uint64]bool)}
+
+	coinbase := job.template.Transactions[0].Serialize()
+	split := bytes.Index(coinbase, c.extranonce1)
+	job.coinb1 = coinbase[:split]
+	job.coinb2 = coinbase[split+len(c.extranonce1):]
+	job.branch = merkleBranch(job.template.Transactions)
+
+	s.mu.Lock()
+	s.nextJob++
+	job.id = strconv.FormatUint(s.nextJob, 16)
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	if !c.subscribed {
+		c.mu.Unlock()
+		return
+	}
+	if clean {
+		c.jobs = make(map[string]*stratumJob)
+		c.jobOrder = nil
+	}
+	if len(c.jobOrder) >= stratumMaxJobs {
+		delete(c.jobs, c.jobOrder[0])
+		c.jobOrder = c.jobOrder[1:]
+	}
+	c.jobs[job.id] = job
+	c.jobOrder = append(c.jobOrder, job.id)
+	c.mu.Unlock()
+
+	var branch []string
+	for _, hash := range job.branch {
+		branch = append(branch, hex.EncodeToString(hash))
+	}
+	c.send(stratumNotification{nil, "mining.notify", []interface{}{
+		job.id,
+		hex.EncodeToString(job.template.PrevBlockHash),
+		hex.EncodeToString(job.coinb1),
+		hex.EncodeToString(job.coinb2),
+		branch,
+		fmt.Sprintf("%08x", nodeVersion),
+		fmt.Sprintf("%08x", job.template.TargetBits),
+		fmt.Sprintf("%08x", job.template.Timestamp),
+		clean,
+	}})
+}
+
+func (c *stratumConn) send(message interface{}) {
+	line, err := json.Marshal(message)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	err = c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if err == nil {
+		_, err = c.conn.Write(append(line, '\n'))
+	}
+	if err != nil {
+		debugf("Writing to Stratum worker %s failed: %s\n", c.conn.RemoteAddr(), err)
+		c.conn.Close()
+	}
+}
+
+func stratumError(code int, message string) []interface{} {
+	return []interface{}{code, message, nil}
+}
+
+func (s *stratumServer) serve(conn net.Conn) {
+	defer func(conn net.Conn) {
+		_ = conn.Close()
+	}(conn)
+
+	if isBannedAddr(conn.RemoteAddr()) {
+		return
+	}
+
+	s.mu.Lock()
+	if len(s.conns) >= stratumMaxConns {
+		s.mu.Unlock()
+		return
+	}
+	s.nextExtranonce1++
+	c := &stratumConn{conn: conn, extranonce1: binary.BigEndian.AppendUint32(nil, s.nextExtranonce1), workers: make(map[string]bool), jobs: make(map[string]*stratumJob)}
+	s.conns[c] = true
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 1024), stratumMaxLine)
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(stratumIdleTimeout)); err != nil {
+			return
+		}
+		if !scanner.Scan() {
+			return
+		}
+
+		var req stratumRequest
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			debugf("Undecodable Stratum request from %s: %s\n", conn.RemoteAddr(), err)
+			return
+		}
+
+		result, stratumErr := s.handle(c, req)
+		c.send(stratumResponse{req.ID, result, stratumErr})
+
+		if req.Method == "mining.subscribe" && stratumErr == nil {
+			// Jobs go out once the worker has the subscription and the share target
+			c.send(stratumNotification{nil, "mining.set_difficulty", []interface{}{shareBits()}})
+			c.mu.Lock()
+			c.subscribed = true
+			c.mu.Unlock()
+			if template := s.currentTemplate(); template.Height > 0 {
+				s.sendJob(c, template, true)
+			}
+		}
+	}
+}
+
+func (s *stratumServer) handle(c *stratumConn, req stratumRequest) (interface{}, interface{}) {
+	params := make([]string, len(req.Params))
+	for i, param := range req.Params {
+		_ = json.Unmarshal(param, &params[i])
+	}
+
+	switch req.Method {
+	case "mining.subscribe":
+		subscription := hex.EncodeToString(c.extranonce1)
+		return []interface{}{
+			[][]string{{"mining.set_difficulty", subscription}, {"mining.notify", subscription}},
+			hex.EncodeToString(c.extranonce1),
+			0,
+		}, nil
+	case "mining.authorize":
+		if len(params) < 1 || params[0] == "" {
+			return false, stratumError(stratumErrUnauthorized, "Worker name missing")
+		}
+		c.mu.Lock()
+		c.workers[params[0]] = true
+		c.mu.Unlock()
+		infof("Stratum worker %s authorized from %s\n", params[0], c.conn.RemoteAddr())
+		return true, nil
+	case "mining.extranonce.subscribe":
+		return false, nil
+	case "mining.submit":
+		return s.submit(c, params)
+	}
+
+	return nil, stratumError(stratumErrOther, "Unknown method "+req.Method)
+}
+
+// submit checks a share, params are worker, job ID, extranonce2, ntime and nonce
+func (s *stratumServer) submit(c *stratumConn, params []string) (interface{}, interface{}) {
+	if len(params) < 5 {
+		return false, stratumError(stratumErrOther, "mining.submit takes worker, job, extranonce2, ntime and nonce")
+	}
+	worker := params[0]
+
+	c.mu.Lock()
+	subscribed, authorized := c.subscribed, c.workers[worker]
+	job, ok := c.jobs[params[1]]
+	c.mu.Unlock()
+	if !subscribed {
+		return false, stratumError(stratumErrNotSubscribed, "Not subscribed")
+	}
+	if !authorized {
+		return false, stratumError(stratumErrUnauthorized, "Unauthorized worker")
+	}
+	if !ok {
+		s.shares.Record(worker, false, false)
+		return false, stratumError(stratumErrJobNotFound, "Job not found")
+	}
+
+	ntime, errTime := strconv.ParseUint(params[3], 16, 64)
+	nonce, errNonce := strconv.ParseUint(params[4], 16, 64)
+	if params[2] != "" || errTime != nil || errNonce != nil || nonce > math.MaxInt64 {
+		s.shares.Record(worker, false, false)
+		return false, stratumError(stratumErrOther, "Malformed extranonce2, ntime or nonce")
+	}
+	if int64(ntime) != job.template.Timestamp {
+		s.shares.Record(worker, false, false)
+		return false, stratumError(stratumErrOther, "ntime must be the job's")
+	}
+
+	c.mu.Lock()
+	duplicate := job.nonces[nonce]
+	job.nonces[nonce] = true
+	c.mu.Unlock()
+	if duplicate {
+		s.shares.Record(worker, false, false)
+		return false, stratumError(stratumErrDuplicate, "Duplicate share")
+	}
+
+	block := job.template.Block(int(nonce))
+	var hashInt big.Int
+	hashInt.SetBytes(block.Hash)
+	if hashInt.Cmp(s.shareTarget) != -1 {
+		s.shares.Record(worker, false, false)
+		return false, stratumError(stratumErrLowDiff, "Low difficulty share")
+	}
+
+	found := false
+	if hashInt.Cmp(powTarget()) == -1 {
+		if err := submitBlock(block, s.bc); err != nil {
+			log.Printf("Block %x of Stratum worker %s rejected: %s\n", block.Hash, worker, err)
+		} else {
+			found = true
+			fmt.Printf("New block %x is mined by Stratum worker %s with %d transactions!\n", block.Hash, worker, len(block.Transactions)-1)
+		}
+	}
+	s.shares.Record(worker, true, found)
+
+	return true, nil
+}
@@ -2,8 +2,6 @@ package domain
 
 import (
 	"bytes"
-	"crypto/ecdsa"
-	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/gob"
@@ -11,29 +9,29 @@ import (
 	"fmt"
 	"github.com/aleksannder/gochain/util"
 	"log"
-	"math/big"
 	"strings"
 )
 
-const subsidy = 10
-
 type TXOutput struct {
-	Value      int
-	PubKeyHash []byte
+	Value        int
+	ScriptPubKey []byte // Locking script
 }
 type TXInput struct {
 	Txid      []byte
 	Vout      int
-	Signature []byte
-	PubKey    []byte
+	ScriptSig []byte // Unlocking script
+	Sequence  uint32 // Relative lock time, see lockTime.go
 }
 type TXOutputs struct {
-	Outputs []TXOutput
+	Outputs    map[int]TXOutput // Unspent outputs by their index in the transaction
+	Height     int              // Height of the block that included the transaction
+	MedianTime int64            // Median time past before that block
 }
 type Transaction struct {
-	ID   []byte
-	Vin  []TXInput
-	Vout []TXOutput
+	ID       []byte
+	Vin      []TXInput
+	Vout     []TXOutput
+	LockTime int64 // Block height or unix time before which the transaction can't be mined
 }
 
 // TX methods
@@ -49,52 +47,77 @@ func NewCoinbaseTX(to, data string) *Transaction {
 		data = fmt.Sprintf("%x", randData)
 	}
 
-	txin := TXInput{[]byte{}, -1, nil, []byte(data)}
-	txout := NewTXOutput(subsidy, to)
-	tx := Transaction{nil, []TXInput{txin}, []TXOutput{*txout}}
+	txin := TXInput{[]byte{}, -1, []byte(data), maxTxInSequence}
+	txout := NewTXOutput(chainParams.Subsidy, to)
+	tx := Transaction{nil, []TXInput{txin}, []TXOutput{*txout}, 0}
 
 	tx.ID = tx.Hash()
 
 	return &tx
 }
 
-func NewUTXOTransaction(wallet *Wallet, to string, amount int, set *UTXOSet) *Transaction {
+// NewUTXOTransaction pays every recipient from an address of wallets, change goes to a
+// fresh change address when wallets is an HD wallet and back to from otherwise
+func NewUTXOTransaction(wallets *Wallets, from string, payments []Payment, lockTime int64, coins CoinSelection, set *UTXOSet) *Transaction {
+	wallet, ok := wallets.Wallets[from]
+	if !ok {
+		log.Panicf("ERROR: Address %s is not in the wallet", from)
+	}
+
+	tx := newUnsignedTransaction(from, payments, lockTime, coins, set)
+	if changeIdx := len(payments); len(tx.Vout) > changeIdx && wallets.HasSeed() {
+		change, err := wallets.NewChangeAddress()
+		if err != nil {
+			log.Panic(err)
+		}
+		tx.Vout[changeIdx] = *NewTXOutput(tx.Vout[changeIdx].Value, change)
+		tx.ID = tx.Hash()
+	}
+	set.Blockchain.SignTransaction(tx, wallet)
+
+	return tx
+}
+
+// newUnsignedTransaction has one output per payment, in order, followed by the change
+func newUnsignedTransaction(from string, payments []Payment, lockTime int64, coins CoinSelection, set *UTXOSet) *Transaction {
 	var inputs []TXInput
 	var outputs []TXOutput
 
-	pubKeyHash := util.HashPubKey(wallet.PublicKey)
-	acc, validOutputs := set.FindSpendableOutputs(pubKeyHash, amount)
+	if err := ValidatePayments(payments); err != nil {
+		log.Panicf("ERROR: %s", err)
+	}
 
-	if acc < amount {
-		log.Panic("ERROR: Not enough funds")
+	amount := totalAmount(payments)
+	selected, acc, err := coins.selectCoins(set, from, amount)
+	if err != nil {
+		log.Panicf("ERROR: %s", err)
 	}
 
-	for txid, outs := range validOutputs {
-		txID, err := hex.DecodeString(txid)
-		if err != nil {
-			log.Panic(err)
-		}
+	// Lock time is only enforced when at least one input isn't final
+	sequence := uint32(maxTxInSequence)
+	if lockTime != 0 {
+		sequence = maxTxInSequence - 1
+	}
 
-		for _, out := range outs {
-			input := TXInput{txID, out, nil, wallet.PublicKey}
-			inputs = append(inputs, input)
-		}
+	for _, utxo := range selected {
+		input := TXInput{utxo.Txid, utxo.Vout, nil, sequence}
+		inputs = append(inputs, input)
 	}
 
-	from := fmt.Sprintf("%s", wallet.GetAddress())
-	outputs = append(outputs, *NewTXOutput(amount, to))
+	for _, payment := range payments {
+		outputs = append(outputs, *NewTXOutput(payment.Amount, payment.Address))
+	}
 	if acc > amount {
 		outputs = append(outputs, *NewTXOutput(acc-amount, from))
 	}
 
-	tx := Transaction{nil, inputs, outputs}
+	tx := Transaction{nil, inputs, outputs, lockTime}
 	tx.ID = tx.Hash()
-	set.Blockchain.SignTransaction(&tx, wallet.PrivateKey)
 
 	return &tx
 }
 
-func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transaction) {
+func (tx *Transaction) Sign(wallet *Wallet, prevTXs map[string]Transaction) {
 	if tx.IsCoinbase() {
 		return
 	}
@@ -105,23 +128,16 @@ func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transac
 		}
 	}
 
-	txCopy := tx.TrimmedCopy()
-
-	for inID, vin := range txCopy.Vin {
+	for inID, vin := range tx.Vin {
 		prevTx := prevTXs[hex.EncodeToString(vin.Txid)]
-		txCopy.Vin[inID].Signature = nil
-		txCopy.Vin[inID].PubKey = prevTx.Vout[vin.Vout].PubKeyHash
+		lockingScript := prevTx.Vout[vin.Vout].ScriptPubKey
 
-		dataToSign := fmt.Sprintf("%x\n", txCopy)
-
-		r, s, err := ecdsa.Sign(rand.Reader, &privKey, []byte(dataToSign))
-		if err != nil {
-			log.Panic(err)
+		if !IsP2PKHScript(lockingScript) {
+			log.Panicf("ERROR: Input %d is not a standard pay-to-pubkey-hash output", inID)
 		}
-		signature := append(r.Bytes(), s.Bytes()...)
 
-		tx.Vin[inID].Signature = signature
-		txCopy.Vin[inID].PubKey = nil
+		signature := tx.SignInput(inID, lockingScript, prevTx.Vout[vin.Vout].Value, SigHashAll, wallet)
+		tx.Vin[inID].ScriptSig = NewScriptBuilder().AddData(signature).AddData(wallet.PublicKey).Script()
 	}
 }
 
@@ -130,14 +146,14 @@ func (tx *Transaction) TrimmedCopy() Transaction {
 	var outs []TXOutput
 
 	for _, vin := range tx.Vin {
-		inp = append(inp, TXInput{vin.Txid, vin.Vout, nil, nil})
+		inp = append(inp, TXInput{vin.Txid, vin.Vout, nil, vin.Sequence})
 	}
 
 	for _, vout := range tx.Vout {
-		outs = append(outs, TXOutput{vout.Value, vout.PubKeyHash})
+		outs = append(outs, TXOutput{vout.Value, vout.ScriptPubKey})
 	}
 
-	txCopy := Transaction{tx.ID, inp, outs}
+	txCopy := Transaction{tx.ID, inp, outs, tx.LockTime}
 
 	return txCopy
 }
@@ -180,20 +196,35 @@ func (tx *Transaction) String() string {
 		lines = append(lines, fmt.Sprintf("  - Input %d:", i))
 		lines = append(lines, fmt.Sprintf("    Txid: %x", in.Txid))
 		lines = append(lines, fmt.Sprintf("    Vout: %d", in.Vout))
-		lines = append(lines, fmt.Sprintf("    PubKey: %x", in.PubKey))
-		lines = append(lines, fmt.Sprintf("    Signature: %x", in.Signature))
+		if in.Sequence != maxTxInSequence {
+			lines = append(lines, fmt.Sprintf("    Sequence: %d", in.Sequence))
+		}
+		if tx.IsCoinbase() {
+			lines = append(lines, fmt.Sprintf("    Coinbase: %x", in.ScriptSig))
+		} else {
+			lines = append(lines, fmt.Sprintf("    ScriptSig: %s", DisasmScript(in.ScriptSig)))
+		}
 	}
 
 	for i, out := range tx.Vout {
 		lines = append(lines, fmt.Sprintf("  - Output %d:", i))
-		lines = append(lines, fmt.Sprintf("    PubKey: %x", out.PubKeyHash))
+		lines = append(lines, fmt.Sprintf("    ScriptPubKey: %s", DisasmScript(out.ScriptPubKey)))
 		lines = append(lines, fmt.Sprintf("    Value: %d", out.Value))
 	}
+	if tx.LockTime != 0 {
+		lines = append(lines, fmt.Sprintf("  LockTime: %d", tx.LockTime))
+	}
 
 	return strings.Join(lines, "\n")
 }
 
 func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
+	return tx.verify(prevTXs, nil)
+}
+
+// verify runs the scripts of every input, Schnorr signatures are added to batch
+// instead of being checked right away when batch isn't nil
+func (tx *Transaction) verify(prevTXs map[string]Transaction, batch *SchnorrBatch) bool {
 	if tx.IsCoinbase() {
 		return true
 	}
@@ -204,42 +235,104 @@ func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
 		}
 	}
 
-	txCopy := tx.TrimmedCopy()
-	curve := elliptic.P256()
-
 	for inID, vin := range tx.Vin {
 		prevTX := prevTXs[hex.EncodeToString(vin.Txid)]
-		txCopy.Vin[inID].Signature = nil
-		txCopy.Vin[inID].PubKey = prevTX.Vout[vin.Vout].PubKeyHash
-
-		r := big.Int{}
-		s := big.Int{}
-		sigLen := len(vin.Signature)
-		r.SetBytes(vin.Signature[:(sigLen / 2)])
-		s.SetBytes(vin.Signature[(sigLen / 2):])
-
-		x := big.Int{}
-		y := big.Int{}
-		keyLen := len(vin.PubKey)
-		x.SetBytes(vin.PubKey[:(keyLen / 2)])
-		y.SetBytes(vin.PubKey[(keyLen / 2):])
+		if vin.Vout < 0 || vin.Vout >= len(prevTX.Vout) {
+			return false
+		}
 
-		dataToVerify := fmt.Sprintf("%x\n", txCopy)
+		prevOut := prevTX.Vout[vin.Vout]
+		var checker SigChecker = txSigChecker{tx, inID, prevOut.Value}
+		if batch != nil {
+			checker = batchSigChecker{txSigChecker{tx, inID, prevOut.Value}, batch}
+		}
 
-		rawPubKey := ecdsa.PublicKey{Curve: curve, X: &x, Y: &y}
-		if ecdsa.Verify(&rawPubKey, []byte(dataToVerify), &r, &s) == false {
+		err := ExecuteScript(vin.ScriptSig, prevOut.ScriptPubKey, checker)
+		if err != nil {
+			log.Printf("Input %d of transaction %x failed script validation: %s\n", inID, tx.ID, err)
 			return false
 		}
-		txCopy.Vin[inID].PubKey = nil
 	}
 
 	return true
 }
 
+// txSigChecker verifies signatures against a single input of a transaction
+type txSigChecker struct {
+	tx    *Transaction
+	inID  int
+	value int // Value of the spent output
+}
+
+// CheckSig expects a signature followed by its one byte hash type, the scheme
+// is picked from the public key encoding
+func (c txSigChecker) CheckSig(sig, pubKey, subScript []byte) bool {
+	scheme, hash, ok := c.signatureHash(sig, pubKey, subScript)
+	if !ok {
+		return false
+	}
+
+	return scheme.Verify(pubKey, hash, sig[:len(sig)-1])
+}
+
+func (c txSigChecker) signatureHash(sig, pubKey, subScript []byte) (SignatureScheme, []byte, bool) {
+	scheme := schemeForPubKey(pubKey)
+	if scheme == nil || len(sig) < 2 {
+		return nil, nil, false
+	}
+
+	hashType := SigHashType(sig[len(sig)-1])
+	hash, err := c.tx.SignatureHash(c.inID, subScript, c.value, hashType)
+	if err != nil {
+		return nil, nil, false
+	}
+
+	return scheme, hash, true
+}
+
+type batchSigChecker struct {
+	txSigChecker
+	batch *SchnorrBatch
+}
+
+func (c batchSigChecker) DeferSig(sig, pubKey, subScript []byte) bool {
+	scheme, hash, ok := c.signatureHash(sig, pubKey, subScript)
+	if !ok {
+		return false
+	}
+	if scheme.ID() != schemeSchnorr {
+		return scheme.Verify(pubKey, hash, sig[:len(sig)-1])
+	}
+
+	c.batch.Add(pubKey, hash, sig[:len(sig)-1])
+
+	return true
+}
+
+// CheckLockTime follows BIP-65: the script lock time has to be of the same kind
+// (height or timestamp) as the transaction lock time and must not exceed it
+func (c txSigChecker) CheckLockTime(lockTime int64) bool {
+	txLockTime := c.tx.LockTime
+
+	if (txLockTime < lockTimeThreshold) != (lockTime < lockTimeThreshold) {
+		return false
+	}
+	if lockTime > txLockTime {
+		return false
+	}
+
+	// A final input would let the transaction bypass its own lock time
+	return c.tx.Vin[c.inID].Sequence != maxTxInSequence
+}
+
 // TXInput methods
 
 func (in *TXInput) UsesKey(pubKeyHash []byte) bool {
-	lockingHash := util.HashPubKey(in.PubKey)
+	pushes, err := PushedData(in.ScriptSig)
+	if err != nil || len(pushes) != 2 {
+		return false
+	}
+	lockingHash := util.HashPubKey(pushes[1])
 
 	return bytes.Compare(lockingHash, pubKeyHash) == 0
 }
@@ -248,19 +341,26 @@ func (in *TXInput) UsesKey(pubKeyHash []byte) bool {
 
 func NewTXOutput(value int, address string) *TXOutput {
 	txo := &TXOutput{value, nil}
-	txo.Lock([]byte(address))
+	txo.Lock(mustParseAddress(address))
 
 	return txo
 }
 
-func (out *TXOutput) Lock(address []byte) {
-	pubKeyHash := util.Base58Decode(address)
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
-	out.PubKeyHash = pubKeyHash
+func (out *TXOutput) Lock(address Address) {
+	out.ScriptPubKey = address.LockingScript()
 }
 
 func (out *TXOutput) IsLockedWithKey(pubKeyHash []byte) bool {
-	return bytes.Compare(out.PubKeyHash, pubKeyHash) == 0
+	return bytes.Compare(ExtractPubKeyHash(out.ScriptPubKey), pubKeyHash) == 0
+}
+
+func (out *TXOutput) IsLockedWithScript(lockingScript []byte) bool {
+	return bytes.Equal(out.ScriptPubKey, lockingScript)
+}
+
+// LockingScript returns the standard script paying to address
+func LockingScript(address string) []byte {
+	return mustParseAddress(address).LockingScript()
 }
 
 func (outs TXOutputs) Serialize() []byte {
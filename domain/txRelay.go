@@ -0,0 +1,198 @@
+package domain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Transactions are announced to every peer in batched inv messages, each peer's
+// batch goes out after its own random delay so the origin of a transaction can't
+// be told from which peer announced it first
+const inventoryInterval = 5 * time.Second
+
+// maxInvBatch keeps a batch within what the peer may fetch at the tx rate limit,
+// the rest waits for the next one
+const maxInvBatch = 100
+
+// maxKnownInventory caps the items remembered per peer, the set starts over when full
+const maxKnownInventory = 50000
+
+// A transaction asked for with getdata isn't asked for again, from any peer, until
+// txRequestTimeout passes without it arriving
+const txRequestTimeout = time.Minute
+
+type notfound struct {
+	AddrFrom string
+	Type     string
+	ID       []byte
+}
+
+type peerInventory struct {
+	known     map[string]bool
+	queue     [][]byte
+	scheduled bool
+}
+
+var inventory = struct {
+	sync.Mutex
+	peers map[string]*peerInventory
+}{peers: make(map[string]*peerInventory)}
+
+var txsRequested = struct {
+	sync.Mutex
+	at map[string]time.Time
+}{at: make(map[string]time.Time)}
+
+func inventoryEntry(address string) *peerInventory {
+	entry, ok := inventory.peers[address]
+	if !ok {
+		entry = &peerInventory{known: make(map[string]bool)}
+		inventory.peers[address] = entry
+	}
+
+	return entry
+}
+
+func (p *peerInventory) markKnown(id []byte) {
+	if len(p.known) >= maxKnownInventory {
+		p.known = make(map[string]bool)
+	}
+	p.known[hex.EncodeToString(id)] = true
+}
+
+// markInventoryKnown remembers that the peer at address has the items, they
+// aren't announced to it again
+func markInventoryKnown(address string, items [][]byte) {
+	inventory.Lock()
+	defer inventory.Unlock()
+
+	entry := inventoryEntry(address)
+	for _, id := range items {
+		entry.markKnown(id)
+	}
+}
+
+// trickleDelay is exponentially distributed around inventoryInterval
+func trickleDelay() time.Duration {
+	delay := time.Duration(rand.ExpFloat64() * float64(inventoryInterval))
+	if delay > 4*inventoryInterval {
+		delay = 4 * inventoryInterval
+	}
+
+	return delay
+}
+
+// relayTransaction queues tx for every peer but the one it came from
+func relayTransaction(tx *Transaction, addrFrom string) {
+	inventory.Lock()
+	defer inventory.Unlock()
+
+	for _, node := range knownNodeList() {
+		if node == nodeAddress || node == addrFrom {
+			continue
+		}
+		entry := inventoryEntry(node)
+		if entry.known[hex.EncodeToString(tx.ID)] {
+			continue
+		}
+		entry.markKnown(tx.ID)
+		entry.queue = append(entry.queue, tx.ID)
+
+		if !entry.scheduled {
+			entry.scheduled = true
+			node := node
+			time.AfterFunc(trickleDelay(), func() { flushInventory(node) })
+		}
+	}
+}
+
+// flushInventory announces the queued transactions of a peer in one inv, those that
+// were mined or dropped since they were queued aren't announced
+func flushInventory(address string) {
+	inventory.Lock()
+	entry := inventoryEntry(address)
+	var batch [][]byte
+	for len(entry.queue) > 0 && len(batch) < maxInvBatch {
+		if _, ok := mempoolTx(entry.queue[0]); ok {
+			batch = append(batch, entry.queue[0])
+		}
+		entry.queue = entry.queue[1:]
+	}
+	entry.scheduled = len(entry.queue) > 0
+	if entry.scheduled {
+		time.AfterFunc(trickleDelay(), func() { flushInventory(address) })
+	}
+	inventory.Unlock()
+
+	if len(batch) == 0 {
+		return
+	}
+	debugf("Announcing %d transactions to %s\n", len(batch), address)
+	sendInv(address, "tx", batch)
+}
+
+// requestTx asks the peer at addr for a transaction unless it's already asked for
+func requestTx(addr string, id []byte) {
+	key := hex.EncodeToString(id)
+	now := time.Now()
+
+	txsRequested.Lock()
+	if len(txsRequested.at) >= maxKnownInventory {
+		for requested, at := range txsRequested.at {
+			if now.Sub(at) > txRequestTimeout {
+				delete(txsRequested.at, requested)
+			}
+		}
+	}
+	at, requested := txsRequested.at[key]
+	if (requested && now.Sub(at) <= txRequestTimeout) || len(txsRequested.at) >= maxKnownInventory {
+		txsRequested.Unlock()
+		return
+	}
+	txsRequested.at[key] = now
+	txsRequested.Unlock()
+
+	sendGetData(addr, "tx", id)
+}
+
+// txArrived forgets the request for a transaction that arrived or wasn't found
+func txArrived(id []byte) {
+	txsRequested.Lock()
+	delete(txsRequested.at, hex.EncodeToString(id))
+	txsRequested.Unlock()
+}
+
+func sendNotFound(addr, kind string, id []byte) {
+	payload := gobEncode(notfound{nodeAddress, kind, id})
+	req := append(commandToBytes("notfound"), payload...)
+
+	sendData(addr, req)
+}
+
+func handleNotFound(req []byte, from net.Addr) {
+	var buf bytes.Buffer
+	var payload notfound
+
+	buf.Write(req[commandLength:])
+	dec := gob.NewDecoder(&buf)
+	err := dec.Decode(&payload)
+	if err != nil {
+		misbehaving(from, scoreUndecodable, "undecodable notfound message")
+		return
+	}
+
+	payload.AddrFrom = peerAddress(from, payload.AddrFrom)
+
+	debugf("%s doesn't have %s %x\n", payload.AddrFrom, payload.Type, payload.ID)
+	if payload.Type == "block" {
+		takeBlockRequest(payload.ID)
+	}
+	if payload.Type == "tx" {
+		txArrived(payload.ID)
+	}
+}
@@ -56,6 +56,7 @@ func (u UTXOSet) Reindex() {
 
 func (u UTXOSet) Update(block *Block) {
 	db := u.Blockchain.Db
+	medianTime := u.Blockchain.GetMedianTimePast(block.PrevBlockHash)
 
 	err := db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(utxoBucket))
@@ -63,15 +64,10 @@ func (u UTXOSet) Update(block *Block) {
 		for _, tx := range block.Transactions {
 			if tx.IsCoinbase() == false {
 				for _, vin := range tx.Vin {
-					updatedOuts := TXOutputs{}
 					outsBytes := b.Get(vin.Txid)
-					outs := DeserializeOutputs(outsBytes)
+					updatedOuts := DeserializeOutputs(outsBytes)
+					delete(updatedOuts.Outputs, vin.Vout)
 
-					for outIdx, out := range outs.Outputs {
-						if outIdx != vin.Vout {
-							updatedOuts.Outputs = append(updatedOuts.Outputs, out)
-						}
-					}
 					if len(updatedOuts.Outputs) == 0 {
 						err := b.Delete(vin.Txid)
 						if err != nil {
@@ -86,9 +82,9 @@ func (u UTXOSet) Update(block *Block) {
 				}
 			}
 
-			newOutputs := TXOutputs{}
-			for _, out := range tx.Vout {
-				newOutputs.Outputs = append(newOutputs.Outputs, out)
+			newOutputs := TXOutputs{make(map[int]TXOutput), block.Height, medianTime}
+			for outIdx, out := range tx.Vout {
+				newOutputs.Outputs[outIdx] = out
 			}
 
 			err := b.Put(tx.ID, newOutputs.Serialize())
@@ -127,7 +123,7 @@ func (u UTXOSet) CountTransactions() int {
 	return counter
 }
 
-func (u UTXOSet) FindUTXO(pubKeyHash []byte) []TXOutput {
+func (u UTXOSet) FindUTXO(lockingScript []byte) []TXOutput {
 	var UTXOs []TXOutput
 	db := u.Blockchain.Db
 
@@ -139,7 +135,7 @@ func (u UTXOSet) FindUTXO(pubKeyHash []byte) []TXOutput {
 			outs := DeserializeOutputs(v)
 
 			for _, out := range outs.Outputs {
-				if out.IsLockedWithKey(pubKeyHash) {
+				if out.IsLockedWithScript(lockingScript) {
 					UTXOs = append(UTXOs, out)
 				}
 			}
@@ -155,33 +151,23 @@ func (u UTXOSet) FindUTXO(pubKeyHash []byte) []TXOutput {
 	return UTXOs
 }
 
-func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[string][]int) {
-	unspentOutputs := make(map[string][]int)
-	accumulated := 0
-	db := u.Blockchain.Db
+func (u UTXOSet) FindOutputs(txID []byte) (TXOutputs, bool) {
+	var outs TXOutputs
+	found := false
 
-	err := db.View(func(tx *bolt.Tx) error {
+	err := u.Blockchain.Db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(utxoBucket))
-		c := b.Cursor()
-
-		for k, v := c.First(); k != nil; k, v = c.Next() {
-			txID := hex.EncodeToString(k)
-			outs := DeserializeOutputs(v)
-
-			for outIDx, out := range outs.Outputs {
-				if out.IsLockedWithKey(pubKeyHash) && accumulated < amount {
-					accumulated += out.Value
-					unspentOutputs[txID] = append(unspentOutputs[txID], outIDx)
-				}
-			}
+		data := b.Get(txID)
+		if data != nil {
+			outs = DeserializeOutputs(data)
+			found = true
 		}
 
 		return nil
 	})
-
 	if err != nil {
-		log.Panicln(err)
+		log.Panic(err)
 	}
 
-	return accumulated, unspentOutputs
+	return outs, found
 }
@@ -2,57 +2,101 @@ package domain
 
 import (
 	"bytes"
-	"crypto/ecdsa"
-	"crypto/elliptic"
-	"crypto/rand"
 	"crypto/sha256"
 	"encoding/gob"
 	"fmt"
 	"github.com/aleksannder/gochain/util"
 	"log"
-	"math/big"
 	"os"
 )
 
-const version = byte(0x00)
 const walletFile = "wallet_%s.dat"
 const addressChecksumLen = 4
 
 type Wallet struct {
-	PrivateKey ecdsa.PrivateKey
+	Scheme     byte
+	PrivateKey []byte
 	PublicKey  []byte
+	Path       []uint32 // Derivation path of HD keys
 }
 
 type Wallets struct {
-	Wallets map[string]*Wallet
+	Wallets   map[string]*Wallet
+	MultiSig  map[string][]byte // Redeem scripts of multisig addresses
+	WatchOnly map[string][]byte // Public keys of watched addresses, nil when only the address is known
+	HD        *HDChain
+
+	seed     []byte
+	mnemonic string
+
+	kdf    *walletKDF
+	nonce  []byte
+	sealed []byte
+	key    []byte // Derived from the passphrase while the wallet is unlocked
 }
 
-func NewWallet() *Wallet {
-	private, public := newKeyPair()
-	return &Wallet{private, public}
+// walletStore is the layout of the wallet file, private keys are only kept sealed.
+// Files written before encryption decode into it with the keys still in Wallets.
+type walletStore struct {
+	Wallets   map[string]*Wallet
+	MultiSig  map[string][]byte
+	WatchOnly map[string][]byte
+	HD        *HDChain
+	KDF       *walletKDF
+	Nonce     []byte
+	Sealed    []byte
+}
+
+func NewWallet(scheme SignatureScheme) *Wallet {
+	private, err := scheme.GenerateKey()
+	if err != nil {
+		log.Panic(err)
+	}
+	public, err := scheme.PublicKey(private)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return &Wallet{scheme.ID(), private, public, nil}
 }
 
 func (w *Wallet) GetAddress() []byte {
 	pubKeyHash := util.HashPubKey(w.PublicKey)
 
-	versionedPayload := append([]byte{version}, pubKeyHash...)
-	checksum := checksum(versionedPayload)
+	return encodeAddress(w.signatureScheme().AddressVersion(), pubKeyHash)
+}
 
-	fullPayload := append(versionedPayload, checksum...)
-	address := util.Base58Encode(fullPayload)
+func (w *Wallet) SignHash(hash []byte) ([]byte, error) {
+	if w.PrivateKey == nil {
+		return nil, errWalletLocked
+	}
 
-	return address
+	return w.signatureScheme().Sign(w.PrivateKey, hash)
 }
 
-func newKeyPair() (ecdsa.PrivateKey, []byte) {
-	curve := elliptic.P256()
-	private, err := ecdsa.GenerateKey(curve, rand.Reader)
+func (w *Wallet) signatureScheme() SignatureScheme {
+	scheme, err := GetSignatureScheme(w.Scheme)
 	if err != nil {
 		log.Panic(err)
 	}
-	pubKey := append(private.PublicKey.X.Bytes(), private.PublicKey.Y.Bytes()...)
 
-	return *private, pubKey
+	return scheme
+}
+
+func NewMultiSigAddress(redeemScript []byte) []byte {
+	scriptHash := util.HashPubKey(redeemScript)
+
+	return encodeAddress(chainParams.ScriptHashVersion, scriptHash)
+}
+
+func encodeAddress(version byte, hash []byte) []byte {
+	versionedPayload := append([]byte{version}, hash...)
+	checksum := checksum(versionedPayload)
+
+	fullPayload := append(versionedPayload, checksum...)
+	address := util.Base58Encode(fullPayload)
+
+	return address
 }
 
 func checksum(payload []byte) []byte {
@@ -63,26 +107,24 @@ func checksum(payload []byte) []byte {
 }
 
 func ValidateAddress(address string) bool {
-	pubKeyHash := util.Base58Decode([]byte(address))
-	actualChecksum := pubKeyHash[len(pubKeyHash)-addressChecksumLen:]
-	version := pubKeyHash[0]
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-addressChecksumLen]
-	targetChecksum := checksum(append([]byte{version}, pubKeyHash...))
+	_, err := ParseAddress(address)
 
-	return bytes.Compare(actualChecksum, targetChecksum) == 0
+	return err == nil
 }
 
 func NewWallets(nodeID string) (*Wallets, error) {
 	wallets := Wallets{}
 	wallets.Wallets = make(map[string]*Wallet)
+	wallets.MultiSig = make(map[string][]byte)
+	wallets.WatchOnly = make(map[string][]byte)
 
 	err := wallets.LoadFromFile(nodeID)
 
 	return &wallets, err
 }
 
-func (ws *Wallets) CreateWallet() string {
-	wallet := NewWallet()
+func (ws *Wallets) CreateWallet(scheme SignatureScheme) string {
+	wallet := NewWallet(scheme)
 	address := fmt.Sprintf("%s", wallet.GetAddress())
 
 	ws.Wallets[address] = wallet
@@ -90,22 +132,87 @@ func (ws *Wallets) CreateWallet() string {
 	return address
 }
 
+func (ws *Wallets) CreateMultiSig(m int, pubKeys [][]byte) (string, error) {
+	redeemScript, err := NewMultiSigScript(m, pubKeys)
+	if err != nil {
+		return "", err
+	}
+	address := fmt.Sprintf("%s", NewMultiSigAddress(redeemScript))
+
+	ws.MultiSig[address] = redeemScript
+
+	return address, nil
+}
+
 func (ws *Wallets) GetWallet(address string) Wallet {
 	return *ws.Wallets[address]
 }
 
+func (ws *Wallets) GetWalletByPubKey(pubKey []byte) *Wallet {
+	for _, wallet := range ws.Wallets {
+		if bytes.Equal(wallet.PublicKey, pubKey) {
+			return wallet
+		}
+	}
+
+	return nil
+}
+
+func (ws *Wallets) GetWalletByPubKeyHash(pubKeyHash []byte) *Wallet {
+	for _, wallet := range ws.Wallets {
+		if wallet.PrivateKey != nil && bytes.Equal(util.HashPubKey(wallet.PublicKey), pubKeyHash) {
+			return wallet
+		}
+	}
+
+	return nil
+}
+
 func (ws *Wallets) GetAddresses() []string {
 	var addresses []string
 
 	for address := range ws.Wallets {
 		addresses = append(addresses, address)
 	}
+	for address := range ws.MultiSig {
+		addresses = append(addresses, address)
+	}
+	for address := range ws.WatchOnly {
+		addresses = append(addresses, address)
+	}
 
 	return addresses
 }
 
+// merge adds what the unlocked other holds and ws doesn't: keys, multisig and watched
+// addresses, and HD indexes further along
+func (ws *Wallets) merge(other *Wallets) {
+	for address, wallet := range other.Wallets {
+		if _, ok := ws.Wallets[address]; !ok {
+			ws.Wallets[address] = &Wallet{wallet.Scheme, append([]byte{}, wallet.PrivateKey...), wallet.PublicKey, wallet.Path}
+		}
+	}
+	for address, redeemScript := range other.MultiSig {
+		if _, ok := ws.MultiSig[address]; !ok {
+			ws.MultiSig[address] = redeemScript
+		}
+	}
+	for address, pubKey := range other.WatchOnly {
+		if _, ok := ws.WatchOnly[address]; !ok {
+			ws.WatchOnly[address] = pubKey
+		}
+	}
+	if ws.HD != nil && other.HD != nil {
+		for branch, index := range other.HD.NextIndex {
+			if index > ws.HD.NextIndex[branch] {
+				ws.HD.NextIndex[branch] = index
+			}
+		}
+	}
+}
+
 func (ws *Wallets) LoadFromFile(nodeID string) error {
-	walletFile := fmt.Sprintf(walletFile, nodeID)
+	walletFile := config.dataFile(fmt.Sprintf(walletFile, nodeID))
 	if _, err := os.Stat(walletFile); os.IsNotExist(err) {
 		return err
 	}
@@ -115,85 +222,71 @@ func (ws *Wallets) LoadFromFile(nodeID string) error {
 		log.Panic(err)
 	}
 
-	var wallets Wallets
+	var store walletStore
 	decoder := gob.NewDecoder(bytes.NewReader(fileContent))
-	err = decoder.Decode(&wallets)
+	err = decoder.Decode(&store)
 	if err != nil {
 		log.Panic(err)
 	}
 
-	ws.Wallets = wallets.Wallets
+	ws.Wallets = store.Wallets
+	if ws.Wallets == nil {
+		ws.Wallets = make(map[string]*Wallet)
+	}
+	if store.MultiSig != nil {
+		ws.MultiSig = store.MultiSig
+	}
+	if store.WatchOnly != nil {
+		ws.WatchOnly = store.WatchOnly
+	}
+	ws.HD = store.HD
+	ws.kdf, ws.nonce, ws.sealed, ws.key = store.KDF, store.Nonce, store.Sealed, nil
 
 	return nil
 }
 
-func (ws Wallets) SaveToFile(nodeID string) {
-	var content bytes.Buffer
-	walletFile := fmt.Sprintf(walletFile, nodeID)
-	encoder := gob.NewEncoder(&content)
-	err := encoder.Encode(ws)
-	if err != nil {
-		log.Panic(err)
+// SaveToFile atomically replaces the wallet file, which is only written encrypted
+func (ws *Wallets) SaveToFile(nodeID string) {
+	if !ws.IsEncrypted() {
+		log.Panic(errWalletNotEncrypted)
 	}
-
-	err = os.WriteFile(walletFile, content.Bytes(), 0644)
-	if err != nil {
-		log.Panic(err)
+	if !ws.IsLocked() {
+		err := ws.seal()
+		if err != nil {
+			log.Panic(err)
+		}
 	}
-}
-
-type _PrivateKey struct {
-	D          *big.Int
-	PublicKeyX *big.Int
-	PublicKeyY *big.Int
-}
 
-func (w *Wallet) GobEncode() ([]byte, error) {
-	privKey := &_PrivateKey{
-		D:          w.PrivateKey.D,
-		PublicKeyX: w.PrivateKey.PublicKey.X,
-		PublicKeyY: w.PrivateKey.PublicKey.Y,
+	store := walletStore{make(map[string]*Wallet), ws.MultiSig, ws.WatchOnly, ws.HD, ws.kdf, ws.nonce, ws.sealed}
+	for address, wallet := range ws.Wallets {
+		store.Wallets[address] = &Wallet{wallet.Scheme, nil, wallet.PublicKey, wallet.Path}
 	}
 
-	var buf bytes.Buffer
-
-	encoder := gob.NewEncoder(&buf)
-	err := encoder.Encode(privKey)
+	var content bytes.Buffer
+	walletFile := config.dataFile(fmt.Sprintf(walletFile, nodeID))
+	encoder := gob.NewEncoder(&content)
+	err := encoder.Encode(store)
 	if err != nil {
 		log.Panic(err)
 	}
 
-	_, err = buf.Write(w.PublicKey)
+	tmpFile := walletFile + ".tmp"
+	file, err := os.OpenFile(tmpFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		log.Panic(err)
 	}
-
-	return buf.Bytes(), nil
-}
-
-func (w *Wallet) GobDecode(data []byte) error {
-	buf := bytes.NewBuffer(data)
-	var privKey _PrivateKey
-
-	decoder := gob.NewDecoder(buf)
-	err := decoder.Decode(&privKey)
-	if err != nil {
-		log.Panic(err)
+	_, err = file.Write(content.Bytes())
+	if err == nil {
+		err = file.Sync()
 	}
-
-	w.PrivateKey = ecdsa.PrivateKey{
-		D: privKey.D,
-		PublicKey: ecdsa.PublicKey{
-			Curve: elliptic.P256(),
-			X:     privKey.PublicKeyX,
-			Y:     privKey.PublicKeyY,
-		},
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFile, walletFile)
 	}
-	w.PublicKey = make([]byte, buf.Len())
-	_, err = buf.Read(w.PublicKey)
 	if err != nil {
+		os.Remove(tmpFile)
 		log.Panic(err)
 	}
-
-	return nil
 }
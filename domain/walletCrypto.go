@@ -0,0 +1,182 @@
+package domain
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/gob"
+	"errors"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Private keys are sealed with XChaCha20-Poly1305 under a key derived from the
+// passphrase with scrypt, public data stays readable while the wallet is locked
+const (
+	walletScryptN  = 1 << 15
+	walletScryptR  = 8
+	walletScryptP  = 1
+	walletSaltLen  = 16
+	walletKeyLen   = chacha20poly1305.KeySize
+	walletSealInfo = "gochain wallet"
+)
+
+var (
+	errWalletLocked       = errors.New("wallet is locked, unlock it with the passphrase first")
+	errWrongPassphrase    = errors.New("wrong wallet passphrase")
+	errWalletNotEncrypted = errors.New("wallet has no passphrase set")
+	errEmptyPassphrase    = errors.New("passphrase can't be empty")
+)
+
+type walletKDF struct {
+	Salt []byte
+	N    int
+	R    int
+	P    int
+}
+
+// walletSecrets is the plaintext that gets sealed in the wallet file
+type walletSecrets struct {
+	Keys     map[string][]byte // Private keys keyed by address
+	Seed     []byte
+	Mnemonic string
+}
+
+func newWalletKDF() (*walletKDF, error) {
+	salt := make([]byte, walletSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	return &walletKDF{salt, walletScryptN, walletScryptR, walletScryptP}, nil
+}
+
+func (kdf *walletKDF) deriveKey(passphrase []byte) ([]byte, error) {
+	return scrypt.Key(passphrase, kdf.Salt, kdf.N, kdf.R, kdf.P, walletKeyLen)
+}
+
+func (ws *Wallets) IsEncrypted() bool {
+	return ws.kdf != nil
+}
+
+func (ws *Wallets) IsLocked() bool {
+	return ws.IsEncrypted() && ws.key == nil
+}
+
+// Unlock decrypts the private keys of the wallet
+func (ws *Wallets) Unlock(passphrase []byte) error {
+	if !ws.IsEncrypted() {
+		return errWalletNotEncrypted
+	}
+
+	key, err := ws.kdf.deriveKey(passphrase)
+	if err != nil {
+		return err
+	}
+
+	return ws.unlockWithKey(key)
+}
+
+// unlockWithKey is Unlock with the key derived from the passphrase
+func (ws *Wallets) unlockWithKey(key []byte) error {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return err
+	}
+	plaintext, err := aead.Open(nil, ws.nonce, ws.sealed, []byte(walletSealInfo))
+	if err != nil {
+		return errWrongPassphrase
+	}
+
+	var secrets walletSecrets
+	err = gob.NewDecoder(bytes.NewReader(plaintext)).Decode(&secrets)
+	if err != nil {
+		return err
+	}
+
+	for address, privKey := range secrets.Keys {
+		if wallet, ok := ws.Wallets[address]; ok {
+			wallet.PrivateKey = privKey
+		}
+	}
+	ws.seed, ws.mnemonic = secrets.Seed, secrets.Mnemonic
+	ws.key = append([]byte{}, key...)
+
+	return nil
+}
+
+// Lock wipes the decrypted private keys from memory
+func (ws *Wallets) Lock() {
+	if !ws.IsEncrypted() {
+		return
+	}
+
+	for _, wallet := range ws.Wallets {
+		wipe(wallet.PrivateKey)
+		wallet.PrivateKey = nil
+	}
+	wipe(ws.seed)
+	wipe(ws.key)
+	ws.seed, ws.mnemonic, ws.key = nil, "", nil
+}
+
+// SetPassphrase encrypts the wallet with a new passphrase, the wallet must be unlocked
+func (ws *Wallets) SetPassphrase(passphrase []byte) error {
+	if len(passphrase) == 0 {
+		return errEmptyPassphrase
+	}
+	if ws.IsLocked() {
+		return errWalletLocked
+	}
+
+	kdf, err := newWalletKDF()
+	if err != nil {
+		return err
+	}
+	key, err := kdf.deriveKey(passphrase)
+	if err != nil {
+		return err
+	}
+
+	wipe(ws.key)
+	ws.kdf, ws.key = kdf, key
+
+	return ws.seal()
+}
+
+// seal encrypts the private keys with a fresh nonce
+func (ws *Wallets) seal() error {
+	secrets := walletSecrets{make(map[string][]byte), ws.seed, ws.mnemonic}
+	for address, wallet := range ws.Wallets {
+		if wallet.PrivateKey != nil {
+			secrets.Keys[address] = wallet.PrivateKey
+		}
+	}
+
+	var plaintext bytes.Buffer
+	err := gob.NewEncoder(&plaintext).Encode(secrets)
+	if err != nil {
+		return err
+	}
+	defer wipe(plaintext.Bytes())
+
+	aead, err := chacha20poly1305.NewX(ws.key)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	ws.nonce = nonce
+	ws.sealed = aead.Seal(nil, nonce, plaintext.Bytes(), []byte(walletSealInfo))
+
+	return nil
+}
+
+func wipe(data []byte) {
+	for i := range data {
+		data[i] = 0
+	}
+}
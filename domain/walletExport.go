@@ -0,0 +1,169 @@
+package domain
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aleksannder/gochain/util"
+)
+
+const (
+	dumpMnemonicPrefix = "# mnemonic: "
+	dumpSchemePrefix   = "# hdscheme: "
+)
+
+// Exported private keys look like Bitcoin's WIF: the network's private key version,
+// scheme and key, followed by the address checksum and encoded with Base58
+func EncodePrivateKey(wallet *Wallet) (string, error) {
+	if wallet.PrivateKey == nil {
+		return "", errWalletLocked
+	}
+
+	payload := append([]byte{chainParams.PrivateKeyVersion, wallet.Scheme}, wallet.PrivateKey...)
+	payload = append(payload, checksum(payload)...)
+
+	return string(util.Base58Encode(payload)), nil
+}
+
+// DecodePrivateKey parses an exported key into a wallet, deriving its public key
+func DecodePrivateKey(encoded string) (*Wallet, error) {
+	payload, err := util.Base58Decode([]byte(strings.TrimSpace(encoded)))
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) < 2+addressChecksumLen || payload[0] != chainParams.PrivateKeyVersion {
+		return nil, errors.New("not an exported private key")
+	}
+
+	data := payload[:len(payload)-addressChecksumLen]
+	if !bytes.Equal(checksum(data), payload[len(payload)-addressChecksumLen:]) {
+		return nil, errors.New("private key checksum mismatch")
+	}
+
+	scheme, err := GetSignatureScheme(data[1])
+	if err != nil {
+		return nil, err
+	}
+	privKey := append([]byte{}, data[2:]...)
+	public, err := scheme.PublicKey(privKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Wallet{scheme.ID(), privKey, public, nil}, nil
+}
+
+// ImportKey adds wallet under its address, reporting whether the key was new
+func (ws *Wallets) ImportKey(wallet *Wallet) (string, bool) {
+	address := fmt.Sprintf("%s", wallet.GetAddress())
+	if existing, ok := ws.Wallets[address]; ok && existing.PrivateKey != nil {
+		return address, false
+	}
+
+	ws.Wallets[address] = wallet
+	delete(ws.WatchOnly, address)
+
+	return address, true
+}
+
+// Dump writes every key of the wallet as text, one exported key per line followed by
+// its address and derivation path. HD wallets also get their mnemonic in a comment.
+func (ws *Wallets) Dump(w io.Writer) error {
+	if ws.IsLocked() {
+		return errWalletLocked
+	}
+
+	lines := []string{
+		"# Wallet dump created by gochain",
+		fmt.Sprintf("# Created on %s", time.Now().UTC().Format(time.RFC3339)),
+	}
+	if ws.HasSeed() {
+		scheme, err := GetSignatureScheme(ws.HD.Scheme)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, dumpMnemonicPrefix+ws.mnemonic, dumpSchemePrefix+scheme.Name())
+	}
+	lines = append(lines, "")
+
+	var addresses []string
+	for address := range ws.Wallets {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+
+	for _, address := range addresses {
+		wallet := ws.Wallets[address]
+		key, err := EncodePrivateKey(wallet)
+		if err != nil {
+			return err
+		}
+
+		line := fmt.Sprintf("%s %s", key, address)
+		if wallet.Path != nil {
+			line += " " + formatHDPath(wallet.Path)
+		}
+		lines = append(lines, line)
+	}
+
+	_, err := io.WriteString(w, strings.Join(lines, "\n")+"\n")
+
+	return err
+}
+
+// ImportDump reads a file written by Dump and returns the addresses of the imported
+// keys. The mnemonic is only taken over when the wallet has no HD seed yet.
+func (ws *Wallets) ImportDump(r io.Reader) ([]string, error) {
+	var imported []string
+	var mnemonic, schemeName string
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		switch {
+		case strings.HasPrefix(line, dumpMnemonicPrefix):
+			mnemonic = strings.TrimPrefix(line, dumpMnemonicPrefix)
+			continue
+		case strings.HasPrefix(line, dumpSchemePrefix):
+			schemeName = strings.TrimPrefix(line, dumpSchemePrefix)
+			continue
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+		}
+
+		fields := strings.Fields(line)
+		wallet, err := DecodePrivateKey(fields[0])
+		if err != nil {
+			return imported, err
+		}
+		if len(fields) > 1 && fields[1] != fmt.Sprintf("%s", wallet.GetAddress()) {
+			return imported, fmt.Errorf("key of %s doesn't match its address", fields[1])
+		}
+
+		if address, added := ws.ImportKey(wallet); added {
+			imported = append(imported, address)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return imported, err
+	}
+
+	if mnemonic != "" && !ws.HasSeed() {
+		scheme, err := GetSignatureSchemeByName(schemeName)
+		if err != nil {
+			return imported, err
+		}
+		if err := ws.SetMnemonic(mnemonic, scheme); err != nil {
+			return imported, err
+		}
+	}
+
+	return imported, nil
+}
@@ -0,0 +1,49 @@
+package domain
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/aleksannder/gochain/util"
+)
+
+// ImportAddress watches an address, or the address of a hex encoded public key, without
+// holding its private key
+func (ws *Wallets) ImportAddress(addressOrPubKey string) (string, error) {
+	address := addressOrPubKey
+	var pubKey []byte
+
+	if !ValidateAddress(address) {
+		var err error
+		pubKey, err = hex.DecodeString(addressOrPubKey)
+		if err != nil {
+			return "", errors.New("neither a valid address nor a hex public key")
+		}
+
+		scheme := schemeForPubKey(pubKey)
+		if scheme == nil {
+			return "", fmt.Errorf("public key of %d bytes doesn't match any signature scheme", len(pubKey))
+		}
+		address = fmt.Sprintf("%s", encodeAddress(scheme.AddressVersion(), util.HashPubKey(pubKey)))
+	}
+
+	if _, ok := ws.Wallets[address]; ok {
+		return "", fmt.Errorf("the wallet already holds the key of %s", address)
+	}
+	if _, ok := ws.MultiSig[address]; ok {
+		return "", fmt.Errorf("%s is already a multisig address of the wallet", address)
+	}
+
+	if pubKey != nil || ws.WatchOnly[address] == nil {
+		ws.WatchOnly[address] = pubKey
+	}
+
+	return address, nil
+}
+
+func (ws *Wallets) IsWatchOnly(address string) bool {
+	_, ok := ws.WatchOnly[address]
+
+	return ok
+}
@@ -4,7 +4,15 @@ go 1.23.2
 
 require (
 	github.com/boltdb/bolt v1.3.1
+	github.com/btcsuite/btcd/btcec/v2 v2.3.4
+	github.com/tyler-smith/go-bip39 v1.1.0
 	golang.org/x/crypto v0.32.0
+	golang.org/x/term v0.29.0
 )
 
-require golang.org/x/sys v0.30.0 // indirect
+require (
+	github.com/btcsuite/btcd/chaincfg/chainhash v1.0.1 // indirect
+	github.com/decred/dcrd/crypto/blake256 v1.0.0 // indirect
+	github.com/decred/dcrd/dcrec/secp256k1/v4 v4.0.1 // indirect
+	golang.org/x/sys v0.30.0 // indirect
+)
@@ -3,6 +3,7 @@ package util
 import (
 	"bytes"
 	"crypto/sha256"
+	"fmt"
 	"golang.org/x/crypto/ripemd160"
 	"log"
 	"math/big"
@@ -24,38 +25,43 @@ func Base58Encode(input []byte) []byte {
 		result = append(result, b58Alphabet[mod.Int64()])
 	}
 
-	ReverseBytes(result)
-	for b := range input {
-		if b == 0x00 {
-			result = append([]byte{b58Alphabet[0]}, result...)
-		} else {
+	// Every leading zero byte is written as the first letter of the alphabet
+	for _, b := range input {
+		if b != 0x00 {
 			break
 		}
+		result = append(result, b58Alphabet[0])
 	}
+	ReverseBytes(result)
 
 	return result
 }
-func Base58Decode(input []byte) []byte {
+
+// Base58Decode fails on characters outside the alphabet instead of decoding them as garbage
+func Base58Decode(input []byte) ([]byte, error) {
 	result := big.NewInt(0)
 	zeroBytes := 0
 
-	for b := range input {
-		if b == 0x00 {
-			zeroBytes++
+	for _, b := range input {
+		if b != b58Alphabet[0] {
+			break
 		}
+		zeroBytes++
 	}
 
-	payload := input[zeroBytes:]
-	for _, b := range payload {
+	base := big.NewInt(int64(len(b58Alphabet)))
+	for i, b := range input[zeroBytes:] {
 		charIndex := bytes.IndexByte(b58Alphabet, b)
-		result.Mul(result, big.NewInt(58))
+		if charIndex < 0 {
+			return nil, fmt.Errorf("invalid base58 character %q at position %d", b, zeroBytes+i)
+		}
+		result.Mul(result, base)
 		result.Add(result, big.NewInt(int64(charIndex)))
 	}
 
-	decoded := result.Bytes()
-	decoded = append(bytes.Repeat([]byte{byte(0x00)}, zeroBytes), decoded...)
+	decoded := append(make([]byte, zeroBytes), result.Bytes()...)
 
-	return decoded
+	return decoded, nil
 }
 func HashPubKey(pubKey []byte) []byte {
 	publicSHA256 := sha256.Sum256(pubKey)
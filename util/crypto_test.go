@@ -0,0 +1,48 @@
+package util
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestBase58(t *testing.T) {
+	tests := []struct {
+		hex     string
+		encoded string
+	}{
+		{"", ""},
+		{"00", "1"},
+		{"0000", "11"},
+		{"61", "2g"},
+		{"626262", "a3gV"},
+		{"68656c6c6f20776f726c64", "StV1DL6CwTryKyV"},
+		{"0000287fb4cd", "11233QC4"},
+		{"00010966776006953d5567439e5e39f86a0d273beed61967f6", "16UwLL9Risc3QfPqBUvKofHmBQ7wMtjvM"},
+	}
+
+	for _, test := range tests {
+		data, err := hex.DecodeString(test.hex)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if encoded := Base58Encode(data); string(encoded) != test.encoded {
+			t.Errorf("Base58Encode(%s) = %q, expected %q", test.hex, encoded, test.encoded)
+		}
+		decoded, err := Base58Decode([]byte(test.encoded))
+		if err != nil {
+			t.Errorf("Base58Decode(%q) failed: %s", test.encoded, err)
+		} else if !bytes.Equal(decoded, data) {
+			t.Errorf("Base58Decode(%q) = %x, expected %s", test.encoded, decoded, test.hex)
+		}
+	}
+}
+
+func TestBase58DecodeInvalid(t *testing.T) {
+	for _, input := range []string{"0", "O", "I", "l", "1l", "StV1DL6CwTryKy0", "abc+", " 2g", "2g\n", "é"} {
+		if decoded, err := Base58Decode([]byte(input)); err == nil {
+			t.Errorf("Base58Decode(%q) = %x, expected an error", input, decoded)
+		}
+	}
+}